@@ -0,0 +1,123 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+)
+
+// Environment variable holding the authentication token for all registries.
+// SOCI_INDEXER_AUTH_<HOST> sets it for a single host, e.g. SOCI_INDEXER_AUTH_REGISTRY_EXAMPLE_COM_5000.
+const authEnvVar = "SOCI_INDEXER_AUTH"
+
+var (
+	authStdin bool
+	authFiles []string
+)
+
+// authSource finds the registry authentication token without exposing it on the command line
+type authSource struct {
+	flag   string
+	stdin  io.Reader
+	files  []string
+	getenv func(string) string
+}
+
+// Pick the authentication token for a registry host. The first source that is set wins:
+// --auth, --auth-stdin, --auth-file for the host, --auth-file for all hosts,
+// SOCI_INDEXER_AUTH_<HOST> and SOCI_INDEXER_AUTH. An empty token means no explicit authentication.
+func (source authSource) resolve(registry string) (string, error) {
+	if source.flag != "" {
+		return source.flag, nil
+	}
+
+	if source.stdin != nil {
+		token, err := io.ReadAll(source.stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read authentication token from stdin: %w", err)
+		}
+		return nonEmptyToken(string(token), "stdin")
+	}
+
+	var hostFile, allHostsFile string
+	for _, value := range source.files {
+		host, file := parseHostFlag(value)
+		if host == registryutils.AllHosts {
+			allHostsFile = file
+		} else if strings.EqualFold(host, registry) {
+			hostFile = file
+		}
+	}
+	for _, file := range []string{hostFile, allHostsFile} {
+		if file == "" {
+			continue
+		}
+		token, err := os.ReadFile(file)
+		if err != nil {
+			// the error only names the file, never its content
+			return "", fmt.Errorf("failed to read authentication token file: %w", err)
+		}
+		return nonEmptyToken(string(token), file)
+	}
+
+	for _, name := range []string{authEnvVarForHost(registry), authEnvVar} {
+		if token := source.getenv(name); token != "" {
+			return nonEmptyToken(token, name)
+		}
+	}
+
+	return "", nil
+}
+
+// Pick the authentication token set for a single registry host, like a mirror: --auth-file for the host or
+// SOCI_INDEXER_AUTH_<HOST>. Tokens for all hosts are left out, they belong to the registry being indexed.
+func (source authSource) resolveHost(registry string) (string, error) {
+	for _, value := range source.files {
+		host, file := parseHostFlag(value)
+		if host == registryutils.AllHosts || !strings.EqualFold(host, registry) {
+			continue
+		}
+		token, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read authentication token file: %w", err)
+		}
+		return nonEmptyToken(string(token), file)
+	}
+	if token := source.getenv(authEnvVarForHost(registry)); token != "" {
+		return nonEmptyToken(token, authEnvVarForHost(registry))
+	}
+	return "", nil
+}
+
+// Name of the environment variable holding the authentication token for a single host
+func authEnvVarForHost(registry string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, registry)
+	return authEnvVar + "_" + name
+}
+
+// Trim the trailing newline editors and echo add, and register the token so it never gets logged
+func nonEmptyToken(token string, source string) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("authentication token from " + source + " is empty")
+	}
+	log.RegisterSecret(token)
+	return token, nil
+}
@@ -0,0 +1,169 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveAuth(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	allHostsFile := writeFile("all", "all:file\n")
+	hostFile := writeFile("host", "host:file\n")
+	emptyFile := writeFile("empty", "\n")
+
+	env := map[string]string{
+		"SOCI_INDEXER_AUTH": "all:env",
+		"SOCI_INDEXER_AUTH_DESTINATION_EXAMPLE_COM_5000": "destination:env",
+	}
+	getenv := func(name string) string { return env[name] }
+	noEnv := func(string) string { return "" }
+
+	tests := []struct {
+		name      string
+		source    authSource
+		registry  string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "nothing set",
+			source:   authSource{getenv: noEnv},
+			registry: "registry.example.com",
+			expected: "",
+		},
+		{
+			name:     "flag wins",
+			source:   authSource{flag: "user:flag", stdin: strings.NewReader("user:stdin"), files: []string{allHostsFile}, getenv: getenv},
+			registry: "registry.example.com",
+			expected: "user:flag",
+		},
+		{
+			name:     "stdin",
+			source:   authSource{stdin: strings.NewReader("user:stdin\n"), files: []string{allHostsFile}, getenv: getenv},
+			registry: "registry.example.com",
+			expected: "user:stdin",
+		},
+		{
+			name:      "empty stdin",
+			source:    authSource{stdin: strings.NewReader(""), getenv: getenv},
+			registry:  "registry.example.com",
+			expectErr: true,
+		},
+		{
+			name:     "file for all hosts",
+			source:   authSource{files: []string{allHostsFile}, getenv: getenv},
+			registry: "registry.example.com",
+			expected: "all:file",
+		},
+		{
+			name:     "file for host wins over file for all hosts",
+			source:   authSource{files: []string{allHostsFile, "registry.example.com=" + hostFile}, getenv: getenv},
+			registry: "registry.example.com",
+			expected: "host:file",
+		},
+		{
+			name:     "file for other host is ignored",
+			source:   authSource{files: []string{"source.example.com=" + hostFile}, getenv: getenv},
+			registry: "registry.example.com",
+			expected: "all:env",
+		},
+		{
+			name:      "empty file",
+			source:    authSource{files: []string{emptyFile}, getenv: getenv},
+			registry:  "registry.example.com",
+			expectErr: true,
+		},
+		{
+			name:      "missing file",
+			source:    authSource{files: []string{filepath.Join(dir, "missing")}, getenv: getenv},
+			registry:  "registry.example.com",
+			expectErr: true,
+		},
+		{
+			name:     "environment for host",
+			source:   authSource{getenv: getenv},
+			registry: "destination.example.com:5000",
+			expected: "destination:env",
+		},
+		{
+			name:     "environment for all hosts",
+			source:   authSource{getenv: getenv},
+			registry: "source.example.com",
+			expected: "all:env",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := test.source.resolve(test.registry)
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve returned error: %v", err)
+			}
+			if token != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, token)
+			}
+		})
+	}
+}
+
+func TestResolveHostAuth(t *testing.T) {
+	dir := t.TempDir()
+	hostFile := filepath.Join(dir, "host")
+	if err := os.WriteFile(hostFile, []byte("mirror:file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"SOCI_INDEXER_AUTH":                         "all:env",
+		"SOCI_INDEXER_AUTH_MIRROR_EXAMPLE_COM_5000": "mirror:env",
+	}
+	source := authSource{flag: "all:flag", files: []string{hostFile, "mirror.example.com=" + hostFile}, getenv: func(name string) string { return env[name] }}
+
+	tests := []struct {
+		registry string
+		expected string
+	}{
+		{"mirror.example.com", "mirror:file"},
+		{"mirror.example.com:5000", "mirror:env"},
+		{"other.example.com", ""},
+	}
+	for _, test := range tests {
+		token, err := source.resolveHost(test.registry)
+		if err != nil {
+			t.Fatalf("resolveHost returned error: %v", err)
+		}
+		if token != test.expected {
+			t.Errorf("expected %q for %s, got %q", test.expected, test.registry, token)
+		}
+	}
+}
+
+func TestAuthEnvVarForHost(t *testing.T) {
+	tests := map[string]string{
+		"docker.io":                 "SOCI_INDEXER_AUTH_DOCKER_IO",
+		"registry.example.com:5000": "SOCI_INDEXER_AUTH_REGISTRY_EXAMPLE_COM_5000",
+		"my-registry.Example.com":   "SOCI_INDEXER_AUTH_MY_REGISTRY_EXAMPLE_COM",
+	}
+	for host, expected := range tests {
+		if name := authEnvVarForHost(host); name != expected {
+			t.Errorf("expected %s for %s, got %s", expected, host, name)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configEnvPrefix starts the environment variables overriding settings, like SOCI_INDEXER_RETRY_ATTEMPTS
+	configEnvPrefix = "SOCI_INDEXER_"
+	configFlag      = "config"
+	// registriesKey holds per-registry settings in config files
+	registriesKey = "registries"
+
+	configFormatYAML = "yaml"
+	configFormatTOML = "toml"
+)
+
+// configFile is the config file to read, set from command line flags
+var configFile string
+
+// hostListFlags take HOST[=true|false] values, registries set them with true or false in config files
+var hostListFlags = []string{"plain-http", "insecure-skip-tls-verify"}
+
+// hostValueFlags take [HOST=]VALUE values, registries set their own value in config files
+var hostValueFlags = []string{
+	"auth-file", "ca-file", "cert-file", "key-file",
+	"aws-profile", "aws-role-arn", "aws-external-id", "aws-role-session-name",
+	"credential-provider",
+}
+
+// Flags environment variables don't set. SOCI_INDEXER_AUTH[_<HOST>] already holds the token itself, which
+// SOCI_INDEXER_AUTH_FILE and SOCI_INDEXER_AUTH_STDIN would be mistaken for.
+var envIgnoredFlags = []string{"auth", "auth-file", "auth-stdin", "help", "version"}
+
+// Flags config files don't set. Tokens don't belong in files, auth-file or SOCI_INDEXER_AUTH can be used instead.
+var fileIgnoredFlags = []string{"auth", configFlag, "help", "version"}
+
+// Config files looked for when --config isn't given, the first one found is used. The working directory isn't
+// searched, a checked out repository could otherwise run a credential provider or turn off TLS verification.
+func defaultConfigPaths() []string {
+	var dirs []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "soci-indexer"))
+	}
+	dirs = append(dirs, "/etc/soci-indexer")
+
+	var paths []string
+	for _, dir := range dirs {
+		for _, ext := range []string{".yaml", ".yml", ".toml"} {
+			paths = append(paths, filepath.Join(dir, "config"+ext))
+		}
+	}
+	return paths
+}
+
+// Apply environment variables and the config file to flags not given on the command line. The command line wins
+// over environment variables, which win over the config file.
+func loadConfig(flagSets []*pflag.FlagSet, known map[string]bool, getenv func(string) string) (string, error) {
+	for _, flags := range flagSets {
+		if err := applyEnv(flags, getenv); err != nil {
+			return "", err
+		}
+	}
+
+	path := configFile
+	if path == "" {
+		for _, candidate := range defaultConfigPaths() {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return "", nil
+		}
+	}
+
+	config, err := readConfigFile(path)
+	if err != nil {
+		return path, err
+	}
+	values, err := configFlagValues(config, known)
+	if err != nil {
+		return path, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, flags := range flagSets {
+		if err := applyFlagValues(flags, values); err != nil {
+			return path, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return path, nil
+}
+
+// Set flags not given on the command line from SOCI_INDEXER_<FLAG> variables. Flags taking several values split
+// them on commas.
+func applyEnv(flags *pflag.FlagSet, getenv func(string) string) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || slices.Contains(envIgnoredFlags, flag.Name) {
+			return
+		}
+		name := configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flag.Name, "-", "_"))
+		value := getenv(name)
+		if value == "" {
+			return
+		}
+		values := []string{value}
+		if _, ok := flag.Value.(pflag.SliceValue); ok {
+			values = strings.Split(value, ",")
+		}
+		if setErr := setFlag(flag, values); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// Read a YAML or TOML config file, picked by its extension
+func readConfigFile(path string) (map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]any{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &config)
+	case ".toml":
+		err = toml.Unmarshal(b, &config)
+	default:
+		return nil, fmt.Errorf("unknown config file format %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Turn config file settings into flag values, with the registries section as [HOST=]VALUE values
+func configFlagValues(config map[string]any, known map[string]bool) (map[string][]string, error) {
+	values := map[string][]string{}
+	for name, value := range config {
+		if name == registriesKey {
+			continue
+		}
+		if slices.Contains(fileIgnoredFlags, name) {
+			return nil, fmt.Errorf("%s can't be set in a config file", name)
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown setting %s", name)
+		}
+		flagValues, err := configValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values[name] = flagValues
+	}
+
+	registries, ok := config[registriesKey].(map[string]any)
+	if config[registriesKey] != nil && !ok {
+		return nil, fmt.Errorf("%s must map registry hosts to their settings", registriesKey)
+	}
+	hosts := make([]string, 0, len(registries))
+	for host := range registries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		settings, ok := registries[host].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("settings of registry %s must be a map", host)
+		}
+		for name, value := range settings {
+			switch {
+			case slices.Contains(hostListFlags, name):
+				enabled, ok := value.(bool)
+				if !ok {
+					return nil, fmt.Errorf("%s of registry %s must be true or false", name, host)
+				}
+				if enabled {
+					values[name] = append(values[name], host)
+				} else {
+					values[name] = append(values[name], host+"=false")
+				}
+			case slices.Contains(hostValueFlags, name):
+				hostValues, err := configValues(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s of registry %s: %w", name, host, err)
+				}
+				for _, hostValue := range hostValues {
+					values[name] = append(values[name], host+"="+hostValue)
+				}
+			default:
+				return nil, fmt.Errorf("unknown setting %s for registry %s", name, host)
+			}
+		}
+	}
+	return values, nil
+}
+
+// Turn a config file value, a scalar or a list of scalars, into flag values
+func configValues(value any) ([]string, error) {
+	switch value := value.(type) {
+	case []any:
+		var values []string
+		for _, item := range value {
+			itemValues, err := configValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	case map[string]any:
+		return nil, errors.New("expected a value or a list, got a map")
+	case nil:
+		return nil, nil
+	default:
+		return []string{fmt.Sprint(value)}, nil
+	}
+}
+
+// Set flags not given on the command line or in the environment
+func applyFlagValues(flags *pflag.FlagSet, values map[string][]string) error {
+	for name, flagValues := range values {
+		flag := flags.Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		if err := setFlag(flag, flagValues); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Set a flag as if it was given on the command line, so later sources leave it alone
+func setFlag(flag *pflag.Flag, values []string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(values); err != nil {
+			return err
+		}
+	} else {
+		if len(values) != 1 {
+			return fmt.Errorf("expected a single value, got %d", len(values))
+		}
+		if err := flag.Value.Set(values[0]); err != nil {
+			return err
+		}
+	}
+	flag.Changed = true
+	return nil
+}
+
+// Collect the names of every flag of a command and its subcommands, so config files can set flags of any command
+func knownFlags(cmd *cobra.Command) map[string]bool {
+	known := map[string]bool{}
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		for _, flags := range []*pflag.FlagSet{cmd.LocalFlags(), cmd.PersistentFlags()} {
+			flags.VisitAll(func(flag *pflag.Flag) {
+				known[flag.Name] = true
+			})
+		}
+		for _, child := range cmd.Commands() {
+			visit(child)
+		}
+	}
+	visit(cmd)
+	return known
+}
+
+// The effective settings of flags as a config file would hold them. Empty settings are left out and auth tokens
+// are never included.
+func effectiveConfig(flagSets ...*pflag.FlagSet) (map[string]any, error) {
+	config := map[string]any{}
+	registries := map[string]map[string]any{}
+	var err error
+	for _, flags := range flagSets {
+		flags.VisitAll(func(flag *pflag.Flag) {
+			if err != nil || slices.Contains(fileIgnoredFlags, flag.Name) {
+				return
+			}
+			switch {
+			case slices.Contains(hostListFlags, flag.Name):
+				for _, value := range flag.Value.(pflag.SliceValue).GetSlice() {
+					host, enabled, switchErr := parseHostSwitch(value)
+					if switchErr != nil {
+						err = switchErr
+						return
+					}
+					registrySettings(registries, host)[flag.Name] = enabled
+				}
+			case slices.Contains(hostValueFlags, flag.Name):
+				for _, value := range flag.Value.(pflag.SliceValue).GetSlice() {
+					host, rest := parseHostFlag(value)
+					settings := config
+					if host != registryutils.AllHosts {
+						settings = registrySettings(registries, host)
+					}
+					settings[flag.Name] = appendConfigValue(settings[flag.Name], rest)
+				}
+			default:
+				var value any
+				value, err = typedFlagValue(flag)
+				if value != nil {
+					config[flag.Name] = value
+				}
+			}
+		})
+	}
+	if len(registries) > 0 {
+		config[registriesKey] = registries
+	}
+	return config, err
+}
+
+func registrySettings(registries map[string]map[string]any, host string) map[string]any {
+	if registries[host] == nil {
+		registries[host] = map[string]any{}
+	}
+	return registries[host]
+}
+
+// Add a value to a setting, turning it into a list once it has several values
+func appendConfigValue(current any, value string) any {
+	switch current := current.(type) {
+	case nil:
+		return value
+	case string:
+		return []string{current, value}
+	default:
+		return append(current.([]string), value)
+	}
+}
+
+// The value of a flag with its type, nil when it's empty
+func typedFlagValue(flag *pflag.Flag) (any, error) {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if values := slice.GetSlice(); len(values) > 0 {
+			return values, nil
+		}
+		return nil, nil
+	}
+	value := flag.Value.String()
+	switch flag.Value.Type() {
+	case "bool":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil || !enabled {
+			return nil, err
+		}
+		return true, nil
+	case "int":
+		number, err := strconv.Atoi(value)
+		if err != nil || number == 0 {
+			return nil, err
+		}
+		return number, nil
+	case "int64":
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || number == 0 {
+			return nil, err
+		}
+		return number, nil
+	default:
+		if value == "" {
+			return nil, nil
+		}
+		return value, nil
+	}
+}
+
+// Write the effective settings as YAML or TOML
+func printConfig(w io.Writer, format string, config map[string]any) error {
+	var b []byte
+	var err error
+	switch format {
+	case configFormatYAML:
+		b, err = yaml.Marshal(config)
+	case configFormatTOML:
+		b, err = toml.Marshal(config)
+	default:
+		return fmt.Errorf("unknown output format %s, expected %s or %s", format, configFormatYAML, configFormatTOML)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Load the config before any command runs, exiting on invalid settings like flags do
+func setupConfig(cmd *cobra.Command, flagSets ...*pflag.FlagSet) {
+	ctx := context.Background()
+	path, err := loadConfig(append([]*pflag.FlagSet{cmd.Flags()}, flagSets...), knownFlags(cmd.Root()), os.Getenv)
+	if err != nil {
+		log.Error(ctx, "Error loading configuration", err)
+		os.Exit(1)
+	}
+	if path != "" {
+		log.Info(ctx, fmt.Sprintf("Loaded configuration from %s", path))
+	}
+}
+
+func newConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration read from config files and " + configEnvPrefix + "* environment variables",
+	}
+
+	var format string
+	printCmd := &cobra.Command{
+		Use:   "print",
+		Short: "Print the effective configuration merged from flags, environment variables and the config file",
+		Args:  cobra.NoArgs,
+		// the settings of the root command are printed too, not just the ones this command has
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			setupConfig(cmd, cmd.Root().LocalNonPersistentFlags())
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := effectiveConfig(cmd.Flags(), cmd.Root().LocalNonPersistentFlags())
+			if err == nil {
+				delete(config, "output")
+				err = printConfig(cmd.OutOrStdout(), format, config)
+			}
+			if err != nil {
+				log.Error(context.Background(), "Error printing configuration", err)
+				os.Exit(1)
+			}
+		},
+	}
+	printCmd.Flags().StringVarP(&format, "output", "o", configFormatYAML, "Output format: yaml or toml")
+	cmd.AddCommand(printCmd)
+	return cmd
+}
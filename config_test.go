@@ -0,0 +1,295 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// Flags like the ones of the root command
+func newTestConfigFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("auth", "", "")
+	flags.String("sign-format", "cosign", "")
+	flags.Int("retry-attempts", 0, "")
+	flags.Int64("span-size", 0, "")
+	flags.Int64("min-layer-size", 0, "")
+	flags.Bool("provenance", false, "")
+	flags.StringArray("new-tag", nil, "")
+	flags.StringArray("ca-file", nil, "")
+	flags.StringArray("auth-file", nil, "")
+	flags.StringArray("plain-http", nil, "")
+	flags.StringArray("insecure-skip-tls-verify", nil, "")
+	return flags
+}
+
+func knownTestConfigFlags(flags *pflag.FlagSet) map[string]bool {
+	known := map[string]bool{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		known[flag.Name] = true
+	})
+	return known
+}
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	const yamlConfig = `
+retry-attempts: 5
+span-size: 8388608
+provenance: true
+new-tag: ["{{.Tag}}-soci", stable]
+ca-file: /etc/ssl/all.pem
+registries:
+  harbor.internal:
+    ca-file: /etc/ssl/internal-ca.pem
+    auth-file: [/run/secrets/harbor]
+  localhost:5000:
+    plain-http: true
+  secure.internal:
+    insecure-skip-tls-verify: false
+`
+	const tomlConfig = `
+retry-attempts = 5
+provenance = true
+new-tag = ["{{.Tag}}-soci", "stable"]
+ca-file = "/etc/ssl/all.pem"
+
+[registries."harbor.internal"]
+ca-file = "/etc/ssl/internal-ca.pem"
+auth-file = ["/run/secrets/harbor"]
+
+[registries."localhost:5000"]
+plain-http = true
+`
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		args     []string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: yamlConfig,
+			expected: map[string]string{
+				"retry-attempts":           "5",
+				"span-size":                "8388608",
+				"provenance":               "true",
+				"new-tag":                  "[{{.Tag}}-soci,stable]",
+				"ca-file":                  "[/etc/ssl/all.pem,harbor.internal=/etc/ssl/internal-ca.pem]",
+				"auth-file":                "[harbor.internal=/run/secrets/harbor]",
+				"plain-http":               "[localhost:5000]",
+				"sign-format":              "cosign",
+				"insecure-skip-tls-verify": "[secure.internal=false]",
+			},
+		},
+		{
+			name:    "toml",
+			file:    "config.toml",
+			content: tomlConfig,
+			expected: map[string]string{
+				"retry-attempts": "5",
+				"provenance":     "true",
+				"new-tag":        "[{{.Tag}}-soci,stable]",
+				"ca-file":        "[/etc/ssl/all.pem,harbor.internal=/etc/ssl/internal-ca.pem]",
+				"auth-file":      "[harbor.internal=/run/secrets/harbor]",
+				"plain-http":     "[localhost:5000]",
+			},
+		},
+		{
+			name:    "command line wins over environment, which wins over the file",
+			file:    "config.yml",
+			content: yamlConfig,
+			args:    []string{"--retry-attempts", "9", "--new-tag", "latest"},
+			env: map[string]string{
+				"SOCI_INDEXER_RETRY_ATTEMPTS": "7",
+				"SOCI_INDEXER_PROVENANCE":     "false",
+				"SOCI_INDEXER_CA_FILE":        "a.example=a.pem,b.pem",
+				"SOCI_INDEXER_SIGN_FORMAT":    "notation",
+			},
+			expected: map[string]string{
+				"retry-attempts": "9",
+				"provenance":     "false",
+				"new-tag":        "[latest]",
+				"ca-file":        "[a.example=a.pem,b.pem]",
+				"sign-format":    "notation",
+				"plain-http":     "[localhost:5000]",
+			},
+		},
+		{
+			name:    "auth variables are left to the auth flags",
+			file:    "config.yaml",
+			content: "retry-attempts: 1",
+			env: map[string]string{
+				"SOCI_INDEXER_AUTH":      "user:password",
+				"SOCI_INDEXER_AUTH_FILE": "token",
+			},
+			expected: map[string]string{
+				"auth":      "",
+				"auth-file": "[]",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldConfigFile := configFile
+			t.Cleanup(func() {
+				configFile = oldConfigFile
+			})
+			configFile = writeTestConfig(t, test.file, test.content)
+
+			flags := newTestConfigFlags()
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			path, err := loadConfig([]*pflag.FlagSet{flags}, knownTestConfigFlags(flags), func(name string) string {
+				return test.env[name]
+			})
+			if err != nil {
+				t.Fatalf("loadConfig returned error: %v", err)
+			}
+			if path != configFile {
+				t.Errorf("expected %s to be loaded, got %s", configFile, path)
+			}
+			for name, expected := range test.expected {
+				if value := flags.Lookup(name).Value.String(); value != expected {
+					t.Errorf("expected %s to be %s, got %s", name, expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		message string
+	}{
+		{name: "unknown setting", file: "config.yaml", content: "retry-attempt: 5", message: "unknown setting retry-attempt"},
+		{name: "auth token", file: "config.yaml", content: "auth: user:password", message: "auth can't be set"},
+		{name: "unknown registry setting", file: "config.yaml", content: "registries: {harbor.internal: {retry-attempts: 5}}", message: "unknown setting retry-attempts for registry harbor.internal"},
+		{name: "registry flag that isn't true or false", file: "config.yaml", content: "registries: {localhost:5000: {plain-http: yes please}}", message: "plain-http of registry localhost:5000"},
+		{name: "map value", file: "config.toml", content: "[new-tag]\nlatest = true", message: "new-tag"},
+		{name: "list for a single value", file: "config.yaml", content: "retry-attempts: [1, 2]", message: "expected a single value"},
+		{name: "invalid value", file: "config.yaml", content: "retry-attempts: many", message: "retry-attempts"},
+		{name: "invalid environment value", file: "config.yaml", content: "", env: map[string]string{"SOCI_INDEXER_PROVENANCE": "maybe"}, message: "SOCI_INDEXER_PROVENANCE"},
+		{name: "unknown format", file: "config.json", content: "{}", message: "unknown config file format"},
+		{name: "invalid yaml", file: "config.yaml", content: "new-tag: [", message: "failed to parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldConfigFile := configFile
+			t.Cleanup(func() {
+				configFile = oldConfigFile
+			})
+			configFile = writeTestConfig(t, test.file, test.content)
+
+			flags := newTestConfigFlags()
+			_, err := loadConfig([]*pflag.FlagSet{flags}, knownTestConfigFlags(flags), func(name string) string {
+				return test.env[name]
+			})
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("expected an error about %q, got %v", test.message, err)
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	flags := newTestConfigFlags()
+	err := flags.Parse([]string{
+		"--auth", "user:password",
+		"--retry-attempts", "3",
+		"--span-size", "4194304",
+		"--min-layer-size", "1048576",
+		"--new-tag", "{{.Tag}}-soci",
+		"--ca-file", "/etc/ssl/all.pem",
+		"--ca-file", "harbor.internal=/etc/ssl/internal-ca.pem",
+		"--ca-file", "harbor.internal=/etc/ssl/other-ca.pem",
+		"--plain-http", "localhost:5000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := effectiveConfig(flags)
+	if err != nil {
+		t.Fatalf("effectiveConfig returned error: %v", err)
+	}
+
+	for _, format := range []string{configFormatYAML, configFormatTOML} {
+		t.Run(format, func(t *testing.T) {
+			var output strings.Builder
+			if err := printConfig(&output, format, config); err != nil {
+				t.Fatalf("printConfig returned error: %v", err)
+			}
+			if strings.Contains(output.String(), "password") {
+				t.Fatalf("expected the auth token to be left out, got %s", output.String())
+			}
+			separator := ": "
+			if format == configFormatTOML {
+				separator = " = "
+			}
+			if !strings.Contains(output.String(), "span-size"+separator+"4194304\n") {
+				t.Errorf("expected span-size to be printed as an integer, got %s", output.String())
+			}
+
+			// the printed configuration loads back to the same settings
+			path := writeTestConfig(t, "config."+format, output.String())
+			printed, err := readConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := newTestConfigFlags()
+			values, err := configFlagValues(printed, knownTestConfigFlags(loaded))
+			if err != nil {
+				t.Fatalf("configFlagValues returned error: %v", err)
+			}
+			if err := applyFlagValues(loaded, values); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"retry-attempts", "span-size", "min-layer-size", "new-tag", "plain-http", "sign-format"} {
+				if loaded.Lookup(name).Value.String() != flags.Lookup(name).Value.String() {
+					t.Errorf("expected %s to be %s, got %s", name, flags.Lookup(name).Value, loaded.Lookup(name).Value)
+				}
+			}
+			caFiles, _ := loaded.GetStringArray("ca-file")
+			slices.Sort(caFiles)
+			expectedCaFiles := []string{"/etc/ssl/all.pem", "harbor.internal=/etc/ssl/internal-ca.pem", "harbor.internal=/etc/ssl/other-ca.pem"}
+			if !slices.Equal(caFiles, expectedCaFiles) {
+				t.Errorf("expected ca-file %v, got %v", expectedCaFiles, caFiles)
+			}
+		})
+	}
+
+	if err := printConfig(&strings.Builder{}, "json", config); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestDefaultConfigPathsSkipWorkingDirectory(t *testing.T) {
+	for _, path := range defaultConfigPaths() {
+		if !filepath.IsAbs(path) {
+			t.Errorf("expected only absolute config paths, got %s", path)
+		}
+	}
+}
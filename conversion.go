@@ -0,0 +1,178 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// conversion is a run turning a source image into a converted image. Indexing and migrating only differ in how
+// they pull the source image and build the converted image, everything before and after is shared.
+type conversion struct {
+	source    imageReference
+	buildType string
+	startedOn time.Time
+	registry  registryClient
+	dataDir   string
+	sociStore *store.SociStore
+	// imageDesc is the source image as resolved, pulledDesc as pulled
+	imageDesc  ocispec.Descriptor
+	pulledDesc ocispec.Descriptor
+	// newTags are the rendered tags, templateData what they were rendered with
+	newTags      []string
+	templateData tagTemplateData
+	// dependencies other than the source image, like the SOCI index manifests v1 migrate reuses
+	dependencies []ocispec.Descriptor
+}
+
+// pullFunc pulls the source image into the local store, like registryClient.Pull
+type pullFunc func(registry registryClient, ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error)
+
+// Resolve the source image, check the registry takes the converted image and create the local storage. A nil
+// conversion stops the run with the returned message and error, the caller cleans up its data directory otherwise.
+func startConversion(ctx context.Context, source imageReference, buildType string, authToken string) (*conversion, string, error) {
+	run := &conversion{source: source, buildType: buildType, startedOn: time.Now()}
+
+	registry, err := initRegistry(ctx, source.registry, authToken)
+	if err != nil {
+		message, err := logAndReturnError(ctx, "Remote registry initialization error", err)
+		return nil, message, err
+	}
+	run.registry = registry
+
+	run.imageDesc, err = resolveSourceImageDescriptor(ctx, registry, source.repo, source.reference())
+	if err != nil && ctx.Err() != nil {
+		message, err := logAndReturnError(ctx, InterruptedMessage, context.Cause(ctx))
+		return nil, message, err
+	} else if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
+		// Returning a non error to skip retries
+		return nil, "Exited early due to manifest validation error", nil
+	}
+
+	// fail before spending time on pulling and building if the index can't be pushed anyway
+	if sociIndexVersion == IndexVersionV2 && !skipOciProbe {
+		err = registry.ProbeOciArtifactSupport(ctx, source.repo)
+		if errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts) {
+			message, err := logAndReturnError(ctx, UnsupportedRegistryMessage, err)
+			return nil, message, err
+		} else if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't check registry support for OCI image indexes: %v", err))
+		}
+	}
+
+	// Directory in lambda storage to store images and SOCI artifacts
+	run.dataDir, err = createTempDir(ctx)
+	if err != nil {
+		message, err := logAndReturnError(ctx, "Directory create error", err)
+		return nil, message, err
+	}
+
+	run.sociStore, err = initSociStore(ctx, run.dataDir)
+	if err != nil {
+		cleanUp(ctx, run.dataDir)
+		message, err := logAndReturnError(ctx, "OCI storage initialization error", err)
+		return nil, message, err
+	}
+	return run, "", nil
+}
+
+// Verify and pull the resolved digest, the tag may have moved since it was resolved, then render the new tags
+func pullSourceImage(ctx context.Context, run *conversion, pull pullFunc, newTags []string) (string, error) {
+	repo := run.source.repo
+	if verifier != nil {
+		err := verifySourceImage(ctx, run.registry, repo, run.sociStore, run.imageDesc)
+		if err != nil {
+			return logAndReturnError(ctx, VerifyFailedMessage, err)
+		}
+	}
+
+	pulledDesc, err := pull(run.registry, ctx, repo, run.sociStore, run.imageDesc.Digest.String())
+	if err != nil {
+		return logAndReturnError(ctx, "Image pull error", err)
+	}
+	run.pulledDesc = *pulledDesc
+
+	// templates read the platforms of the image after the pull phase ended
+	run.templateData = newTagTemplateData(context.WithoutCancel(ctx), run.sociStore, repo, run.source.tag, run.pulledDesc)
+	run.newTags, err = renderNewTags(newTags, run.source.tag, run.templateData)
+	if err != nil {
+		return logAndReturnError(ctx, InvalidTagMessage, err)
+	}
+	log.Info(ctx, fmt.Sprintf("Tagging with %s", strings.Join(run.newTags, ", ")))
+	return "", nil
+}
+
+// Point the new tags to the source image when there is nothing to convert, the user will be expecting those tags
+// to exist whether or not an index was created
+func keepSourceImage(ctx context.Context, run *conversion, message string) (string, error) {
+	log.Warn(ctx, message)
+	err := tagOriginalImage(ctx, run.registry, run.source.repo, run.source.tag, run.newTags, run.pulledDesc)
+	if err != nil {
+		return logAndReturnError(ctx, tagErrorMessage(err), err)
+	}
+	return message, nil
+}
+
+// Push the converted image with its referrers, provenance and signature, tag it and print its digest
+func finishConversion(ctx context.Context, run *conversion, convertedDesc ocispec.Descriptor, successMessage string) (string, error) {
+	repo := run.source.repo
+	ctx = context.WithValue(ctx, "SOCIIndexDigest", convertedDesc.Digest.String())
+
+	pushCtx, cancelPush := phaseContext(ctx, PhasePush)
+	defer cancelPush()
+	err := run.registry.Push(pushCtx, run.sociStore, convertedDesc, repo)
+	if errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts) {
+		return logAndReturnError(ctx, UnsupportedRegistryMessage, err)
+	} else if err != nil {
+		return logAndReturnError(ctx, PushFailedMessage, err)
+	}
+
+	// before tagging, so policies checking referrers never see the tag without them
+	if copyReferrers {
+		err = copyReferrersToConvertedImage(pushCtx, run.registry, repo, run.sociStore, run.pulledDesc, convertedDesc)
+		if err != nil {
+			return logAndReturnError(ctx, CopyReferrersFailedMessage, err)
+		}
+	}
+
+	if provenance {
+		err = pushProvenance(pushCtx, run.registry, run.sociStore, provenanceRun{
+			buildType:    run.buildType,
+			image:        run.source,
+			newTags:      run.newTags,
+			source:       run.pulledDesc,
+			converted:    convertedDesc,
+			dependencies: run.dependencies,
+			startedOn:    run.startedOn,
+		})
+		if err != nil {
+			return logAndReturnError(ctx, ProvenanceFailedMessage, err)
+		}
+	}
+
+	if signer != nil {
+		err = signConvertedImage(pushCtx, run.registry, run.source.registry, repo, run.sociStore, convertedDesc)
+		if err != nil {
+			return logAndReturnError(ctx, SignFailedMessage, err)
+		}
+	}
+	cancelPush()
+
+	err = tagConvertedImage(ctx, run.registry, repo, run.source.tag, run.newTags, run.templateData, run.imageDesc, convertedDesc)
+	if err != nil {
+		return logAndReturnError(ctx, tagErrorMessage(err), err)
+	}
+	fmt.Fprintln(digestOutput, convertedDesc.Digest)
+	return successMessage, nil
+}
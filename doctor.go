@@ -0,0 +1,84 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/spf13/cobra"
+)
+
+// Build the doctor subcommand that checks a repository is ready for indexing without indexing anything
+func newDoctorCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor [REGISTRY/]REPO[:TAG]",
+		Short: "Check registry reachability, authentication, permissions and features needed to push SOCI indexes",
+		Long: "Check registry reachability, authentication, permissions and features needed to push SOCI indexes.\n" +
+			"Push checks upload a small test blob, a tiny OCI image index and a soci-indexer-doctor-* tag, and delete them when the registry allows it.\n" +
+			"Pull permission is checked on TAG when given, otherwise by listing tags.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ctx = context.Background()
+
+			source, err := parseImageReference(args[0])
+			if err != nil {
+				log.Error(ctx, "Error parsing image reference", err)
+				os.Exit(1)
+			}
+			reference := ""
+			if hasExplicitReference(args[0]) {
+				reference = source.reference()
+			}
+
+			if err := setupRegistryOptions(source); err != nil {
+				log.Error(ctx, "Invalid registry flags", err)
+				os.Exit(1)
+			}
+			if err := setupTimeouts(); err != nil {
+				log.Error(ctx, "Invalid --timeout", err)
+				os.Exit(1)
+			}
+			authToken, err := resolveAuthToken(ctx, source.registry)
+			if err != nil {
+				log.Error(ctx, "Error reading authentication token", err)
+				os.Exit(1)
+			}
+
+			runCtx, cancel := newRunContext()
+			defer cancel()
+			checks := registryutils.Diagnose(runCtx, source.registry, authToken, source.repo, reference, registryOptions...)
+			if !printChecks(cmd.OutOrStdout(), checks) {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// Check if an image reference names a tag or digest instead of relying on the default tag
+func hasExplicitReference(desc string) bool {
+	name := desc[strings.LastIndex(desc, "/")+1:]
+	return strings.ContainsAny(name, ":@")
+}
+
+// Print checks as a table and report whether all of them passed or only warned
+func printChecks(w io.Writer, checks []registryutils.Check) bool {
+	ok := true
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "CHECK\tSTATUS\tDETAIL")
+	for _, check := range checks {
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\n", check.Name, check.Status, log.Redact(check.Detail))
+		if check.Status == registryutils.CheckFailed {
+			ok = false
+		}
+	}
+	_ = table.Flush()
+	return ok
+}
@@ -0,0 +1,48 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+)
+
+func TestHasExplicitReference(t *testing.T) {
+	tests := map[string]bool{
+		"repo":                                 false,
+		"repo:latest":                          true,
+		"localhost:5000/repo":                  false,
+		"localhost:5000/org/repo:v1":           true,
+		"registry.example.com/repo@sha256:abc": true,
+	}
+	for desc, expected := range tests {
+		if hasExplicitReference(desc) != expected {
+			t.Errorf("hasExplicitReference(%s) should be %t", desc, expected)
+		}
+	}
+}
+
+func TestPrintChecks(t *testing.T) {
+	var output bytes.Buffer
+	ok := printChecks(&output, []registryutils.Check{
+		{Name: registryutils.CheckDNS, Status: registryutils.CheckPassed, Detail: "127.0.0.1"},
+		{Name: registryutils.CheckReferrers, Status: registryutils.CheckWarning, Detail: "not supported"},
+	})
+	if !ok {
+		t.Fatal("warnings should not fail the doctor")
+	}
+	if !strings.Contains(output.String(), "Referrers API") || !strings.Contains(output.String(), "not supported") {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	ok = printChecks(&output, []registryutils.Check{
+		{Name: registryutils.CheckPush, Status: registryutils.CheckFailed, Detail: "denied"},
+	})
+	if ok {
+		t.Fatal("failed checks should fail the doctor")
+	}
+}
@@ -7,14 +7,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
-	"strings"
+	"slices"
 
 	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
 	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/signing"
 	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
 	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
 
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
@@ -28,102 +32,301 @@ var (
 	ErrEmptyIndex = errors.New("no ztocs created, all layers either skipped or produced errors")
 )
 
+// ErrTagMoved means the source tag was pushed to while indexing, so it's left alone
+var ErrTagMoved = errors.New("tag moved since it was resolved")
+
 const (
 	BuildFailedMessage         = "SOCI index build error"
 	PushFailedMessage          = "SOCI index push error"
 	PushOnEmptyIndexMessage    = "SOCI index does not contain any zTOCs"
 	BuildAndPushSuccessMessage = "Successfully built and pushed SOCI index"
+	CopyReferrersFailedMessage = "Referrers copy error"
+	SignFailedMessage          = "Image signing error"
+	VerifyFailedMessage        = "Source image signature verification error"
+	TagMovedMessage            = "Source tag was pushed to while indexing, not replacing it"
+	InvalidTagMessage          = "New tag template error"
+	UntaggedImageMessage       = "Converted image was pushed without a tag. Pin its digest soon, registries that " +
+		"garbage collect untagged manifests (like ECR lifecycle policies or Harbor garbage collection) may delete it"
+	UnsupportedRegistryMessage = "Registry does not accept the OCI image indexes SOCI index manifest v2 needs. " +
+		"Push to a registry with OCI image index and artifact support, such as ECR, Harbor 2 or distribution 3"
+	UnsupportedReferrerRegistryMessage = "Registry does not accept the OCI artifact manifests SOCI index manifest v1 needs"
+
+	// IndexVersionV2 converts the image to an OCI image index that includes the SOCI index, changing its digest
+	IndexVersionV2 = "v2"
+	// IndexVersionV1 pushes the SOCI index as a referrer of the image, leaving the image untouched
+	IndexVersionV1 = "v1"
 
 	artifactsStoreName = "store"
 	artifactsDbName    = "artifacts.db"
+
+	buildToolIdentifier = "github.com/CloudSnorkel/standalone-soci-indexer"
 )
 
 type registryClient interface {
 	Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error)
+	PullManifests(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error)
+	Referrers(ctx context.Context, repositoryName string, subject ocispec.Descriptor, artifactType string) ([]ocispec.Descriptor, error)
 	Push(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repositoryName string) error
 	Tag(ctx context.Context, indexDesc ocispec.Descriptor, repositoryName, tag string) error
 	HeadManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error)
+	ResolveUpstream(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error)
+	DeleteTag(ctx context.Context, repositoryName string, tag string) error
 	ValidateImageManifest(ctx context.Context, repositoryName string, digest string) error
+	ProbeOciArtifactSupport(ctx context.Context, repositoryName string) error
+	PushReferrer(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, repositoryName string) error
+	PullReferrer(ctx context.Context, repositoryName string, sociStore *store.SociStore, reference string) (*ocispec.Descriptor, error)
+	CopyReferrers(ctx context.Context, repositoryName string, from ocispec.Descriptor, to ocispec.Descriptor) ([]registryutils.ReferrerCopy, error)
 }
 
 var (
-	initRegistry = func(ctx context.Context, registryUrl string, authToken string) (registryClient, error) {
-		return registryutils.Init(ctx, registryUrl, authToken)
+	// registryOptions are passed to every registry client, set from command line flags
+	registryOptions []registryutils.Option
+	initRegistry    = func(ctx context.Context, registryUrl string, authToken string) (registryClient, error) {
+		return registryutils.Init(ctx, registryUrl, authToken, registryOptions...)
 	}
-	buildIndexFn = buildIndex
+	buildIndexFn         = buildIndex
+	buildReferrerIndexFn = buildReferrerIndexes
+	// sociIndexVersion is IndexVersionV2 or IndexVersionV1, set from command line flags
+	sociIndexVersion = IndexVersionV2
+	// SOCI index build options, the soci library defaults made explicit so provenance can record them, set from
+	// command line flags
+	spanSize     = int64(1 << 22)  // 4MiB
+	minLayerSize = int64(10 << 20) // 10MiB
+	// copyReferrers attaches the referrers of the original image to the converted image, set from command line flags
+	copyReferrers bool
+	// skipOciProbe skips pushing a probe before pulling to check the registry takes OCI image indexes, set from
+	// command line flags
+	skipOciProbe bool
+	// backupTagTemplate names the tag that keeps the original image when the source tag is replaced, set from
+	// command line flags
+	backupTagTemplate string
+	// provenance attaches an in-toto provenance statement to the converted image, set from command line flags
+	provenance bool
+	// signer signs the converted image before tagging it, nil unless set from command line flags
+	signer *signing.Signer
+	// verifier refuses source images without a trusted signature, nil unless set from command line flags
+	verifier *signing.Verifier
+	// digestOutput receives the digest of every converted image, so scripts can pin it
+	digestOutput io.Writer = os.Stdout
 )
 
-func indexAndPush(ctx context.Context, repo string, tag string, newTags []string, registryUrl string, authToken string) (string, error) {
-	ctx = context.WithValue(ctx, "RegistryURL", registryUrl)
+func indexAndPush(ctx context.Context, source imageReference, newTags []string, authToken string) (string, error) {
+	ctx = context.WithValue(ctx, "RegistryURL", source.registry)
+	run, message, err := startConversion(ctx, source, ProvenanceBuildTypeIndex, authToken)
+	if run == nil {
+		return message, err
+	}
+	defer cleanUp(ctx, run.dataDir)
+	ctx = context.WithValue(ctx, "ImageDigest", run.imageDesc.Digest.String())
 
-	registry, err := initRegistry(ctx, registryUrl, authToken)
-	if err != nil {
-		return logAndReturnError(ctx, "Remote registry initialization error", err)
+	pullCtx, cancelPull := phaseContext(ctx, PhasePull)
+	defer cancelPull()
+	if message, err := pullSourceImage(pullCtx, run, registryClient.Pull, newTags); err != nil {
+		return message, err
+	}
+	cancelPull()
+
+	image := images.Image{
+		Name:   source.name(),
+		Target: run.pulledDesc,
 	}
 
-	imageDesc, err := resolveSourceImageDescriptor(ctx, registry, repo, tag)
+	if sociIndexVersion == IndexVersionV1 {
+		return indexAndPushReferrers(ctx, run.registry, source.repo, source.tag, run.newTags, run.dataDir, run.sociStore, image)
+	}
+
+	buildCtx, cancelBuild := phaseContext(ctx, PhaseBuild)
+	defer cancelBuild()
+	indexDescriptor, err := buildIndexFn(buildCtx, run.dataDir, run.sociStore, image)
+	cancelBuild()
 	if err != nil {
-		log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
-		// Returning a non error to skip retries
-		return "Exited early due to manifest validation error", nil
+		if err.Error() == ErrEmptyIndex.Error() {
+			return keepSourceImage(ctx, run, PushOnEmptyIndexMessage)
+		}
+		return logAndReturnError(ctx, BuildFailedMessage, err)
 	}
 
-	// Directory in lambda storage to store images and SOCI artifacts
-	dataDir, err := createTempDir(ctx)
+	return finishConversion(ctx, run, *indexDescriptor, BuildAndPushSuccessMessage)
+}
+
+// Push a SOCI index manifest v1 for every platform as a referrer of the platform's manifest.
+// The image keeps its tag and digest, --new-tag only adds tags pointing to it.
+func indexAndPushReferrers(ctx context.Context, registry registryClient, repo string, tag string, newTags []string, dataDir string, sociStore *store.SociStore, image images.Image) (string, error) {
+	buildCtx, cancelBuild := phaseContext(ctx, PhaseBuild)
+	defer cancelBuild()
+	indexDescriptors, err := buildReferrerIndexFn(buildCtx, dataDir, sociStore, image)
+	if err != nil && err.Error() != ErrEmptyIndex.Error() {
+		return logAndReturnError(ctx, BuildFailedMessage, err)
+	}
+	cancelBuild()
+
+	pushCtx, cancelPush := phaseContext(ctx, PhasePush)
+	defer cancelPush()
+	for _, indexDescriptor := range indexDescriptors {
+		err = registry.PushReferrer(pushCtx, sociStore, indexDescriptor, repo)
+		if errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts) {
+			return logAndReturnError(ctx, UnsupportedReferrerRegistryMessage, err)
+		} else if err != nil {
+			return logAndReturnError(ctx, PushFailedMessage, err)
+		}
+	}
+
+	cancelPush()
+
+	err = tagOriginalImage(ctx, registry, repo, tag, newTags, image.Target)
 	if err != nil {
-		return logAndReturnError(ctx, "Directory create error", err)
+		return logAndReturnError(ctx, tagErrorMessage(err), err)
+	}
+
+	if len(indexDescriptors) == 0 {
+		log.Warn(ctx, PushOnEmptyIndexMessage)
+		return PushOnEmptyIndexMessage, nil
+	}
+	return BuildAndPushSuccessMessage, nil
+}
+
+// Copy the referrers of the original image to the converted image, and the referrers of each platform manifest
+// to the matching manifest of the converted image. Convert keeps the order of the original manifests.
+func copyReferrersToConvertedImage(ctx context.Context, registry registryClient, repo string, sociStore *store.SociStore, imageDesc ocispec.Descriptor, convertedDesc ocispec.Descriptor) error {
+	subjects := [][2]ocispec.Descriptor{{imageDesc, convertedDesc}}
+	if images.IsIndexType(imageDesc.MediaType) {
+		var original, converted ocispec.Index
+		if err := fetchJSON(ctx, sociStore, imageDesc, &original); err != nil {
+			return err
+		}
+		if err := fetchJSON(ctx, sociStore, convertedDesc, &converted); err != nil {
+			return err
+		}
+		for i, desc := range original.Manifests {
+			if i < len(converted.Manifests) && images.IsManifestType(desc.MediaType) {
+				subjects = append(subjects, [2]ocispec.Descriptor{desc, converted.Manifests[i]})
+			}
+		}
 	}
-	defer cleanUp(ctx, dataDir)
 
-	sociStore, err := initSociStore(ctx, dataDir)
+	for _, subject := range subjects {
+		copies, err := registry.CopyReferrers(ctx, repo, subject[0], subject[1])
+		if err != nil {
+			return err
+		}
+		for _, referrerCopy := range copies {
+			if referrerCopy.Copy == nil {
+				log.Warn(ctx, fmt.Sprintf("Couldn't copy %s %s of %s: %s", referrerCopy.Referrer.ArtifactType, referrerCopy.Referrer.Digest, subject[0].Digest, referrerCopy.Reason))
+			} else {
+				log.Info(ctx, fmt.Sprintf("Copied %s %s of %s to %s", referrerCopy.Referrer.ArtifactType, referrerCopy.Referrer.Digest, subject[0].Digest, referrerCopy.Copy.Digest))
+			}
+		}
+	}
+	return nil
+}
+
+// Sign the converted image and push the signature as its referrer
+func signConvertedImage(ctx context.Context, registry registryClient, registryUrl string, repo string, sociStore *store.SociStore, convertedDesc ocispec.Descriptor) error {
+	signatureDesc, err := signer.Sign(ctx, sociStore, registryUrl+"/"+repo, convertedDesc)
 	if err != nil {
-		return logAndReturnError(ctx, "OCI storage initialization error", err)
+		return err
 	}
-	ctx = context.WithValue(ctx, "ImageDigest", imageDesc.Digest.String())
+	log.Info(ctx, fmt.Sprintf("Signed %s with %s signature %s", convertedDesc.Digest, signer.Format(), signatureDesc.Digest))
+	return registry.PushReferrer(ctx, sociStore, signatureDesc, repo)
+}
 
-	pulledDesc, err := registry.Pull(ctx, repo, sociStore, tag)
+// Point the new tags that aren't the source tag to the original image
+func tagOriginalImage(ctx context.Context, registry registryClient, repo string, tag string, newTags []string, imageDesc ocispec.Descriptor) error {
+	ctx, cancel, err := tagPhaseContext(ctx)
 	if err != nil {
-		return logAndReturnError(ctx, "Image pull error", err)
+		return err
 	}
+	defer cancel()
 
-	image := images.Image{
-		Name:   imageNameForReference(repo, tag),
-		Target: *pulledDesc,
+	var otherTags []string
+	for _, newTag := range newTags {
+		if newTag != tag {
+			otherTags = append(otherTags, newTag)
+		}
 	}
+	_, err = updateTags(ctx, registry, repo, otherTags, imageDesc, nil)
+	return err
+}
 
-	indexDescriptor, err := buildIndexFn(ctx, dataDir, sociStore, image)
+// Point the new tags to the converted image. The source tag is resolved again right before it's replaced and left
+// alone if it moved. Registries can't update tags conditionally, so this only narrows the race with other pushes
+// to the tagging itself. The backup tag is rendered from the same template data as the new tags.
+func tagConvertedImage(ctx context.Context, registry registryClient, repo string, tag string, newTags []string, templateData tagTemplateData, imageDesc ocispec.Descriptor, convertedDesc ocispec.Descriptor) error {
+	ctx, cancel, err := tagPhaseContext(ctx)
 	if err != nil {
-		if err.Error() == ErrEmptyIndex.Error() {
-			log.Warn(ctx, PushOnEmptyIndexMessage)
-
-			// tag when using --new-tag
-			// the user will be expecting those tags to exist whether or not we created an index
-			for _, newTag := range newTags {
-				if newTag != tag {
-					err = registry.Tag(ctx, *pulledDesc, repo, newTag)
-					if err != nil {
-						return logAndReturnError(ctx, PushFailedMessage, err)
-					}
-				}
-			}
-			return PushOnEmptyIndexMessage, nil
+		return err
+	}
+	defer cancel()
+
+	if len(newTags) == 0 {
+		log.Warn(ctx, fmt.Sprintf("%s: %s", UntaggedImageMessage, convertedDesc.Digest))
+		return nil
+	}
+	if !slices.Contains(newTags, tag) {
+		_, err = updateTags(ctx, registry, repo, newTags, convertedDesc, nil)
+		return err
+	}
+
+	expected := map[string]digest.Digest{tag: imageDesc.Digest}
+	if backupTagTemplate != "" {
+		if err := backupOriginalImage(ctx, registry, repo, newTags, templateData, imageDesc, expected); err != nil {
+			return err
 		}
-		return logAndReturnError(ctx, BuildFailedMessage, err)
 	}
-	ctx = context.WithValue(ctx, "SOCIIndexDigest", indexDescriptor.Digest.String())
+	_, err = updateTags(ctx, registry, repo, newTags, convertedDesc, expected)
+	return err
+}
 
-	err = registry.Push(ctx, sociStore, *indexDescriptor, repo)
+// Keep the original image reachable under the backup tag before the source tag is replaced
+func backupOriginalImage(ctx context.Context, registry registryClient, repo string, newTags []string, templateData tagTemplateData, imageDesc ocispec.Descriptor, expected map[string]digest.Digest) error {
+	backupTag, err := renderTagTemplate(backupTagTemplate, templateData)
 	if err != nil {
-		return logAndReturnError(ctx, PushFailedMessage, err)
+		return fmt.Errorf("invalid backup tag: %w", err)
 	}
+	if slices.Contains(newTags, backupTag) {
+		return fmt.Errorf("backup tag %s would be replaced with the converted image", backupTag)
+	}
+	log.Info(ctx, fmt.Sprintf("Backing up %s as %s", imageDesc.Digest, backupTag))
+	_, err = updateTags(ctx, registry, repo, []string{backupTag}, imageDesc, expected)
+	return err
+}
 
-	for _, newTag := range newTags {
-		err = registry.Tag(ctx, *indexDescriptor, repo, newTag)
-		if err != nil {
-			return logAndReturnError(ctx, PushFailedMessage, err)
+// Look for a signature of the image by a trusted key in its referrers and in cosign's signature tag
+func verifySourceImage(ctx context.Context, registry registryClient, repo string, sociStore *store.SociStore, imageDesc ocispec.Descriptor) error {
+	referrers, err := registry.Referrers(ctx, repo, imageDesc, "")
+	if err != nil {
+		return err
+	}
+	var references []string
+	var errs []error
+	for _, referrer := range referrers {
+		if signing.IsSignature(referrer.ArtifactType) {
+			references = append(references, referrer.Digest.String())
+		} else if signing.IsUnsupportedSignature(referrer.ArtifactType) {
+			errs = append(errs, fmt.Errorf("%w: %s is a %s", signing.ErrUnsupportedSignatureFormat, referrer.Digest, referrer.ArtifactType))
 		}
 	}
-	return BuildAndPushSuccessMessage, nil
+	references = append(references, signing.CosignSignatureTag(imageDesc.Digest))
+
+	for _, reference := range references {
+		signatureDesc, err := registry.PullReferrer(ctx, repo, sociStore, reference)
+		if errors.Is(err, errdef.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = verifier.Verify(ctx, sociStore, *signatureDesc, imageDesc)
+		if err == nil {
+			log.Info(ctx, fmt.Sprintf("Verified signature %s of %s", signatureDesc.Digest, imageDesc.Digest))
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("%w: %s is not signed", signing.ErrNoValidSignature, imageDesc.Digest)
+	}
+	return errors.Join(errs...)
 }
 
 func resolveSourceImageDescriptor(ctx context.Context, registry registryClient, repo string, reference string) (ocispec.Descriptor, error) {
@@ -145,13 +348,6 @@ func resolveSourceImageDescriptor(ctx context.Context, registry registryClient,
 	return desc, nil
 }
 
-func imageNameForReference(repo string, reference string) string {
-	if strings.Contains(reference, ":") {
-		return repo + "@" + reference
-	}
-	return repo + ":" + reference
-}
-
 // Create a temp directory in /tmp or $TMPDIR
 // The directory is prefixed by the Lambda's request id
 func createTempDir(ctx context.Context) (string, error) {
@@ -193,34 +389,95 @@ func initSociArtifactsDb(dataDir string) (*soci.ArtifactsDb, error) {
 	return artifactsDb, nil
 }
 
-// Build soci index for an image and returns its ocispec.Descriptor
-func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) (*ocispec.Descriptor, error) {
-	log.Info(ctx, "Building SOCI index")
-
+// Init a SOCI index builder and list the platforms of the image
+func initIndexBuilder(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) (*soci.IndexBuilder, []ocispec.Platform, error) {
 	artifactsDb, err := initSociArtifactsDb(dataDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	containerdStore, err := initContainerdStore(dataDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	builder, err := soci.NewIndexBuilder(containerdStore, sociStore, soci.WithArtifactsDb(artifactsDb), soci.WithBuildToolIdentifier("github.com/CloudSnorkel/standalone-soci-indexer"))
+	builder, err := soci.NewIndexBuilder(containerdStore, sociStore,
+		soci.WithArtifactsDb(artifactsDb),
+		soci.WithSpanSize(spanSize),
+		soci.WithMinLayerSize(minLayerSize),
+		soci.WithBuildToolIdentifier(buildToolIdentifier),
+	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	platforms, err := images.Platforms(ctx, containerdStore, image.Target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return builder, platforms, nil
+}
+
+// Build soci index for an image and returns its ocispec.Descriptor
+func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) (*ocispec.Descriptor, error) {
+	log.Info(ctx, "Building SOCI index")
+
+	builder, platforms, err := initIndexBuilder(ctx, dataDir, sociStore, image)
 	if err != nil {
 		return nil, err
 	}
 
-	index, err := builder.Convert(ctx, image, soci.ConvertWithPlatforms(platforms...))
+	var index *ocispec.Descriptor
+	withStdoutOnStderr(func() {
+		index, err = builder.Convert(ctx, image, soci.ConvertWithPlatforms(platforms...))
+	})
 	return index, err
 }
 
+// Build a SOCI index manifest v1 for every platform of an image and return their descriptors.
+// Each index has the platform's manifest as its subject. Platforms without zTOCs are skipped.
+func buildReferrerIndexes(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) ([]ocispec.Descriptor, error) {
+	log.Info(ctx, "Building SOCI index manifests v1")
+
+	builder, platforms, err := initIndexBuilder(ctx, dataDir, sociStore, image)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexDescriptors []ocispec.Descriptor
+	for _, platform := range platforms {
+		var index *soci.IndexWithMetadata
+		withStdoutOnStderr(func() {
+			index, err = builder.Build(ctx, image, soci.WithPlatform(platform))
+		})
+		if err != nil {
+			if err.Error() == ErrEmptyIndex.Error() {
+				log.Warn(ctx, fmt.Sprintf("%s for %s", PushOnEmptyIndexMessage, path.Join(platform.OS, platform.Architecture, platform.Variant)))
+				continue
+			}
+			return nil, err
+		}
+		indexDescriptors = append(indexDescriptors, index.Desc)
+	}
+
+	if len(indexDescriptors) == 0 {
+		return nil, ErrEmptyIndex
+	}
+	return indexDescriptors, nil
+}
+
+// Run fn with os.Stdout pointing at stderr. The soci library prints a line for every layer to stdout, which only
+// carries converted digests. digestOutput still holds the real stdout.
+func withStdoutOnStderr(fn func()) {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+}
+
 // Log and return error
 func logAndReturnError(ctx context.Context, msg string, err error) (string, error) {
 	log.Error(ctx, msg, err)
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/containerd/containerd/images"
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
 
 	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/signing"
 )
 
 type fakeRegistry struct {
@@ -18,12 +32,49 @@ type fakeRegistry struct {
 	headErr        error
 	pullDescriptor ocispec.Descriptor
 	validateErr    error
+	probeErr       error
 	buildCalls     int
+	probeCalls     int
+	// referrers of each subject digest
+	referrers map[digest.Digest][]ocispec.Descriptor
+	// pullContent writes the pulled content to the local store
+	pullContent func(sociStore *store.SociStore)
 
 	pullReferences []string
 	pushes         []ocispec.Descriptor
+	referrerPushes []ocispec.Descriptor
 	tags           []tagCall
 	validateCalls  []string
+
+	// references pulled without layers
+	manifestPullReferences []string
+	referrerCopies         []referrerCopyCall
+	// number of tags pushed before each referrer push
+	referrerPushTagged []int
+	// referrerContent writes the referrer PullReferrer pulls to the local store, by reference
+	referrerContent        map[string]func(sociStore *store.SociStore) ocispec.Descriptor
+	pullReferrerReferences []string
+	// movedDescriptor is returned by HeadManifest after the first call, like a tag pushed to while indexing
+	movedDescriptor *ocispec.Descriptor
+	headCalls       int
+	// tagDescriptors, when set, is the state of the tags HeadManifest resolves and Tag updates
+	tagDescriptors map[string]ocispec.Descriptor
+	// upstreamResolves are the references resolved without mirrors
+	upstreamResolves []string
+	// tagErr fails Tag calls
+	tagErr func(desc ocispec.Descriptor, tag string) error
+	// deleteTagErr fails DeleteTag calls
+	deleteTagErr error
+	deletedTags  []string
+	// digestOutput collects the converted digests written for scripts
+	digestOutput strings.Builder
+}
+
+type referrerCopyCall struct {
+	from ocispec.Descriptor
+	to   ocispec.Descriptor
+	// number of tags pushed before the copy
+	tagged int
 }
 
 type tagCall struct {
@@ -31,49 +82,133 @@ type tagCall struct {
 	tag  string
 }
 
-func (f *fakeRegistry) Pull(_ context.Context, _ string, _ *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
-	f.pullReferences = append(f.pullReferences, imageReference)
+func (f *fakeRegistry) Pull(_ context.Context, _ string, sociStore *store.SociStore, reference string) (*ocispec.Descriptor, error) {
+	f.pullReferences = append(f.pullReferences, reference)
+	if f.pullContent != nil {
+		f.pullContent(sociStore)
+	}
+	desc := f.pullDescriptor
+	return &desc, nil
+}
+
+func (f *fakeRegistry) PullManifests(_ context.Context, _ string, sociStore *store.SociStore, reference string) (*ocispec.Descriptor, error) {
+	f.manifestPullReferences = append(f.manifestPullReferences, reference)
+	if f.pullContent != nil {
+		f.pullContent(sociStore)
+	}
 	desc := f.pullDescriptor
 	return &desc, nil
 }
 
+func (f *fakeRegistry) Referrers(_ context.Context, _ string, subject ocispec.Descriptor, _ string) ([]ocispec.Descriptor, error) {
+	return f.referrers[subject.Digest], nil
+}
+
 func (f *fakeRegistry) Push(_ context.Context, _ *store.SociStore, indexDesc ocispec.Descriptor, _ string) error {
 	f.pushes = append(f.pushes, indexDesc)
 	return nil
 }
 
+func (f *fakeRegistry) PushReferrer(_ context.Context, _ *store.SociStore, desc ocispec.Descriptor, _ string) error {
+	f.referrerPushes = append(f.referrerPushes, desc)
+	f.referrerPushTagged = append(f.referrerPushTagged, len(f.tags))
+	return nil
+}
+
+func (f *fakeRegistry) PullReferrer(_ context.Context, _ string, sociStore *store.SociStore, reference string) (*ocispec.Descriptor, error) {
+	f.pullReferrerReferences = append(f.pullReferrerReferences, reference)
+	pull, ok := f.referrerContent[reference]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", reference, errdef.ErrNotFound)
+	}
+	desc := pull(sociStore)
+	return &desc, nil
+}
+
+func (f *fakeRegistry) CopyReferrers(_ context.Context, _ string, from ocispec.Descriptor, to ocispec.Descriptor) ([]registryutils.ReferrerCopy, error) {
+	f.referrerCopies = append(f.referrerCopies, referrerCopyCall{from: from, to: to, tagged: len(f.tags)})
+	return []registryutils.ReferrerCopy{
+		{Referrer: ocispec.Descriptor{ArtifactType: "application/spdx+json"}, Copy: &ocispec.Descriptor{}},
+		{Referrer: ocispec.Descriptor{ArtifactType: "application/vnd.cncf.notary.signature"}, Reason: "signed"},
+	}, nil
+}
+
 func (f *fakeRegistry) Tag(_ context.Context, indexDesc ocispec.Descriptor, _ string, tag string) error {
+	if f.tagErr != nil {
+		if err := f.tagErr(indexDesc, tag); err != nil {
+			return err
+		}
+	}
 	f.tags = append(f.tags, tagCall{desc: indexDesc, tag: tag})
+	if f.tagDescriptors != nil {
+		f.tagDescriptors[tag] = indexDesc
+	}
+	return nil
+}
+
+func (f *fakeRegistry) DeleteTag(_ context.Context, _ string, tag string) error {
+	if f.deleteTagErr != nil {
+		return f.deleteTagErr
+	}
+	f.deletedTags = append(f.deletedTags, tag)
+	delete(f.tagDescriptors, tag)
 	return nil
 }
 
-func (f *fakeRegistry) HeadManifest(_ context.Context, _ string, _ string) (ocispec.Descriptor, error) {
+func (f *fakeRegistry) HeadManifest(_ context.Context, _ string, reference string) (ocispec.Descriptor, error) {
+	f.headCalls++
+	if f.tagDescriptors != nil {
+		desc, ok := f.tagDescriptors[reference]
+		if !ok {
+			return ocispec.Descriptor{}, fmt.Errorf("%s: %w", reference, errdef.ErrNotFound)
+		}
+		return desc, nil
+	}
+	if f.movedDescriptor != nil && f.headCalls > 1 {
+		return *f.movedDescriptor, f.headErr
+	}
 	return f.headDescriptor, f.headErr
 }
 
+func (f *fakeRegistry) ResolveUpstream(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
+	f.upstreamResolves = append(f.upstreamResolves, reference)
+	return f.HeadManifest(ctx, repositoryName, reference)
+}
+
 func (f *fakeRegistry) ValidateImageManifest(_ context.Context, _ string, digest string) error {
 	f.validateCalls = append(f.validateCalls, digest)
 	return f.validateErr
 }
 
+func (f *fakeRegistry) ProbeOciArtifactSupport(_ context.Context, _ string) error {
+	f.probeCalls++
+	return f.probeErr
+}
+
 func installTestHooks(t *testing.T, registry *fakeRegistry, build func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error)) {
 	oldInitRegistry := initRegistry
 	oldBuildIndexFn := buildIndexFn
+	oldDigestOutput := digestOutput
 	t.Cleanup(func() {
 		initRegistry = oldInitRegistry
 		buildIndexFn = oldBuildIndexFn
+		digestOutput = oldDigestOutput
 	})
 
 	initRegistry = func(context.Context, string, string) (registryClient, error) {
 		return registry, nil
 	}
 	buildIndexFn = build
+	digestOutput = &registry.digestOutput
 }
 
+// testSource is the image indexAndPush and migrateAndPush tests index
+var testSource = imageReference{registry: "registry.example.com", repo: "example/repo", tag: "latest"}
+
 func runIndexAndPushTest(t *testing.T, registry *fakeRegistry, build func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error)) (string, error) {
 	t.Helper()
 	installTestHooks(t, registry, build)
-	return indexAndPush(context.Background(), "example/repo", "latest", []string{"latest", "stable"}, "registry.example.com", "")
+	return indexAndPush(context.Background(), testSource, []string{"latest", "stable"}, "")
 }
 
 func TestIndexAndPush(t *testing.T) {
@@ -125,8 +260,11 @@ func TestIndexAndPush(t *testing.T) {
 				if registry.buildCalls != 1 {
 					t.Fatalf("expected buildIndex to be called once, got %d", registry.buildCalls)
 				}
-				if len(registry.pullReferences) != 1 || registry.pullReferences[0] != "latest" {
-					t.Fatalf("unexpected pull references: %#v", registry.pullReferences)
+				if registry.probeCalls != 1 {
+					t.Fatalf("expected the OCI image index probe before pulling, got %d", registry.probeCalls)
+				}
+				if len(registry.pullReferences) != 1 || registry.pullReferences[0] != registry.headDescriptor.Digest.String() {
+					t.Fatalf("expected the resolved digest to be pulled, got %#v", registry.pullReferences)
 				}
 				if len(registry.pushes) != 1 || registry.pushes[0].Digest != digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222") {
 					t.Fatalf("unexpected pushes: %#v", registry.pushes)
@@ -188,6 +326,110 @@ func TestIndexAndPush(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "fails before pull when registry rejects OCI image indexes",
+			setup: func(t *testing.T) (*fakeRegistry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error)) {
+				registry := &fakeRegistry{
+					headDescriptor: ocispec.Descriptor{
+						MediaType: registryutils.MediaTypeDockerManifestList,
+						Digest:    digest.Digest("sha256:4444444444444444444444444444444444444444444444444444444444444444"),
+					},
+					probeErr: fmt.Errorf("%w: unsupported", registryutils.RegistryNotSupportingOciArtifacts),
+				}
+
+				build := func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+					registry.buildCalls++
+					return nil, errors.New("should not build")
+				}
+
+				return registry, build
+			},
+			assert: func(t *testing.T, registry *fakeRegistry, message string, err error) {
+				if !errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts) {
+					t.Fatalf("expected unsupported registry error, got %v", err)
+				}
+				if message != UnsupportedRegistryMessage {
+					t.Fatalf("unexpected message: %s", message)
+				}
+				if registry.probeCalls != 1 {
+					t.Fatalf("expected one probe, got %d", registry.probeCalls)
+				}
+				if len(registry.pullReferences) != 0 || registry.buildCalls != 0 || len(registry.pushes) != 0 {
+					t.Fatalf("expected no pull, build or push, got %#v %d %#v", registry.pullReferences, registry.buildCalls, registry.pushes)
+				}
+			},
+		},
+		{
+			name: "skips the probe with --skip-oci-probe",
+			setup: func(t *testing.T) (*fakeRegistry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error)) {
+				oldSkipOciProbe := skipOciProbe
+				t.Cleanup(func() {
+					skipOciProbe = oldSkipOciProbe
+				})
+				skipOciProbe = true
+				registry := &fakeRegistry{
+					headDescriptor: ocispec.Descriptor{
+						MediaType: registryutils.MediaTypeDockerManifestList,
+						Digest:    digest.Digest("sha256:4444444444444444444444444444444444444444444444444444444444444444"),
+					},
+					pullDescriptor: ocispec.Descriptor{
+						MediaType: registryutils.MediaTypeDockerManifestList,
+						Digest:    digest.Digest("sha256:4444444444444444444444444444444444444444444444444444444444444444"),
+					},
+					probeErr: fmt.Errorf("%w: unsupported", registryutils.RegistryNotSupportingOciArtifacts),
+				}
+
+				build := func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+					return &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("converted")}, nil
+				}
+
+				return registry, build
+			},
+			assert: func(t *testing.T, registry *fakeRegistry, message string, err error) {
+				if err != nil || message != BuildAndPushSuccessMessage {
+					t.Fatalf("unexpected message: %s (%v)", message, err)
+				}
+				if registry.probeCalls != 0 {
+					t.Fatalf("did not expect the OCI image index probe, got %d", registry.probeCalls)
+				}
+			},
+		},
+		{
+			name: "continues when the probe fails for other reasons",
+			setup: func(t *testing.T) (*fakeRegistry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error)) {
+				registry := &fakeRegistry{
+					headDescriptor: ocispec.Descriptor{
+						MediaType: registryutils.MediaTypeDockerManifestList,
+						Digest:    digest.Digest("sha256:5555555555555555555555555555555555555555555555555555555555555555"),
+					},
+					pullDescriptor: ocispec.Descriptor{
+						MediaType: registryutils.MediaTypeDockerManifestList,
+						Digest:    digest.Digest("sha256:5555555555555555555555555555555555555555555555555555555555555555"),
+					},
+					probeErr: errors.New("connection reset"),
+				}
+
+				build := func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+					return &ocispec.Descriptor{
+						MediaType: ocispec.MediaTypeImageIndex,
+						Digest:    digest.Digest("sha256:6666666666666666666666666666666666666666666666666666666666666666"),
+					}, nil
+				}
+
+				return registry, build
+			},
+			assert: func(t *testing.T, registry *fakeRegistry, message string, err error) {
+				if err != nil {
+					t.Fatalf("indexAndPush returned error: %v", err)
+				}
+				if message != BuildAndPushSuccessMessage {
+					t.Fatalf("unexpected message: %s", message)
+				}
+				if len(registry.pushes) != 1 {
+					t.Fatalf("expected one push, got %#v", registry.pushes)
+				}
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -199,6 +441,323 @@ func TestIndexAndPush(t *testing.T) {
 	}
 }
 
+func TestIndexAndPushReferrers(t *testing.T) {
+	imageDigest := digest.Digest("sha256:7777777777777777777777777777777777777777777777777777777777777777")
+	indexDigests := []digest.Digest{
+		"sha256:8888888888888888888888888888888888888888888888888888888888888888",
+		"sha256:9999999999999999999999999999999999999999999999999999999999999999",
+	}
+
+	tests := []struct {
+		name            string
+		build           func(context.Context, string, *store.SociStore, images.Image) ([]ocispec.Descriptor, error)
+		expectedMessage string
+		expectedPushes  int
+	}{
+		{
+			name: "pushes an index per platform as referrers",
+			build: func(_ context.Context, _ string, _ *store.SociStore, image images.Image) ([]ocispec.Descriptor, error) {
+				if image.Target.Digest != imageDigest {
+					t.Fatalf("unexpected image digest: %s", image.Target.Digest)
+				}
+				var descs []ocispec.Descriptor
+				for _, dgst := range indexDigests {
+					descs = append(descs, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst})
+				}
+				return descs, nil
+			},
+			expectedMessage: BuildAndPushSuccessMessage,
+			expectedPushes:  2,
+		},
+		{
+			name: "still tags original image on empty index",
+			build: func(context.Context, string, *store.SociStore, images.Image) ([]ocispec.Descriptor, error) {
+				return nil, ErrEmptyIndex
+			},
+			expectedMessage: PushOnEmptyIndexMessage,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &fakeRegistry{
+				headDescriptor: ocispec.Descriptor{MediaType: registryutils.MediaTypeDockerManifestList, Digest: imageDigest},
+				pullDescriptor: ocispec.Descriptor{MediaType: registryutils.MediaTypeDockerManifestList, Digest: imageDigest},
+			}
+			oldBuildReferrerIndexFn := buildReferrerIndexFn
+			oldSociIndexVersion := sociIndexVersion
+			t.Cleanup(func() {
+				buildReferrerIndexFn = oldBuildReferrerIndexFn
+				sociIndexVersion = oldSociIndexVersion
+			})
+			buildReferrerIndexFn = test.build
+			sociIndexVersion = IndexVersionV1
+
+			message, err := runIndexAndPushTest(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+				t.Fatal("did not expect a converted image to be built")
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatalf("indexAndPush returned error: %v", err)
+			}
+			if message != test.expectedMessage {
+				t.Fatalf("unexpected message: %s", message)
+			}
+			if registry.probeCalls != 0 {
+				t.Fatalf("did not expect the OCI image index probe, got %d", registry.probeCalls)
+			}
+			if len(registry.pushes) != 0 {
+				t.Fatalf("expected nothing but referrers to be pushed, got %#v", registry.pushes)
+			}
+			if len(registry.referrerPushes) != test.expectedPushes {
+				t.Fatalf("unexpected referrer pushes: %#v", registry.referrerPushes)
+			}
+			if len(registry.tags) != 1 || registry.tags[0].tag != "stable" || registry.tags[0].desc.Digest != imageDigest {
+				t.Fatalf("expected only the new tag to point at the original image, got %#v", registry.tags)
+			}
+		})
+	}
+}
+
+func TestIndexAndPushSigns(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSigner := signer
+	t.Cleanup(func() {
+		signer = oldSigner
+	})
+	signer, err = signing.NewSigner(signing.FormatCosign, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageDigest := digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	convertedDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222"),
+		Size:      123,
+	}
+	registry := &fakeRegistry{
+		headDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: imageDigest},
+		pullDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: imageDigest},
+	}
+
+	message, err := runIndexAndPushTest(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+		return &convertedDesc, nil
+	})
+	if err != nil {
+		t.Fatalf("indexAndPush returned error: %v", err)
+	}
+	if message != BuildAndPushSuccessMessage {
+		t.Fatalf("unexpected message: %s", message)
+	}
+	if len(registry.referrerPushes) != 1 || registry.referrerPushes[0].ArtifactType != signing.CosignArtifactType {
+		t.Fatalf("expected a cosign signature referrer, got %#v", registry.referrerPushes)
+	}
+	if registry.referrerPushTagged[0] != 0 || len(registry.tags) != 2 {
+		t.Fatalf("expected the signature to be pushed before tagging, got %#v", registry.tags)
+	}
+}
+
+func TestIndexAndPushVerifies(t *testing.T) {
+	trustedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldVerifier := verifier
+	t.Cleanup(func() {
+		verifier = oldVerifier
+	})
+	verifier, err = signing.NewVerifier([]crypto.PublicKey{trustedKey.Public()}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+		Size:      321,
+	}
+	signature := func(key crypto.Signer, subject ocispec.Descriptor) func(*store.SociStore) ocispec.Descriptor {
+		return func(sociStore *store.SociStore) ocispec.Descriptor {
+			signatureSigner, err := signing.NewSigner(signing.FormatCosign, key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc, err := signatureSigner.Sign(context.Background(), sociStore, "registry.example.com/example/repo", subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return desc
+		}
+	}
+	signatureDigest := digest.Digest("sha256:3333333333333333333333333333333333333333333333333333333333333333")
+	otherImage := imageDesc
+	otherImage.Digest = digest.Digest("sha256:4444444444444444444444444444444444444444444444444444444444444444")
+
+	tests := []struct {
+		name       string
+		referrers  []ocispec.Descriptor
+		signatures map[string]func(*store.SociStore) ocispec.Descriptor
+		verified   bool
+		// expectedErr is the error of unverified images, ErrNoValidSignature when unset
+		expectedErr error
+	}{
+		{
+			name:       "referrer signed with trusted key",
+			referrers:  []ocispec.Descriptor{{ArtifactType: signing.CosignArtifactType, Digest: signatureDigest}},
+			signatures: map[string]func(*store.SociStore) ocispec.Descriptor{signatureDigest.String(): signature(trustedKey, imageDesc)},
+			verified:   true,
+		},
+		{
+			name:       "cosign signature tag signed with trusted key",
+			signatures: map[string]func(*store.SociStore) ocispec.Descriptor{signing.CosignSignatureTag(imageDesc.Digest): signature(trustedKey, imageDesc)},
+			verified:   true,
+		},
+		{
+			name: "unsigned",
+		},
+		{
+			name:       "signed with another key",
+			referrers:  []ocispec.Descriptor{{ArtifactType: signing.CosignArtifactType, Digest: signatureDigest}},
+			signatures: map[string]func(*store.SociStore) ocispec.Descriptor{signatureDigest.String(): signature(otherKey, imageDesc)},
+		},
+		{
+			name:       "signature of another image",
+			signatures: map[string]func(*store.SociStore) ocispec.Descriptor{signing.CosignSignatureTag(imageDesc.Digest): signature(trustedKey, otherImage)},
+		},
+		{
+			name:        "only signed with a sigstore bundle",
+			referrers:   []ocispec.Descriptor{{ArtifactType: "application/vnd.dev.sigstore.bundle.v0.3+json", Digest: signatureDigest}},
+			expectedErr: signing.ErrUnsupportedSignatureFormat,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &fakeRegistry{
+				headDescriptor:  imageDesc,
+				pullDescriptor:  imageDesc,
+				referrers:       map[digest.Digest][]ocispec.Descriptor{imageDesc.Digest: test.referrers},
+				referrerContent: test.signatures,
+			}
+			message, err := runIndexAndPushTest(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+				return &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: otherImage.Digest}, nil
+			})
+
+			if !test.verified {
+				if err == nil || message != VerifyFailedMessage {
+					t.Fatalf("expected verification to fail, got %q, %v", message, err)
+				}
+				expectedErr := test.expectedErr
+				if expectedErr == nil {
+					expectedErr = signing.ErrNoValidSignature
+				}
+				if !errors.Is(err, expectedErr) {
+					t.Fatalf("expected %v, got %v", expectedErr, err)
+				}
+				if len(registry.pullReferences) != 0 || len(registry.tags) != 0 {
+					t.Fatalf("expected nothing to be pulled or tagged, got %#v and %#v", registry.pullReferences, registry.tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("indexAndPush returned error: %v", err)
+			}
+			if len(registry.pullReferences) != 1 || registry.pullReferences[0] != imageDesc.Digest.String() {
+				t.Fatalf("expected the verified digest to be pulled, got %#v", registry.pullReferences)
+			}
+		})
+	}
+}
+
+func TestIndexAndPushTagMoved(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+	}
+	movedDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:5555555555555555555555555555555555555555555555555555555555555555"),
+	}
+	convertedDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222"),
+	}
+
+	tests := []struct {
+		name              string
+		moved             *ocispec.Descriptor
+		newTags           []string
+		expectedMessage   string
+		expectedHeadCalls int
+		expectedTags      int
+	}{
+		{
+			name:              "replaces tag that didn't move",
+			newTags:           []string{"latest", "stable"},
+			expectedMessage:   BuildAndPushSuccessMessage,
+			expectedHeadCalls: 3,
+			expectedTags:      2,
+		},
+		{
+			name:              "leaves tag that moved alone",
+			moved:             &movedDesc,
+			newTags:           []string{"latest", "stable"},
+			expectedMessage:   TagMovedMessage,
+			expectedHeadCalls: 3,
+		},
+		{
+			name:              "doesn't check tag it doesn't replace",
+			moved:             &movedDesc,
+			newTags:           []string{"stable"},
+			expectedMessage:   BuildAndPushSuccessMessage,
+			expectedHeadCalls: 2,
+			expectedTags:      1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &fakeRegistry{
+				headDescriptor:  imageDesc,
+				pullDescriptor:  imageDesc,
+				movedDescriptor: test.moved,
+			}
+			installTestHooks(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+				return &convertedDesc, nil
+			})
+
+			message, err := indexAndPush(context.Background(), testSource, test.newTags, "")
+			if message != test.expectedMessage {
+				t.Fatalf("unexpected message: %s (%v)", message, err)
+			}
+			if test.expectedMessage == TagMovedMessage {
+				if !errors.Is(err, ErrTagMoved) || exitCode(err) != tagMovedExitCode {
+					t.Fatalf("expected ErrTagMoved, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("indexAndPush returned error: %v", err)
+			}
+			if len(registry.pullReferences) != 1 || registry.pullReferences[0] != imageDesc.Digest.String() {
+				t.Fatalf("expected the resolved digest to be pulled, got %#v", registry.pullReferences)
+			}
+			if registry.headCalls != test.expectedHeadCalls {
+				t.Fatalf("expected %d tag resolves, got %d", test.expectedHeadCalls, registry.headCalls)
+			}
+			if len(registry.tags) != test.expectedTags {
+				t.Fatalf("expected %d tags, got %#v", test.expectedTags, registry.tags)
+			}
+		})
+	}
+}
+
 func TestResolveSourceImageDescriptor(t *testing.T) {
 	validationErr := errors.New("validation failed")
 	headErr := errors.New("head failed")
@@ -300,3 +859,140 @@ func TestResolveSourceImageDescriptor(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexAndPushDigestOnly(t *testing.T) {
+	imageDigest := digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	convertedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("converted")}
+	registry := &fakeRegistry{
+		headDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: imageDigest},
+		pullDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: imageDigest},
+	}
+	installTestHooks(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+		return &convertedDesc, nil
+	})
+
+	message, err := indexAndPush(context.Background(), imageReference{registry: "registry.example.com", repo: "example/repo", digest: imageDigest}, nil, "")
+	if err != nil {
+		t.Fatalf("indexAndPush returned error: %v", err)
+	}
+	if message != BuildAndPushSuccessMessage {
+		t.Fatalf("unexpected message: %s", message)
+	}
+	if len(registry.pushes) != 1 || len(registry.tags) != 0 {
+		t.Fatalf("expected an untagged push, got %#v %#v", registry.pushes, registry.tags)
+	}
+	if registry.digestOutput.String() != convertedDesc.Digest.String()+"\n" {
+		t.Fatalf("expected the converted digest as output, got %q", registry.digestOutput.String())
+	}
+}
+
+func TestIndexAndPushTagAndDigest(t *testing.T) {
+	imageDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("image")}
+	otherDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("other")}
+	convertedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("converted")}
+	source := imageReference{registry: "registry.example.com", repo: "example/repo", tag: "latest", digest: imageDesc.Digest}
+
+	tests := []struct {
+		name            string
+		latest          ocispec.Descriptor
+		expectedMessage string
+		expectedLatest  digest.Digest
+	}{
+		{name: "replaces the tag pointing at the digest", latest: imageDesc, expectedMessage: BuildAndPushSuccessMessage, expectedLatest: convertedDesc.Digest},
+		{name: "leaves a tag pointing elsewhere alone", latest: otherDesc, expectedMessage: TagMovedMessage, expectedLatest: otherDesc.Digest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &fakeRegistry{
+				pullDescriptor: imageDesc,
+				tagDescriptors: map[string]ocispec.Descriptor{"latest": test.latest, imageDesc.Digest.String(): imageDesc},
+			}
+			installTestHooks(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+				return &convertedDesc, nil
+			})
+
+			message, err := indexAndPush(context.Background(), source, []string{"latest"}, "")
+			if message != test.expectedMessage {
+				t.Fatalf("unexpected message: %s (%v)", message, err)
+			}
+			if len(registry.pullReferences) != 1 || registry.pullReferences[0] != imageDesc.Digest.String() {
+				t.Fatalf("expected the pinned digest to be pulled, got %#v", registry.pullReferences)
+			}
+			if registry.tagDescriptors["latest"].Digest != test.expectedLatest {
+				t.Fatalf("expected latest to point at %s, got %s", test.expectedLatest, registry.tagDescriptors["latest"].Digest)
+			}
+		})
+	}
+}
+
+func TestIndexAndPushPrintsOnlyTheDigest(t *testing.T) {
+	ctx := context.Background()
+	oldMinLayerSize := minLayerSize
+	oldStdout := os.Stdout
+	t.Cleanup(func() {
+		minLayerSize = oldMinLayerSize
+		os.Stdout = oldStdout
+	})
+	minLayerSize = 0
+
+	var layer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&layer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	fileContent := []byte("hello")
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0o644, Size: int64(len(fileContent))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarWriter.Write(fileContent); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer.Bytes()), Size: int64(layer.Len())}
+
+	registry := &fakeRegistry{}
+	registry.pullContent = func(sociStore *store.SociStore) {
+		if err := pushContent(ctx, sociStore, layerDesc, layer.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		config := mustPushJSON(t, sociStore, ocispec.MediaTypeImageConfig, ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(fileContent)}},
+		})
+		registry.pullDescriptor = mustPushJSON(t, sociStore, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ocispec.Descriptor{layerDesc},
+		})
+	}
+	registry.headDescriptor = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image")}
+	installTestHooks(t, registry, buildIndex)
+
+	// scripts read the digest from stdout, which the soci library also prints to while building
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	os.Stdout = writer
+	digestOutput = writer
+
+	message, err := indexAndPush(ctx, testSource, []string{"latest"}, "")
+	os.Stdout = oldStdout
+	writer.Close()
+	if err != nil || message != BuildAndPushSuccessMessage {
+		t.Fatalf("unexpected message: %s (%v)", message, err)
+	}
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.pushes) != 1 || string(output) != registry.pushes[0].Digest.String()+"\n" {
+		t.Fatalf("expected only the converted digest on stdout, got %q", output)
+	}
+}
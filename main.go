@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
-	parser "github.com/novln/docker-parser"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/signing"
 	"github.com/spf13/cobra"
 )
 
@@ -20,21 +26,287 @@ var (
 )
 
 var (
-	auth    string
-	newTags []string
+	auth          string
+	newTags       []string
+	retryAttempts int
+
+	plainHTTPHosts []string
+	insecureHosts  []string
+	caFiles        []string
+	certFiles      []string
+	keyFiles       []string
+	hostsDir       string
+
+	awsProfiles     []string
+	awsRoleArns     []string
+	awsExternalIds  []string
+	awsSessionNames []string
+
+	credentialProviders []string
+	dockerConfig        bool
+
+	signKey    string
+	signCert   string
+	signFormat string
+
+	verifyKeys     []string
+	verifyCA       string
+	verifyIdentity string
+
+	timeouts []string
 )
 
-func parseImageDesc(desc string) (repo, tag, registry string, err error) {
-	ref, err := parser.Parse(desc)
+// tagMovedExitCode tells scripts the source tag moved while indexing, so indexing it again is worth it
+const tagMovedExitCode = 2
+
+// Exit codes of runs stopped by a signal or a timeout, like shells and timeout(1) use
+const (
+	interruptedExitCode = 130
+	timeoutExitCode     = 124
+)
+
+// signPasswordEnvVar holds the password of encrypted signing keys, the same variable cosign reads
+const signPasswordEnvVar = "COSIGN_PASSWORD"
+
+// hostPattern matches registry hosts and host globs, like harbor.internal, localhost:5000 or *.pkg.dev
+var hostPattern = regexp.MustCompile(`^[a-zA-Z0-9*?.-]+(:[0-9]+)?$`)
+
+// Whether the text before = in a flag value is a registry host. Like docker, hosts have a dot or a port or are
+// localhost, so values such as AWS external IDs can hold = themselves.
+func isHostPrefix(prefix string) bool {
+	if prefix == registryutils.AllHosts {
+		return true
+	}
+	return hostPattern.MatchString(prefix) && (strings.ContainsAny(prefix, ".:") || prefix == "localhost")
+}
+
+// Split a [HOST=]VALUE flag value. Values without a host apply to all registries, *=VALUE gives the same for values
+// that start with something like a host.
+func parseHostFlag(value string) (host, rest string) {
+	if prefix, rest, found := strings.Cut(value, "="); found && isHostPrefix(prefix) {
+		return prefix, rest
+	}
+	return registryutils.AllHosts, value
+}
+
+// Split a HOST[=true|false] flag value, hosts without a value are turned on. False turns a setting for all
+// registries off for the host.
+func parseHostSwitch(value string) (host string, enabled bool, err error) {
+	host, setting, found := strings.Cut(value, "=")
+	if !found {
+		return host, true, nil
+	}
+	enabled, err = strconv.ParseBool(setting)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid value %s, expected HOST or HOST=true|false", value)
+	}
+	return host, enabled, nil
+}
+
+// Build a registry option for every HOST[=true|false] flag value
+func hostSwitchOptions(values []string, config func(enabled *bool) registryutils.HostConfig) ([]registryutils.Option, error) {
+	var opts []registryutils.Option
+	for _, value := range values {
+		host, enabled, err := parseHostSwitch(value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, registryutils.WithHostConfig(host, config(registryutils.Bool(enabled))))
+	}
+	return opts, nil
+}
+
+// Build a registry option for every [HOST=]VALUE flag value
+func perHostOptions(values []string, config func(value string) registryutils.HostConfig) []registryutils.Option {
+	var opts []registryutils.Option
+	for _, value := range values {
+		host, rest := parseHostFlag(value)
+		opts = append(opts, registryutils.WithHostConfig(host, config(rest)))
+	}
+	return opts
+}
+
+// Collect per-host TLS and AWS settings from the command line
+func hostConfigOptions() ([]registryutils.Option, error) {
+	opts, err := hostSwitchOptions(plainHTTPHosts, func(enabled *bool) registryutils.HostConfig {
+		return registryutils.HostConfig{PlainHTTP: enabled}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("--plain-http: %w", err)
+	}
+	insecureOpts, err := hostSwitchOptions(insecureHosts, func(enabled *bool) registryutils.HostConfig {
+		return registryutils.HostConfig{InsecureSkipVerify: enabled}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("--insecure-skip-tls-verify: %w", err)
+	}
+	opts = append(opts, insecureOpts...)
+	opts = append(opts, perHostOptions(caFiles, func(file string) registryutils.HostConfig {
+		return registryutils.HostConfig{CAFiles: []string{file}}
+	})...)
+	opts = append(opts, perHostOptions(certFiles, func(file string) registryutils.HostConfig {
+		return registryutils.HostConfig{CertFile: file}
+	})...)
+	opts = append(opts, perHostOptions(keyFiles, func(file string) registryutils.HostConfig {
+		return registryutils.HostConfig{KeyFile: file}
+	})...)
+	opts = append(opts, perHostOptions(awsProfiles, func(profile string) registryutils.HostConfig {
+		return registryutils.HostConfig{Aws: registryutils.AwsConfig{Profile: profile}}
+	})...)
+	opts = append(opts, perHostOptions(awsRoleArns, func(roleArn string) registryutils.HostConfig {
+		return registryutils.HostConfig{Aws: registryutils.AwsConfig{RoleARN: roleArn}}
+	})...)
+	opts = append(opts, perHostOptions(awsExternalIds, func(externalId string) registryutils.HostConfig {
+		return registryutils.HostConfig{Aws: registryutils.AwsConfig{ExternalID: externalId}}
+	})...)
+	opts = append(opts, perHostOptions(awsSessionNames, func(sessionName string) registryutils.HostConfig {
+		return registryutils.HostConfig{Aws: registryutils.AwsConfig{RoleSessionName: sessionName}}
+	})...)
+	return opts, nil
+}
+
+// Parse a [HOSTGLOB=]COMMAND [ARG]... credential provider flag. Only the first word can hold the host glob, so
+// arguments like --arg=x are left alone.
+func parseCredentialProvider(value string) (registryutils.CredentialProvider, bool) {
+	command := strings.Fields(value)
+	if len(command) == 0 {
+		return registryutils.CredentialProvider{}, false
+	}
+	host, executable := parseHostFlag(command[0])
+	if executable == "" {
+		if len(command) == 1 {
+			return registryutils.CredentialProvider{}, false
+		}
+		executable, command = command[1], command[1:]
+	}
+	provider := registryutils.CredentialProvider{Command: executable, Args: command[1:]}
+	if host != registryutils.AllHosts {
+		provider.MatchImages = []string{host}
+	}
+	return provider, true
+}
+
+// Build a registry option for every credential provider flag
+func credentialProviderOptions() []registryutils.Option {
+	var opts []registryutils.Option
+	for _, value := range credentialProviders {
+		if provider, ok := parseCredentialProvider(value); ok {
+			opts = append(opts, registryutils.WithCredentialProvider(provider))
+		}
+	}
+	return opts
+}
+
+// Set registryOptions from the connection and authentication flags, for clients of the source image
+func setupRegistryOptions(source imageReference) error {
+	registryOptions = append(registryOptions, registryutils.WithImage(source.String()))
+	if retryAttempts > 0 {
+		registryOptions = append(registryOptions, registryutils.WithRetryPolicy(registryutils.DefaultRetryPolicy.WithMaxAttempts(retryAttempts)))
+	}
+	hostOpts, err := hostConfigOptions()
+	if err != nil {
+		return err
+	}
+	registryOptions = append(registryOptions, hostOpts...)
+	registryOptions = append(registryOptions, credentialProviderOptions()...)
+	registryOptions = append(registryOptions, registryutils.WithHostAuth(authSource{files: authFiles, getenv: os.Getenv}.resolveHost))
+	if hostsDir != "" {
+		registryOptions = append(registryOptions, registryutils.WithHostsDir(hostsDir))
+	}
+	if dockerConfig {
+		registryOptions = append(registryOptions, registryutils.WithDockerConfig())
+	}
+	return nil
+}
+
+// Set signer from the signing flags
+func setupSigner() error {
+	if signKey == "" {
+		if signCert != "" {
+			return errors.New("--sign-cert needs --sign-key")
+		}
+		return nil
+	}
+
+	password := os.Getenv(signPasswordEnvVar)
+	log.RegisterSecret(password)
+	key, err := signing.LoadPrivateKey(signKey, []byte(password))
 	if err != nil {
-		return
+		return err
+	}
+	var certificates []*x509.Certificate
+	if signCert != "" {
+		certificates, err = signing.LoadCertificates(signCert)
+		if err != nil {
+			return err
+		}
+	}
+	signer, err = signing.NewSigner(signFormat, key, certificates)
+	return err
+}
+
+// Set verifier from the verification flags
+func setupVerifier() error {
+	if len(verifyKeys) == 0 && verifyCA == "" {
+		if verifyIdentity != "" {
+			return errors.New("--verify-identity needs --verify-ca")
+		}
+		return nil
 	}
 
-	repo = ref.ShortName()
-	tag = ref.Tag()
-	registry = ref.Registry()
+	var publicKeys []crypto.PublicKey
+	for _, path := range verifyKeys {
+		publicKey, err := signing.LoadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	var roots []*x509.Certificate
+	if verifyCA != "" {
+		var err error
+		roots, err = signing.LoadCertificates(verifyCA)
+		if err != nil {
+			return err
+		}
+	}
 
-	return
+	var err error
+	verifier, err = signing.NewVerifier(publicKeys, roots, verifyIdentity)
+	return err
+}
+
+// Set runTimeout and phaseTimeouts from the timeout flags
+func setupTimeouts() error {
+	var err error
+	runTimeout, phaseTimeouts, err = parseTimeouts(timeouts)
+	return err
+}
+
+// Get the authentication token for the registry from the authentication flags or environment
+func resolveAuthToken(ctx context.Context, registry string) (string, error) {
+	if auth != "" {
+		log.RegisterSecret(auth)
+		log.Warn(ctx, "--auth can leak through the process list and shell history, prefer --auth-stdin, --auth-file or "+authEnvVar)
+	}
+	source := authSource{flag: auth, files: authFiles, getenv: os.Getenv}
+	if authStdin {
+		source.stdin = os.Stdin
+	}
+	return source.resolve(registry)
+}
+
+// Pick the process exit code for an indexing error
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrTagMoved):
+		return tagMovedExitCode
+	case errors.Is(err, ErrInterrupted), errors.Is(err, context.Canceled):
+		return interruptedExitCode
+	case errors.Is(err, context.DeadlineExceeded):
+		return timeoutExitCode
+	}
+	return 1
 }
 
 func main() {
@@ -43,40 +315,126 @@ func main() {
 		Short:   "Standalone SOCI indexer for a container image that both indexes and pushes the index",
 		Version: versionString,
 		Args:    cobra.ExactArgs(1),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			setupConfig(cmd)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			var ctx = context.Background()
 
-			repo, tag, registry, err := parseImageDesc(args[0])
+			source, err := parseImageReference(args[0])
 			if err != nil {
 				log.Error(ctx, "Error parsing image reference: %s", err)
 				os.Exit(1)
 			}
 
-			if strings.Contains(tag, ":") && len(newTags) == 0 {
-				log.Error(ctx, "Tag cannot be a digest without --new-tag", nil)
+			if sociIndexVersion != IndexVersionV2 && sociIndexVersion != IndexVersionV1 {
+				log.Error(ctx, fmt.Sprintf("Unknown SOCI index version %s, expected %s or %s", sociIndexVersion, IndexVersionV2, IndexVersionV1), nil)
+				os.Exit(1)
+			}
+
+			if spanSize <= 0 || minLayerSize < 0 {
+				log.Error(ctx, fmt.Sprintf("Invalid build options, --span-size must be positive and --min-layer-size can't be negative, got %d and %d", spanSize, minLayerSize), nil)
+				os.Exit(1)
+			}
+
+			if signKey != "" && sociIndexVersion == IndexVersionV1 {
+				log.Error(ctx, "--sign-key signs the converted image, which --index-version v1 doesn't create", nil)
+				os.Exit(1)
+			}
+			if provenance && sociIndexVersion == IndexVersionV1 {
+				log.Error(ctx, "--provenance describes the converted image, which --index-version v1 doesn't create", nil)
+				os.Exit(1)
+			}
+			if copyReferrers && sociIndexVersion == IndexVersionV1 {
+				log.Error(ctx, "--copy-referrers copies referrers to the converted image, which --index-version v1 doesn't create", nil)
 				os.Exit(1)
 			}
 
-			if tag == "" {
-				log.Error(ctx, "Tag is required", nil)
+			if _, err := parseTagTemplate(backupTagTemplate); backupTagTemplate != "" && err != nil {
+				log.Error(ctx, "Invalid --backup-tag-template", err)
 				os.Exit(1)
 			}
 
-			if len(newTags) == 0 {
-				newTags = append(newTags, tag)
+			if err := parseTagTemplates(newTags); err != nil {
+				log.Error(ctx, "Invalid --new-tag template", err)
+				os.Exit(1)
 			}
 
-			log.Info(ctx, fmt.Sprintf("Indexing %s:%s and pushing with tags %s to %s", repo, tag, newTags, registry))
+			// digests can't be replaced with the converted image, it's pushed untagged instead
+			if len(newTags) == 0 && source.tag != "" {
+				newTags = append(newTags, source.tag)
+			}
 
-			_, err = indexAndPush(ctx, repo, tag, newTags, registry, auth)
+			if err := setupRegistryOptions(source); err != nil {
+				log.Error(ctx, "Invalid registry flags", err)
+				os.Exit(1)
+			}
+			if err := setupTimeouts(); err != nil {
+				log.Error(ctx, "Invalid --timeout", err)
+				os.Exit(1)
+			}
+			if err := setupSigner(); err != nil {
+				log.Error(ctx, "Error loading signing key", err)
+				os.Exit(1)
+			}
+			if err := setupVerifier(); err != nil {
+				log.Error(ctx, "Error loading signature verification keys", err)
+				os.Exit(1)
+			}
+			authToken, err := resolveAuthToken(ctx, source.registry)
 			if err != nil {
+				log.Error(ctx, "Error reading authentication token", err)
 				os.Exit(1)
 			}
+
+			log.Info(ctx, fmt.Sprintf("Indexing %s and pushing with tags %s", source, newTags))
+
+			runCtx, cancel := newRunContext()
+			_, err = indexAndPush(runCtx, source, newTags, authToken)
+			cancel()
+			if err != nil {
+				os.Exit(exitCode(err))
+			}
 		},
 	}
 
-	rootCmd.Flags().StringVarP(&auth, "auth", "a", "", "Registry authentication token (usually USER:PASSWORD)")
-	rootCmd.Flags().StringArrayVarP(&newTags, "new-tag", "t", nil, "Push indexed image with this tag")
+	rootCmd.PersistentFlags().StringVar(&configFile, configFlag, "", "Read settings from this YAML or TOML file (default the soci-indexer/config.yaml user config or /etc/soci-indexer/config.yaml, also as .yml or .toml)")
+	rootCmd.PersistentFlags().StringVarP(&auth, "auth", "a", "", "Registry authentication token (usually USER:PASSWORD), also read from "+authEnvVar+" or "+authEnvVar+"_<HOST>")
+	rootCmd.PersistentFlags().BoolVar(&authStdin, "auth-stdin", false, "Read the registry authentication token from stdin")
+	rootCmd.PersistentFlags().StringArrayVar(&authFiles, "auth-file", nil, "Read the registry authentication token from a file, optionally for a single registry host ([HOST=]PATH)")
+	rootCmd.MarkFlagsMutuallyExclusive("auth", "auth-stdin")
+	rootCmd.Flags().StringArrayVarP(&newTags, "new-tag", "t", nil, "Push indexed image with this tag, a template like {{.Tag}}-soci can use {{.Tag}}, {{.Repo}}, {{.ShortDigest}} and {{.Platform}}")
+	rootCmd.PersistentFlags().BoolVar(&skipOciProbe, "skip-oci-probe", false, "Don't push a tiny OCI image index before pulling to fail early on registries that don't take them. The probe is deleted again, registries that don't allow deletes keep a single untagged probe per repository")
+	rootCmd.PersistentFlags().BoolVar(&copyReferrers, "copy-referrers", false, "Attach SBOMs and other referrers of the original image to the converted image, warning about signatures that must be signed again")
+	rootCmd.PersistentFlags().StringVar(&backupTagTemplate, "backup-tag-template", "", "Tag the original image with this template (e.g. {{.Tag}}-orig) before its tag points at the converted image")
+	rootCmd.PersistentFlags().BoolVar(&provenance, "provenance", false, "Attach an in-toto SLSA provenance statement describing the conversion to the converted image")
+	rootCmd.PersistentFlags().StringVar(&signKey, "sign-key", "", "Sign the converted image with this PEM private key before tagging it, encrypted cosign keys are decrypted with "+signPasswordEnvVar)
+	rootCmd.PersistentFlags().StringVar(&signCert, "sign-cert", "", "PEM certificate chain of --sign-key, leaf first, required for notation signatures")
+	rootCmd.PersistentFlags().StringVar(&signFormat, "sign-format", signing.FormatCosign, "Signature format: cosign or notation")
+	rootCmd.PersistentFlags().StringArrayVar(&verifyKeys, "verify-key", nil, "Only index images signed with this PEM public key, like cosign.pub")
+	rootCmd.PersistentFlags().StringVar(&verifyCA, "verify-ca", "", "Only index images signed with a code signing certificate issued by a CA in this PEM bundle, which must still be valid (long-lived private PKI certificates, not keyless ones)")
+	rootCmd.PersistentFlags().StringVar(&verifyIdentity, "verify-identity", "", "Only trust --verify-ca certificates issued for this common name, email, DNS name or URI")
+	rootCmd.Flags().Int64Var(&spanSize, "span-size", spanSize, "Size in bytes of the spans layers are split into for lazy loading")
+	rootCmd.Flags().Int64Var(&minLayerSize, "min-layer-size", minLayerSize, "Layers smaller than this many bytes are pulled whole instead of getting a zTOC")
+	rootCmd.Flags().StringVar(&sociIndexVersion, "index-version", IndexVersionV2, "SOCI index manifest version: v2 pushes a converted image with a new digest, v1 attaches the index to the original image as a referrer")
+	rootCmd.PersistentFlags().StringArrayVar(&plainHTTPHosts, "plain-http", nil, "Use plain HTTP instead of HTTPS for this registry host (e.g. localhost:5000), or * for all. HOST=false turns it off again for one host")
+	rootCmd.PersistentFlags().StringArrayVar(&insecureHosts, "insecure-skip-tls-verify", nil, "Skip TLS certificate verification for this registry host, or * for all. HOST=false turns it off again for one host")
+	rootCmd.PersistentFlags().StringArrayVar(&caFiles, "ca-file", nil, "Trust this PEM CA bundle, optionally for a single registry host ([HOST=]PATH)")
+	rootCmd.PersistentFlags().StringArrayVar(&certFiles, "cert-file", nil, "PEM client certificate for mTLS, optionally for a single registry host ([HOST=]PATH)")
+	rootCmd.PersistentFlags().StringArrayVar(&keyFiles, "key-file", nil, "PEM client key for mTLS, optionally for a single registry host ([HOST=]PATH)")
+	rootCmd.PersistentFlags().StringArrayVar(&awsProfiles, "aws-profile", nil, "AWS profile used to authorize with ECR, optionally for a single registry host ([HOST=]PROFILE)")
+	rootCmd.PersistentFlags().StringArrayVar(&awsRoleArns, "aws-role-arn", nil, "IAM role to assume before authorizing with ECR, optionally for a single registry host ([HOST=]ARN)")
+	rootCmd.PersistentFlags().StringArrayVar(&awsExternalIds, "aws-external-id", nil, "External ID used when assuming --aws-role-arn ([HOST=]ID, use *=ID for IDs that start with a host and =)")
+	rootCmd.PersistentFlags().StringArrayVar(&awsSessionNames, "aws-role-session-name", nil, "Session name used when assuming --aws-role-arn ([HOST=]NAME)")
+	rootCmd.PersistentFlags().StringArrayVar(&credentialProviders, "credential-provider", nil, "Get credentials from a kubelet style credential provider executable, optionally for matching registry hosts ([HOSTGLOB=]COMMAND [ARG]...)")
+	rootCmd.PersistentFlags().BoolVar(&dockerConfig, "docker-config", false, "Use credentials saved by docker login and docker credential helpers for registries without other credentials")
+	rootCmd.PersistentFlags().StringVar(&hostsDir, "hosts-dir", "", "Read mirrors and TLS settings from containerd style HOST/hosts.toml files in this directory (e.g. /etc/containerd/certs.d)")
+	rootCmd.PersistentFlags().StringArrayVar(&timeouts, "timeout", nil, "Stop the run after this duration (e.g. 30m), or a phase of it with PHASE=DURATION where PHASE is "+strings.Join(phases, ", ")+". Tagging is never interrupted halfway")
+	rootCmd.PersistentFlags().IntVar(&retryAttempts, "retry-attempts", 0, "Maximum attempts for each registry call (default depends on the operation)")
+
+	rootCmd.AddCommand(newDoctorCommand())
+	rootCmd.AddCommand(newMigrateCommand())
+	rootCmd.AddCommand(newConfigCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
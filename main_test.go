@@ -1,30 +1,160 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
 )
 
 func TestImageParsing(t *testing.T) {
-	test := func(desc, expectedRepo, expectedTag, expectedRegistry string) {
-		repo, tag, registry, err := parseImageDesc(desc)
-		if err != nil {
-			t.Error(err)
-			return
+	const dgst = "sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8"
+
+	tests := []struct {
+		desc     string
+		expected imageReference
+		fails    bool
+	}{
+		{desc: "foo/bar", expected: imageReference{registry: "docker.io", repo: "foo/bar", tag: "latest"}},
+		{desc: "foo/bar:version", expected: imageReference{registry: "docker.io", repo: "foo/bar", tag: "version"}},
+		{desc: "foo/bar@" + dgst, expected: imageReference{registry: "docker.io", repo: "foo/bar", digest: dgst}},
+		{desc: "public.ecr.aws/foo/bar", expected: imageReference{registry: "public.ecr.aws", repo: "foo/bar", tag: "latest"}},
+		{desc: "public.ecr.aws/foo/bar:version", expected: imageReference{registry: "public.ecr.aws", repo: "foo/bar", tag: "version"}},
+		{desc: "public.ecr.aws/foo/bar@" + dgst, expected: imageReference{registry: "public.ecr.aws", repo: "foo/bar", digest: dgst}},
+
+		// tag and digest
+		{desc: "foo/bar:version@" + dgst, expected: imageReference{registry: "docker.io", repo: "foo/bar", tag: "version", digest: dgst}},
+		{desc: "public.ecr.aws/foo/bar:version@" + dgst, expected: imageReference{registry: "public.ecr.aws", repo: "foo/bar", tag: "version", digest: dgst}},
+
+		// Docker Hub official images
+		{desc: "ubuntu", expected: imageReference{registry: "docker.io", repo: "library/ubuntu", tag: "latest"}},
+		{desc: "ubuntu:24.04", expected: imageReference{registry: "docker.io", repo: "library/ubuntu", tag: "24.04"}},
+		{desc: "docker.io/ubuntu", expected: imageReference{registry: "docker.io", repo: "library/ubuntu", tag: "latest"}},
+		{desc: "index.docker.io/foo/bar", expected: imageReference{registry: "docker.io", repo: "foo/bar", tag: "latest"}},
+		{desc: "docker.io/library/ubuntu@" + dgst, expected: imageReference{registry: "docker.io", repo: "library/ubuntu", digest: dgst}},
+
+		// registries with ports
+		{desc: "localhost/repo", expected: imageReference{registry: "localhost", repo: "repo", tag: "latest"}},
+		{desc: "localhost:5000/repo", expected: imageReference{registry: "localhost:5000", repo: "repo", tag: "latest"}},
+		{desc: "localhost:5000/repo:5000", expected: imageReference{registry: "localhost:5000", repo: "repo", tag: "5000"}},
+		{desc: "registry.example.com:8443/team/app:v1@" + dgst, expected: imageReference{registry: "registry.example.com:8443", repo: "team/app", tag: "v1", digest: dgst}},
+		{desc: "127.0.0.1:5000/a/b/c", expected: imageReference{registry: "127.0.0.1:5000", repo: "a/b/c", tag: "latest"}},
+		{desc: "123456789012.dkr.ecr.us-east-1.amazonaws.com/repo:tag", expected: imageReference{registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", repo: "repo", tag: "tag"}},
+		{desc: "Registry/repo", expected: imageReference{registry: "Registry", repo: "repo", tag: "latest"}},
+
+		{desc: "", fails: true},
+		{desc: "foo/Bar", fails: true},
+		{desc: "foo/bar:", fails: true},
+		{desc: "foo/bar:-version", fails: true},
+		{desc: "foo/bar@sha256:1234", fails: true},
+		{desc: "foo/bar@" + dgst + ":version", fails: true},
+		{desc: "9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8", fails: true},
+		{desc: "https://registry.example.com/repo", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ref, err := parseImageReference(test.desc)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseImageReference returned error: %v", err)
+			}
+			if ref != test.expected {
+				t.Fatalf("expected %#v, got %#v", test.expected, ref)
+			}
+		})
+	}
+}
+
+func TestImageReferenceNames(t *testing.T) {
+	const dgst = "sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8"
+
+	tests := []struct {
+		ref       imageReference
+		reference string
+		full      string
+	}{
+		{ref: imageReference{registry: "docker.io", repo: "foo/bar", tag: "latest"}, reference: "latest", full: "docker.io/foo/bar:latest"},
+		{ref: imageReference{registry: "docker.io", repo: "foo/bar", digest: dgst}, reference: dgst, full: "docker.io/foo/bar@" + dgst},
+		{ref: imageReference{registry: "localhost:5000", repo: "repo", tag: "v1", digest: dgst}, reference: dgst, full: "localhost:5000/repo:v1@" + dgst},
+	}
+
+	for _, test := range tests {
+		t.Run(test.full, func(t *testing.T) {
+			if reference := test.ref.reference(); reference != test.reference {
+				t.Errorf("expected reference %s, got %s", test.reference, reference)
+			}
+			if full := test.ref.String(); full != test.full {
+				t.Errorf("expected %s, got %s", test.full, full)
+			}
+			// the full reference parses back to the same reference
+			if parsed, err := parseImageReference(test.full); err != nil || parsed != test.ref {
+				t.Errorf("expected %s to parse back, got %#v, %v", test.full, parsed, err)
+			}
+		})
+	}
+}
+
+func TestParseHostFlag(t *testing.T) {
+	test := func(value, expectedHost, expectedRest string) {
+		host, rest := parseHostFlag(value)
+		if host != expectedHost || rest != expectedRest {
+			t.Errorf("parseHostFlag(%q) = %q, %q; expected %q, %q", value, host, rest, expectedHost, expectedRest)
 		}
-		if repo != expectedRepo || tag != expectedTag || registry != expectedRegistry {
-			t.Errorf(
-				"Image string: %s\nExpected:\n  repo=%s\n  tag=%s\n  registry=%s\nGot:\n  repo=%s\n  tag=%s\n  registry=%s",
-				desc,
-				expectedRepo, expectedTag, expectedRegistry,
-				repo, tag, registry,
-			)
+	}
+
+	test("/etc/ssl/ca.pem", "*", "/etc/ssl/ca.pem")
+	test("harbor.internal=/etc/ssl/ca.pem", "harbor.internal", "/etc/ssl/ca.pem")
+	test("localhost:5000=ca.pem", "localhost:5000", "ca.pem")
+	test("./certs/a=b.pem", "*", "./certs/a=b.pem")
+	test("abc=def", "*", "abc=def")
+	test("external=id=with=equals", "*", "external=id=with=equals")
+	test("*=harbor.internal=id", "*", "harbor.internal=id")
+	test("localhost=token", "localhost", "token")
+	test("*.pkg.dev=provider", "*.pkg.dev", "provider")
+	test("arn:aws:iam::123456789012:role/path/name=with=equals", "*", "arn:aws:iam::123456789012:role/path/name=with=equals")
+	test("123456789012.dkr.ecr.us-east-1.amazonaws.com=arn:aws:iam::123456789012:role/indexer", "123456789012.dkr.ecr.us-east-1.amazonaws.com", "arn:aws:iam::123456789012:role/indexer")
+}
+
+func TestParseHostSwitch(t *testing.T) {
+	test := func(value, expectedHost string, expectedEnabled bool) {
+		host, enabled, err := parseHostSwitch(value)
+		if err != nil || host != expectedHost || enabled != expectedEnabled {
+			t.Errorf("parseHostSwitch(%q) = %q, %v, %v; expected %q, %v", value, host, enabled, err, expectedHost, expectedEnabled)
 		}
 	}
 
-	test("foo/bar", "foo/bar", "latest", "docker.io")
-	test("foo/bar:version", "foo/bar", "version", "docker.io")
-	test("foo/bar@sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8", "foo/bar", "sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8", "docker.io")
-	test("public.ecr.aws/foo/bar", "foo/bar", "latest", "public.ecr.aws")
-	test("public.ecr.aws/foo/bar:version", "foo/bar", "version", "public.ecr.aws")
-	test("public.ecr.aws/foo/bar@sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8", "foo/bar", "sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8", "public.ecr.aws")
+	test("localhost:5000", "localhost:5000", true)
+	test("*", "*", true)
+	test("harbor.internal=false", "harbor.internal", false)
+	test("localhost:5000=true", "localhost:5000", true)
+	if _, _, err := parseHostSwitch("localhost:5000=maybe"); err == nil {
+		t.Error("expected an error for a value that isn't true or false")
+	}
+}
+
+func TestParseCredentialProvider(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected registryutils.CredentialProvider
+		ok       bool
+	}{
+		{value: "gcp-provider --arg=x", expected: registryutils.CredentialProvider{Command: "gcp-provider", Args: []string{"--arg=x"}}, ok: true},
+		{value: "*.pkg.dev=/usr/local/bin/gcp-provider get-credentials --arg=x", expected: registryutils.CredentialProvider{Command: "/usr/local/bin/gcp-provider", Args: []string{"get-credentials", "--arg=x"}, MatchImages: []string{"*.pkg.dev"}}, ok: true},
+		{value: "harbor.internal= provider", expected: registryutils.CredentialProvider{Command: "provider", Args: []string{}, MatchImages: []string{"harbor.internal"}}, ok: true},
+		{value: "  "},
+		{value: "harbor.internal="},
+	}
+
+	for _, test := range tests {
+		provider, ok := parseCredentialProvider(test.value)
+		if ok != test.ok || !reflect.DeepEqual(provider, test.expected) {
+			t.Errorf("parseCredentialProvider(%q) = %#v, %v; expected %#v, %v", test.value, provider, ok, test.expected, test.ok)
+		}
+	}
 }
@@ -0,0 +1,332 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	NoV1IndexMessage      = "Image has no SOCI index manifest v1 to migrate"
+	MigrateSuccessMessage = "Successfully migrated SOCI index manifest v1 to a converted image"
+)
+
+// Build the migrate subcommand that turns SOCI index manifests v1 into a SOCI index manifest v2 converted image
+func newMigrateCommand() *cobra.Command {
+	var migrateTags []string
+	cmd := &cobra.Command{
+		Use:   "migrate [REGISTRY/]REPO[:TAG]",
+		Short: "Convert an image indexed with SOCI index manifest v1 referrers to a SOCI index manifest v2 converted image",
+		Long: "Convert an image indexed with SOCI index manifest v1 referrers to a SOCI index manifest v2 converted image.\n" +
+			"The zTOCs of the existing indexes are reused, so image layers are neither pulled nor indexed again.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ctx = context.Background()
+
+			source, err := parseImageReference(args[0])
+			if err != nil {
+				log.Error(ctx, "Error parsing image reference", err)
+				os.Exit(1)
+			}
+
+			if _, err := parseTagTemplate(backupTagTemplate); backupTagTemplate != "" && err != nil {
+				log.Error(ctx, "Invalid --backup-tag-template", err)
+				os.Exit(1)
+			}
+
+			if err := parseTagTemplates(migrateTags); err != nil {
+				log.Error(ctx, "Invalid --new-tag template", err)
+				os.Exit(1)
+			}
+
+			// digests can't be replaced with the converted image, it's pushed untagged instead
+			if len(migrateTags) == 0 && source.tag != "" {
+				migrateTags = append(migrateTags, source.tag)
+			}
+
+			if err := setupRegistryOptions(source); err != nil {
+				log.Error(ctx, "Invalid registry flags", err)
+				os.Exit(1)
+			}
+			if err := setupTimeouts(); err != nil {
+				log.Error(ctx, "Invalid --timeout", err)
+				os.Exit(1)
+			}
+			if err := setupSigner(); err != nil {
+				log.Error(ctx, "Error loading signing key", err)
+				os.Exit(1)
+			}
+			if err := setupVerifier(); err != nil {
+				log.Error(ctx, "Error loading signature verification keys", err)
+				os.Exit(1)
+			}
+			authToken, err := resolveAuthToken(ctx, source.registry)
+			if err != nil {
+				log.Error(ctx, "Error reading authentication token", err)
+				os.Exit(1)
+			}
+
+			log.Info(ctx, fmt.Sprintf("Migrating %s and pushing with tags %s", source, migrateTags))
+
+			runCtx, cancel := newRunContext()
+			_, err = migrateAndPush(runCtx, source, migrateTags, authToken)
+			cancel()
+			if err != nil {
+				os.Exit(exitCode(err))
+			}
+		},
+	}
+	cmd.Flags().StringArrayVarP(&migrateTags, "new-tag", "t", nil, "Push converted image with this tag, templates like --new-tag of the root command are supported")
+	return cmd
+}
+
+func migrateAndPush(ctx context.Context, source imageReference, newTags []string, authToken string) (string, error) {
+	ctx = context.WithValue(ctx, "RegistryURL", source.registry)
+	run, message, err := startConversion(ctx, source, ProvenanceBuildTypeMigrate, authToken)
+	if run == nil {
+		return message, err
+	}
+	defer cleanUp(ctx, run.dataDir)
+	ctx = context.WithValue(ctx, "ImageDigest", run.imageDesc.Digest.String())
+
+	pullCtx, cancelPull := phaseContext(ctx, PhasePull)
+	defer cancelPull()
+	// layers are not needed, the zTOCs already describe them
+	if message, err := pullSourceImage(pullCtx, run, registryClient.PullManifests, newTags); err != nil {
+		return message, err
+	}
+
+	manifests, err := imageManifests(ctx, run.sociStore, run.pulledDesc)
+	if err != nil {
+		return logAndReturnError(ctx, "Image manifest read error", err)
+	}
+
+	v1Indexes := map[digest.Digest]ocispec.Descriptor{}
+	for _, manifest := range manifests {
+		referrers, err := run.registry.Referrers(pullCtx, source.repo, manifest, soci.SociIndexArtifactTypeV1)
+		if err != nil {
+			return logAndReturnError(ctx, "SOCI index manifest v1 lookup error", err)
+		}
+		if len(referrers) == 0 {
+			log.Warn(ctx, fmt.Sprintf("No SOCI index manifest v1 for %s, it won't have a SOCI index", manifest.Digest))
+			continue
+		}
+		if len(referrers) > 1 {
+			log.Warn(ctx, fmt.Sprintf("Found %d SOCI index manifests v1 for %s, using %s", len(referrers), manifest.Digest, referrers[0].Digest))
+		}
+
+		// the subject is already pulled without its layers, only the index manifest and its zTOCs are left
+		_, err = run.registry.PullReferrer(pullCtx, source.repo, run.sociStore, referrers[0].Digest.String())
+		if err != nil {
+			return logAndReturnError(ctx, "SOCI index manifest v1 pull error", err)
+		}
+		v1Indexes[manifest.Digest] = referrers[0]
+		run.dependencies = append(run.dependencies, referrers[0])
+	}
+	cancelPull()
+
+	if len(v1Indexes) == 0 {
+		return keepSourceImage(ctx, run, NoV1IndexMessage)
+	}
+
+	buildCtx, cancelBuild := phaseContext(ctx, PhaseBuild)
+	defer cancelBuild()
+	indexDescriptor, err := convertFromV1Indexes(buildCtx, run.sociStore, run.pulledDesc, v1Indexes)
+	cancelBuild()
+	if err != nil {
+		return logAndReturnError(ctx, BuildFailedMessage, err)
+	}
+
+	return finishConversion(ctx, run, *indexDescriptor, MigrateSuccessMessage)
+}
+
+// List the image manifests of an image, which is just the image itself for single platform images
+func imageManifests(ctx context.Context, sociStore *store.SociStore, imageDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	if !images.IsIndexType(imageDesc.MediaType) {
+		return []ocispec.Descriptor{imageDesc}, nil
+	}
+
+	var index ocispec.Index
+	if err := fetchJSON(ctx, sociStore, imageDesc, &index); err != nil {
+		return nil, err
+	}
+
+	var manifests []ocispec.Descriptor
+	for _, desc := range index.Manifests {
+		switch {
+		case desc.ArtifactType == soci.SociIndexArtifactTypeV2:
+			return nil, fmt.Errorf("%w with SOCI index manifest v2", registryutils.ImageAlreadyIndexed)
+		case images.IsManifestType(desc.MediaType):
+			manifests = append(manifests, desc)
+		}
+	}
+	return manifests, nil
+}
+
+// Build a SOCI index manifest v2 converted image from the zTOCs of SOCI index manifests v1, keyed by the digest
+// of the image manifest they refer to. The result is the same as what soci.IndexBuilder.Convert builds.
+func convertFromV1Indexes(ctx context.Context, sociStore *store.SociStore, imageDesc ocispec.Descriptor, v1Indexes map[digest.Digest]ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	log.Info(ctx, "Converting SOCI index manifests v1")
+
+	var ociIndex ocispec.Index
+	if images.IsIndexType(imageDesc.MediaType) {
+		if err := fetchJSON(ctx, sociStore, imageDesc, &ociIndex); err != nil {
+			return nil, err
+		}
+		// Some registries don't like mixing Docker and OCI media types
+		ociIndex.MediaType = ocispec.MediaTypeImageIndex
+	} else {
+		platform, err := manifestPlatform(ctx, sociStore, imageDesc)
+		if err != nil {
+			return nil, err
+		}
+		imageDesc.Platform = platform
+		ociIndex = ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []ocispec.Descriptor{imageDesc},
+		}
+	}
+
+	var sociIndexes []ocispec.Descriptor
+	for i := range ociIndex.Manifests {
+		manifestDesc := &ociIndex.Manifests[i]
+		if !images.IsManifestType(manifestDesc.MediaType) {
+			continue
+		}
+
+		var manifest ocispec.Manifest
+		if err := fetchJSON(ctx, sociStore, *manifestDesc, &manifest); err != nil {
+			return nil, err
+		}
+		manifest.MediaType = ocispec.MediaTypeImageManifest
+		manifest.Config.MediaType = ocispec.MediaTypeImageConfig
+
+		var sociIndexDesc *ocispec.Descriptor
+		if v1IndexDesc, ok := v1Indexes[manifestDesc.Digest]; ok {
+			desc, err := convertV1Index(ctx, sociStore, v1IndexDesc)
+			if err != nil {
+				return nil, err
+			}
+			desc.Platform = manifestDesc.Platform
+			if manifest.Annotations == nil {
+				manifest.Annotations = map[string]string{}
+			}
+			manifest.Annotations[soci.ImageAnnotationSociIndexDigest] = desc.Digest.String()
+			sociIndexDesc = &desc
+		}
+
+		newManifestDesc, err := pushJSON(ctx, sociStore, ocispec.MediaTypeImageManifest, manifest)
+		if err != nil {
+			return nil, err
+		}
+		manifestDesc.MediaType = ocispec.MediaTypeImageManifest
+		manifestDesc.Digest = newManifestDesc.Digest
+		manifestDesc.Size = newManifestDesc.Size
+		manifestDesc.Annotations = manifest.Annotations
+
+		if sociIndexDesc != nil {
+			sociIndexDesc.Annotations = map[string]string{soci.IndexAnnotationImageManifestDigest: manifestDesc.Digest.String()}
+			sociIndexes = append(sociIndexes, *sociIndexDesc)
+		}
+	}
+	ociIndex.Manifests = append(ociIndex.Manifests, sociIndexes...)
+
+	indexDesc, err := pushJSON(ctx, sociStore, ocispec.MediaTypeImageIndex, ociIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &indexDesc, nil
+}
+
+// Write the zTOCs of a SOCI index manifest v1 into a SOCI index manifest v2 without a subject
+func convertV1Index(ctx context.Context, sociStore *store.SociStore, v1IndexDesc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	v1Content, err := orascontent.FetchAll(ctx, sociStore, v1IndexDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var v1Index soci.Index
+	if err := soci.UnmarshalIndex(v1Content, &v1Index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if v1Index.ArtifactType != soci.SociIndexArtifactTypeV1 {
+		return ocispec.Descriptor{}, fmt.Errorf("%s is not a SOCI index manifest v1: %s", v1IndexDesc.Digest, v1Index.ArtifactType)
+	}
+
+	index := soci.NewIndex(soci.V2, v1Index.Blobs, nil, v1Index.Annotations)
+	if err := pushContent(ctx, sociStore, index.Config, []byte("{}")); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	indexContent, err := soci.MarshalIndex(index)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV2,
+		Digest:       digest.FromBytes(indexContent),
+		Size:         int64(len(indexContent)),
+	}
+	return desc, pushContent(ctx, sociStore, desc, indexContent)
+}
+
+// Read the platform of a single platform image from its config
+func manifestPlatform(ctx context.Context, sociStore *store.SociStore, manifestDesc ocispec.Descriptor) (*ocispec.Platform, error) {
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, manifestDesc, &manifest); err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := fetchJSON(ctx, sociStore, manifest.Config, &config); err != nil {
+		return nil, err
+	}
+	return &config.Platform, nil
+}
+
+func fetchJSON(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, v any) error {
+	b, err := orascontent.FetchAll(ctx, sociStore, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func pushJSON(ctx context.Context, sociStore *store.SociStore, mediaType string, v any) (ocispec.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	return desc, pushContent(ctx, sociStore, desc, b)
+}
+
+// Push content to the local store, content that is already there is fine
+func pushContent(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, b []byte) error {
+	err := sociStore.Push(ctx, desc, bytes.NewReader(b))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
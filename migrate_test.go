@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+
+	registryutils "github.com/CloudSnorkel/standalone-soci-indexer/utils/registry"
+)
+
+// testImage is a multi-platform image with a SOCI index manifest v1 for the first platform only
+type testImage struct {
+	index     ocispec.Descriptor
+	manifests []ocispec.Descriptor
+	v1Index   ocispec.Descriptor
+	ztoc      ocispec.Descriptor
+}
+
+func newTestSociStore(t *testing.T) *store.SociStore {
+	t.Helper()
+	ociStore, err := oci.NewWithContext(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &store.SociStore{Store: ociStore}
+}
+
+func mustPushJSON(t *testing.T, sociStore *store.SociStore, mediaType string, v any) ocispec.Descriptor {
+	t.Helper()
+	desc, err := pushJSON(context.Background(), sociStore, mediaType, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func writeTestImage(t *testing.T, sociStore *store.SociStore) testImage {
+	t.Helper()
+	ctx := context.Background()
+	var image testImage
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		platform := ocispec.Platform{OS: "linux", Architecture: arch}
+		config := mustPushJSON(t, sociStore, registryutils.MediaTypeDockerImageConfig, ocispec.Image{Platform: platform})
+		manifest := mustPushJSON(t, sociStore, registryutils.MediaTypeDockerManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: registryutils.MediaTypeDockerManifest,
+			Config:    config,
+			Layers: []ocispec.Descriptor{{
+				MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				Digest:    digest.FromString("layer " + arch),
+				Size:      100 << 20,
+			}},
+		})
+		manifest.Platform = &platform
+		image.manifests = append(image.manifests, manifest)
+	}
+	image.index = mustPushJSON(t, sociStore, registryutils.MediaTypeDockerManifestList, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: registryutils.MediaTypeDockerManifestList,
+		Manifests: image.manifests,
+	})
+
+	ztocContent := []byte("ztoc")
+	image.ztoc = ocispec.Descriptor{
+		MediaType: soci.SociLayerMediaType,
+		Digest:    digest.FromBytes(ztocContent),
+		Size:      int64(len(ztocContent)),
+		Annotations: map[string]string{
+			soci.IndexAnnotationImageLayerDigest:    digest.FromString("layer amd64").String(),
+			soci.IndexAnnotationImageLayerMediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		},
+	}
+	if err := pushContent(ctx, sociStore, image.ztoc, ztocContent); err != nil {
+		t.Fatal(err)
+	}
+	subject := image.manifests[0]
+	subject.Platform = nil
+	v1Index := soci.NewIndex(soci.V1, []ocispec.Descriptor{image.ztoc}, &subject, map[string]string{
+		soci.IndexAnnotationBuildToolIdentifier: "AWS SOCI CLI v0.1",
+	})
+	if err := pushContent(ctx, sociStore, v1Index.Config, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	v1Content, err := soci.MarshalIndex(v1Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.v1Index = ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV1,
+		Digest:       digest.FromBytes(v1Content),
+		Size:         int64(len(v1Content)),
+	}
+	if err := pushContent(ctx, sociStore, image.v1Index, v1Content); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestConvertFromV1Indexes(t *testing.T) {
+	ctx := context.Background()
+	sociStore := newTestSociStore(t)
+	image := writeTestImage(t, sociStore)
+
+	indexDesc, err := convertFromV1Indexes(ctx, sociStore, image.index, map[digest.Digest]ocispec.Descriptor{
+		image.manifests[0].Digest: image.v1Index,
+	})
+	if err != nil {
+		t.Fatalf("convertFromV1Indexes returned error: %v", err)
+	}
+	if indexDesc.MediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("unexpected media type: %s", indexDesc.MediaType)
+	}
+
+	var converted ocispec.Index
+	if err := fetchJSON(ctx, sociStore, *indexDesc, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted.MediaType != ocispec.MediaTypeImageIndex || len(converted.Manifests) != 3 {
+		t.Fatalf("expected two images and a SOCI index, got %#v", converted)
+	}
+
+	indexed, notIndexed, sociIndexDesc := converted.Manifests[0], converted.Manifests[1], converted.Manifests[2]
+	if indexed.MediaType != ocispec.MediaTypeImageManifest || indexed.Annotations[soci.ImageAnnotationSociIndexDigest] != sociIndexDesc.Digest.String() {
+		t.Errorf("expected indexed image to be annotated with the SOCI index, got %#v", indexed)
+	}
+	if _, ok := notIndexed.Annotations[soci.ImageAnnotationSociIndexDigest]; ok || notIndexed.MediaType != ocispec.MediaTypeImageManifest {
+		t.Errorf("expected image without SOCI index manifest v1 to only change media type, got %#v", notIndexed)
+	}
+	if notIndexed.Platform == nil || notIndexed.Platform.Architecture != "arm64" {
+		t.Errorf("expected platform to be kept, got %#v", notIndexed.Platform)
+	}
+
+	if sociIndexDesc.ArtifactType != soci.SociIndexArtifactTypeV2 || sociIndexDesc.Platform == nil || sociIndexDesc.Platform.Architecture != "amd64" {
+		t.Errorf("unexpected SOCI index descriptor: %#v", sociIndexDesc)
+	}
+	if sociIndexDesc.Annotations[soci.IndexAnnotationImageManifestDigest] != indexed.Digest.String() {
+		t.Errorf("expected SOCI index descriptor to point at %s, got %#v", indexed.Digest, sociIndexDesc.Annotations)
+	}
+
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, indexed, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.MediaType != ocispec.MediaTypeImageConfig || len(manifest.Layers) != 1 {
+		t.Errorf("unexpected image manifest: %#v", manifest)
+	}
+
+	var sociIndex ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, sociIndexDesc, &sociIndex); err != nil {
+		t.Fatal(err)
+	}
+	if sociIndex.Config.MediaType != soci.SociIndexArtifactTypeV2 || sociIndex.Subject != nil {
+		t.Errorf("expected a SOCI index manifest v2 without subject, got %#v", sociIndex)
+	}
+	if len(sociIndex.Layers) != 1 || sociIndex.Layers[0].Digest != image.ztoc.Digest || sociIndex.Layers[0].Annotations[soci.IndexAnnotationImageLayerDigest] == "" {
+		t.Errorf("expected zTOC to be reused, got %#v", sociIndex.Layers)
+	}
+	if sociIndex.Annotations[soci.IndexAnnotationBuildToolIdentifier] != "AWS SOCI CLI v0.1" {
+		t.Errorf("expected annotations to be kept, got %#v", sociIndex.Annotations)
+	}
+}
+
+func TestConvertFromV1IndexesSinglePlatform(t *testing.T) {
+	ctx := context.Background()
+	sociStore := newTestSociStore(t)
+	image := writeTestImage(t, sociStore)
+	manifest := image.manifests[0]
+	manifest.Platform = nil
+
+	indexDesc, err := convertFromV1Indexes(ctx, sociStore, manifest, map[digest.Digest]ocispec.Descriptor{
+		manifest.Digest: image.v1Index,
+	})
+	if err != nil {
+		t.Fatalf("convertFromV1Indexes returned error: %v", err)
+	}
+
+	var converted ocispec.Index
+	if err := fetchJSON(ctx, sociStore, *indexDesc, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if len(converted.Manifests) != 2 {
+		t.Fatalf("expected the image and a SOCI index, got %#v", converted.Manifests)
+	}
+	for _, desc := range converted.Manifests {
+		if desc.Platform == nil || desc.Platform.OS != "linux" || desc.Platform.Architecture != "amd64" {
+			t.Errorf("expected platform from the image config, got %#v", desc.Platform)
+		}
+	}
+}
+
+func TestMigrateAndPush(t *testing.T) {
+	tests := []struct {
+		name            string
+		withV1Index     bool
+		expectedMessage string
+		expectedTags    []string
+	}{
+		{
+			name:            "pushes converted image with reused zTOCs",
+			withV1Index:     true,
+			expectedMessage: MigrateSuccessMessage,
+			expectedTags:    []string{"latest", "stable"},
+		},
+		{
+			name:            "only adds new tags without SOCI index manifest v1",
+			expectedMessage: NoV1IndexMessage,
+			expectedTags:    []string{"stable"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var image testImage
+			registry := &fakeRegistry{
+				referrers:       map[digest.Digest][]ocispec.Descriptor{},
+				referrerContent: map[string]func(*store.SociStore) ocispec.Descriptor{},
+			}
+			registry.pullContent = func(sociStore *store.SociStore) {
+				image = writeTestImage(t, sociStore)
+				registry.pullDescriptor = image.index
+				if test.withV1Index {
+					registry.referrers[image.manifests[0].Digest] = []ocispec.Descriptor{image.v1Index}
+					registry.referrerContent[image.v1Index.Digest.String()] = func(*store.SociStore) ocispec.Descriptor {
+						return image.v1Index
+					}
+				}
+			}
+			registry.headDescriptor = ocispec.Descriptor{MediaType: registryutils.MediaTypeDockerManifestList, Digest: digest.FromString("list")}
+			installTestHooks(t, registry, nil)
+			copyReferrers = true
+			t.Cleanup(func() { copyReferrers = false })
+
+			message, err := migrateAndPush(context.Background(), testSource, []string{"latest", "stable"}, "")
+			if err != nil {
+				t.Fatalf("migrateAndPush returned error: %v", err)
+			}
+			if message != test.expectedMessage {
+				t.Fatalf("unexpected message: %s", message)
+			}
+			if registry.probeCalls != 1 {
+				t.Fatalf("expected the OCI image index probe before pulling, got %d", registry.probeCalls)
+			}
+			if len(registry.manifestPullReferences) != 1 || registry.manifestPullReferences[0] != registry.headDescriptor.Digest.String() {
+				t.Fatalf("expected the image to be pulled without layers, got %#v", registry.manifestPullReferences)
+			}
+
+			if test.withV1Index {
+				if len(registry.referrerCopies) != 3 || registry.referrerCopies[0].tagged != 0 {
+					t.Fatalf("expected referrers to be copied before tagging, got %#v", registry.referrerCopies)
+				}
+				if len(registry.pullReferrerReferences) != 1 || registry.pullReferrerReferences[0] != image.v1Index.Digest.String() {
+					t.Fatalf("expected only the SOCI index manifest v1 to be pulled as a referrer, got %#v", registry.pullReferrerReferences)
+				}
+				if len(registry.pullReferences) != 0 {
+					t.Fatalf("expected no full pull, got %#v", registry.pullReferences)
+				}
+				if len(registry.pushes) != 1 || registry.pushes[0].MediaType != ocispec.MediaTypeImageIndex {
+					t.Fatalf("expected converted image to be pushed, got %#v", registry.pushes)
+				}
+				if registry.digestOutput.String() != registry.pushes[0].Digest.String()+"\n" {
+					t.Fatalf("expected the converted digest as output, got %q", registry.digestOutput.String())
+				}
+			} else if len(registry.pushes) != 0 {
+				t.Fatalf("expected no pushes, got %#v", registry.pushes)
+			}
+
+			if len(registry.tags) != len(test.expectedTags) {
+				t.Fatalf("unexpected tags: %#v", registry.tags)
+			}
+			for i, tag := range test.expectedTags {
+				if registry.tags[i].tag != tag {
+					t.Fatalf("unexpected tags: %#v", registry.tags)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyReferrersToConvertedImage(t *testing.T) {
+	ctx := context.Background()
+	sociStore := newTestSociStore(t)
+	image := writeTestImage(t, sociStore)
+	convertedDesc, err := convertFromV1Indexes(ctx, sociStore, image.index, map[digest.Digest]ocispec.Descriptor{
+		image.manifests[0].Digest: image.v1Index,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var converted ocispec.Index
+	if err := fetchJSON(ctx, sociStore, *convertedDesc, &converted); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := &fakeRegistry{}
+	if err := copyReferrersToConvertedImage(ctx, registry, "example/repo", sociStore, image.index, *convertedDesc); err != nil {
+		t.Fatalf("copyReferrersToConvertedImage returned error: %v", err)
+	}
+
+	expected := []referrerCopyCall{
+		{from: image.index, to: *convertedDesc},
+		{from: image.manifests[0], to: converted.Manifests[0]},
+		{from: image.manifests[1], to: converted.Manifests[1]},
+	}
+	if len(registry.referrerCopies) != len(expected) {
+		t.Fatalf("unexpected copies: %#v", registry.referrerCopies)
+	}
+	for i, call := range expected {
+		if registry.referrerCopies[i].from.Digest != call.from.Digest || registry.referrerCopies[i].to.Digest != call.to.Digest {
+			t.Errorf("expected referrers of %s to be copied to %s, got %#v", call.from.Digest, call.to.Digest, registry.referrerCopies[i])
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	ProvenanceFailedMessage = "Provenance attestation error"
+
+	InTotoMediaType             = "application/vnd.in-toto+json"
+	InTotoStatementType         = "https://in-toto.io/Statement/v1"
+	SlsaProvenancePredicateType = "https://slsa.dev/provenance/v1"
+
+	// ProvenanceBuildTypeIndex describes images converted by indexing their layers
+	ProvenanceBuildTypeIndex = "https://github.com/CloudSnorkel/standalone-soci-indexer/index@v1"
+	// ProvenanceBuildTypeMigrate describes images converted from the zTOCs of SOCI index manifests v1
+	ProvenanceBuildTypeMigrate = "https://github.com/CloudSnorkel/standalone-soci-indexer/migrate@v1"
+
+	provenanceBuilderId           = "https://github.com/CloudSnorkel/standalone-soci-indexer"
+	inTotoPredicateTypeAnnotation = "in-toto.io/predicate-type"
+	sociModulePath                = "github.com/awslabs/soci-snapshotter"
+)
+
+// An in-toto statement with a SLSA provenance v1 predicate, see https://slsa.dev/spec/v1.0/provenance
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type resourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]any       `json:"externalParameters"`
+		InternalParameters   map[string]any       `json:"internalParameters,omitempty"`
+		ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  time.Time `json:"startedOn"`
+			FinishedOn time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+		Byproducts []resourceDescriptor `json:"byproducts,omitempty"`
+	} `json:"runDetails"`
+}
+
+// provenanceRun describes one conversion of an image for its provenance statement
+type provenanceRun struct {
+	buildType string
+	// image is the reference the source image was given with
+	image     imageReference
+	newTags   []string
+	source    ocispec.Descriptor
+	converted ocispec.Descriptor
+	// dependencies other than the source image, like the SOCI index manifests v1 migrate reuses
+	dependencies []ocispec.Descriptor
+	startedOn    time.Time
+}
+
+// Push a provenance statement of the converted image as its referrer
+func pushProvenance(ctx context.Context, registry registryClient, sociStore *store.SociStore, run provenanceRun) error {
+	statement, err := newProvenanceStatement(ctx, sociStore, run)
+	if err != nil {
+		return err
+	}
+
+	layer, err := pushJSON(ctx, sociStore, InTotoMediaType, statement)
+	if err != nil {
+		return err
+	}
+	layer.Annotations = map[string]string{inTotoPredicateTypeAnnotation: SlsaProvenancePredicateType}
+	config := ocispec.DescriptorEmptyJSON
+	if err := pushContent(ctx, sociStore, config, config.Data); err != nil {
+		return err
+	}
+	config.Data = nil
+
+	subject := ocispec.Descriptor{MediaType: run.converted.MediaType, Digest: run.converted.Digest, Size: run.converted.Size}
+	desc, err := pushJSON(ctx, sociStore, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: InTotoMediaType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+		Annotations:  map[string]string{ocispec.AnnotationCreated: statement.Predicate.RunDetails.Metadata.FinishedOn.Format(time.RFC3339)},
+	})
+	if err != nil {
+		return err
+	}
+	desc.ArtifactType = InTotoMediaType
+
+	log.Info(ctx, fmt.Sprintf("Attaching provenance %s to %s", desc.Digest, run.converted.Digest))
+	return registry.PushReferrer(ctx, sociStore, desc, run.image.repo)
+}
+
+// Describe how the converted image derives from the source image, with the SOCI indexes and zTOCs it added
+func newProvenanceStatement(ctx context.Context, sociStore *store.SociStore, run provenanceRun) (provenanceStatement, error) {
+	name := run.image.registry + "/" + run.image.repo
+	statement := provenanceStatement{
+		Type:          InTotoStatementType,
+		Subject:       []resourceDescriptor{{Name: name, Digest: digestSet(run.converted.Digest)}},
+		PredicateType: SlsaProvenancePredicateType,
+	}
+
+	predicate := &statement.Predicate
+	predicate.BuildDefinition.BuildType = run.buildType
+	predicate.BuildDefinition.ExternalParameters = map[string]any{
+		"source":        run.image.String(),
+		"tags":          run.newTags,
+		"indexVersion":  sociIndexVersion,
+		"copyReferrers": copyReferrers,
+	}
+	if run.buildType == ProvenanceBuildTypeIndex {
+		predicate.BuildDefinition.InternalParameters = map[string]any{
+			"spanSize":            spanSize,
+			"minLayerSize":        minLayerSize,
+			"buildToolIdentifier": buildToolIdentifier,
+		}
+	}
+	predicate.BuildDefinition.ResolvedDependencies = []resourceDescriptor{{
+		URI:       name + "@" + run.source.Digest.String(),
+		Digest:    digestSet(run.source.Digest),
+		MediaType: run.source.MediaType,
+	}}
+	for _, dependency := range run.dependencies {
+		predicate.BuildDefinition.ResolvedDependencies = append(predicate.BuildDefinition.ResolvedDependencies, resourceDescriptor{
+			URI:       name + "@" + dependency.Digest.String(),
+			Digest:    digestSet(dependency.Digest),
+			MediaType: dependency.MediaType,
+		})
+	}
+
+	predicate.RunDetails.Builder.ID = provenanceBuilderId
+	predicate.RunDetails.Builder.Version = map[string]string{
+		"standalone-soci-indexer": versionString,
+		sociModulePath:            sociVersion(),
+	}
+	predicate.RunDetails.Metadata.StartedOn = run.startedOn.UTC().Truncate(time.Second)
+	predicate.RunDetails.Metadata.FinishedOn = time.Now().UTC().Truncate(time.Second)
+
+	byproducts, err := sociIndexByproducts(ctx, sociStore, run.converted)
+	if err != nil {
+		return statement, err
+	}
+	predicate.RunDetails.Byproducts = byproducts
+	return statement, nil
+}
+
+// List the SOCI indexes of a converted image and their zTOCs
+func sociIndexByproducts(ctx context.Context, sociStore *store.SociStore, convertedDesc ocispec.Descriptor) ([]resourceDescriptor, error) {
+	var converted ocispec.Index
+	if err := fetchJSON(ctx, sociStore, convertedDesc, &converted); err != nil {
+		return nil, err
+	}
+
+	var byproducts []resourceDescriptor
+	for _, desc := range converted.Manifests {
+		if desc.ArtifactType != soci.SociIndexArtifactTypeV2 {
+			continue
+		}
+		byproducts = append(byproducts, resourceDescriptor{
+			Name:        "soci-index",
+			Digest:      digestSet(desc.Digest),
+			MediaType:   desc.MediaType,
+			Annotations: desc.Annotations,
+		})
+
+		var index ocispec.Manifest
+		if err := fetchJSON(ctx, sociStore, desc, &index); err != nil {
+			return nil, err
+		}
+		for _, blob := range index.Layers {
+			if blob.MediaType != soci.SociLayerMediaType {
+				continue
+			}
+			byproducts = append(byproducts, resourceDescriptor{
+				Name:        "ztoc",
+				Digest:      digestSet(blob.Digest),
+				MediaType:   blob.MediaType,
+				Annotations: map[string]string{soci.IndexAnnotationImageLayerDigest: blob.Annotations[soci.IndexAnnotationImageLayerDigest]},
+			})
+		}
+	}
+	return byproducts, nil
+}
+
+func digestSet(dgst digest.Digest) map[string]string {
+	return map[string]string{dgst.Algorithm().String(): dgst.Encoded()}
+}
+
+// The version of the soci library this binary is built with
+func sociVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == sociModulePath {
+				if dep.Replace != nil {
+					return dep.Replace.Version
+				}
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
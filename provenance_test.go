@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Write testImage and convert it, returning the source image and the converted image
+func writeTestConvertedImage(t *testing.T, sociStore *store.SociStore) (testImage, ocispec.Descriptor) {
+	t.Helper()
+	image := writeTestImage(t, sociStore)
+	converted, err := convertFromV1Indexes(context.Background(), sociStore, image.index, map[digest.Digest]ocispec.Descriptor{
+		image.manifests[0].Digest: image.v1Index,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image, *converted
+}
+
+func TestNewProvenanceStatement(t *testing.T) {
+	ctx := context.Background()
+	sociStore := newTestSociStore(t)
+	image, converted := writeTestConvertedImage(t, sociStore)
+	startedOn := time.Now().Add(-time.Minute)
+
+	statement, err := newProvenanceStatement(ctx, sociStore, provenanceRun{
+		buildType:    ProvenanceBuildTypeMigrate,
+		image:        testSource,
+		newTags:      []string{"latest", "stable"},
+		source:       image.index,
+		converted:    converted,
+		dependencies: []ocispec.Descriptor{image.v1Index},
+		startedOn:    startedOn,
+	})
+	if err != nil {
+		t.Fatalf("newProvenanceStatement returned error: %v", err)
+	}
+
+	if statement.Type != InTotoStatementType || statement.PredicateType != SlsaProvenancePredicateType {
+		t.Fatalf("unexpected statement type %s with predicate %s", statement.Type, statement.PredicateType)
+	}
+	if len(statement.Subject) != 1 || statement.Subject[0].Name != "registry.example.com/example/repo" || statement.Subject[0].Digest["sha256"] != converted.Digest.Encoded() {
+		t.Fatalf("expected the converted image as subject, got %#v", statement.Subject)
+	}
+
+	buildDefinition := statement.Predicate.BuildDefinition
+	if buildDefinition.BuildType != ProvenanceBuildTypeMigrate || buildDefinition.ExternalParameters["source"] != "registry.example.com/example/repo:latest" {
+		t.Fatalf("unexpected build definition %#v", buildDefinition)
+	}
+	dependencies := buildDefinition.ResolvedDependencies
+	if len(dependencies) != 2 || dependencies[0].Digest["sha256"] != image.index.Digest.Encoded() || dependencies[1].Digest["sha256"] != image.v1Index.Digest.Encoded() {
+		t.Fatalf("expected the source image and the SOCI index manifest v1 as dependencies, got %#v", dependencies)
+	}
+	if dependencies[0].URI != "registry.example.com/example/repo@"+image.index.Digest.String() {
+		t.Errorf("unexpected source URI %s", dependencies[0].URI)
+	}
+
+	runDetails := statement.Predicate.RunDetails
+	if runDetails.Builder.Version["standalone-soci-indexer"] != versionString || runDetails.Builder.Version[sociModulePath] == "" {
+		t.Errorf("expected indexer and soci versions, got %#v", runDetails.Builder.Version)
+	}
+	if runDetails.Metadata.StartedOn.After(runDetails.Metadata.FinishedOn) {
+		t.Errorf("expected start before finish, got %#v", runDetails.Metadata)
+	}
+
+	var sociIndexes, ztocs []resourceDescriptor
+	for _, byproduct := range runDetails.Byproducts {
+		switch byproduct.Name {
+		case "soci-index":
+			sociIndexes = append(sociIndexes, byproduct)
+		case "ztoc":
+			ztocs = append(ztocs, byproduct)
+		}
+	}
+	if len(sociIndexes) != 1 {
+		t.Errorf("expected one SOCI index, got %#v", sociIndexes)
+	}
+	if len(ztocs) != 1 || ztocs[0].Digest["sha256"] != image.ztoc.Digest.Encoded() ||
+		ztocs[0].Annotations[soci.IndexAnnotationImageLayerDigest] != image.ztoc.Annotations[soci.IndexAnnotationImageLayerDigest] {
+		t.Errorf("expected the zTOC with its layer, got %#v", ztocs)
+	}
+}
+
+func TestIndexAndPushProvenance(t *testing.T) {
+	oldProvenance := provenance
+	t.Cleanup(func() {
+		provenance = oldProvenance
+	})
+	provenance = true
+
+	imageDigest := digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	registry := &fakeRegistry{
+		headDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: imageDigest},
+		pullDescriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: imageDigest},
+	}
+	var converted ocispec.Descriptor
+	message, err := runIndexAndPushTest(t, registry, func(_ context.Context, _ string, sociStore *store.SociStore, _ images.Image) (*ocispec.Descriptor, error) {
+		_, converted = writeTestConvertedImage(t, sociStore)
+		return &converted, nil
+	})
+	if err != nil {
+		t.Fatalf("indexAndPush returned error: %v", err)
+	}
+	if message != BuildAndPushSuccessMessage {
+		t.Fatalf("unexpected message: %s", message)
+	}
+	if len(registry.referrerPushes) != 1 || registry.referrerPushes[0].ArtifactType != InTotoMediaType {
+		t.Fatalf("expected a provenance referrer, got %#v", registry.referrerPushes)
+	}
+	if registry.referrerPushTagged[0] != 0 || len(registry.tags) != 2 {
+		t.Fatalf("expected the provenance to be pushed before tagging, got %#v", registry.tags)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// imageReference is a source image reference normalized like docker does, so ubuntu is
+// docker.io/library/ubuntu:latest
+type imageReference struct {
+	registry string
+	repo     string
+	// tag is the source tag, empty for references with only a digest
+	tag string
+	// digest pins the source image when given, the tag is then only replaced if it still points at it
+	digest digest.Digest
+}
+
+// Parse and normalize [REGISTRY/]REPO[:TAG][@DIGEST], defaulting to the latest tag without a tag or digest
+func parseImageReference(desc string) (imageReference, error) {
+	named, err := reference.ParseNormalizedNamed(desc)
+	if err != nil {
+		return imageReference{}, fmt.Errorf("invalid image reference %q: %w", desc, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	ref := imageReference{
+		registry: reference.Domain(named),
+		repo:     reference.Path(named),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.digest = digested.Digest()
+	}
+	return ref, nil
+}
+
+// What to resolve in the registry, the digest when it's pinned
+func (ref imageReference) reference() string {
+	if ref.digest != "" {
+		return ref.digest.String()
+	}
+	return ref.tag
+}
+
+// The name of the image within its registry, like repo:tag@digest
+func (ref imageReference) name() string {
+	name := ref.repo
+	if ref.tag != "" {
+		name += ":" + ref.tag
+	}
+	if ref.digest != "" {
+		name += "@" + ref.digest.String()
+	}
+	return name
+}
+
+// The full reference, like registry/repo:tag@digest
+func (ref imageReference) String() string {
+	return ref.registry + "/" + ref.name()
+}
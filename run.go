@@ -0,0 +1,137 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// Phases of indexing an image that --timeout can limit
+const (
+	// PhasePull verifies and pulls the source image
+	PhasePull = "pull"
+	// PhaseBuild builds the SOCI indexes
+	PhaseBuild = "build"
+	// PhasePush pushes the converted image or SOCI indexes with their referrers, provenance and signatures
+	PhasePush = "push"
+	// PhaseTag moves the new tags
+	PhaseTag = "tag"
+)
+
+var phases = []string{PhasePull, PhaseBuild, PhasePush, PhaseTag}
+
+var (
+	// ErrInterrupted is the cause of runs stopped by SIGINT or SIGTERM
+	ErrInterrupted = errors.New("interrupted")
+	// ErrStoppedBeforeTagging is returned at the safe point before tagging, wrapping why the run stopped
+	ErrStoppedBeforeTagging = errors.New("stopped before tagging")
+)
+
+const InterruptedMessage = "Run was interrupted or timed out before tagging, no tag was changed"
+
+var (
+	// runTimeout limits the whole run, zero for no limit, set from command line flags
+	runTimeout time.Duration
+	// phaseTimeouts limits each phase, set from command line flags
+	phaseTimeouts = map[string]time.Duration{}
+)
+
+// Parse [PHASE=]DURATION timeout flags, a duration without a phase limits the whole run
+func parseTimeouts(values []string) (time.Duration, map[string]time.Duration, error) {
+	var total time.Duration
+	timeouts := map[string]time.Duration{}
+	for _, value := range values {
+		phase, rest, found := strings.Cut(value, "=")
+		if !found {
+			phase, rest = "", value
+		} else if !slices.Contains(phases, phase) {
+			return 0, nil, fmt.Errorf("unknown phase %s in timeout %s, expected one of %s", phase, value, strings.Join(phases, ", "))
+		}
+		timeout, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid timeout %s: %w", value, err)
+		}
+		if timeout <= 0 {
+			return 0, nil, fmt.Errorf("timeout %s must be positive", value)
+		}
+		if phase == "" {
+			total = timeout
+		} else {
+			timeouts[phase] = timeout
+		}
+	}
+	return total, timeouts, nil
+}
+
+// Create the context of a run. It's canceled by the first SIGINT or SIGTERM, so the run stops at the next safe point
+// and cleans up, and a second signal exits right away. It's also canceled once runTimeout passes.
+func newRunContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			// default handling again, so the next signal exits without waiting for the cleanup
+			signal.Stop(signals)
+			log.Warn(ctx, fmt.Sprintf("Received %s, stopping at the next safe point and cleaning up. Send it again to exit right away", sig))
+			cancel(fmt.Errorf("%w by %s", ErrInterrupted, sig))
+		case <-ctx.Done():
+		}
+	}()
+
+	stop := func() {
+		signal.Stop(signals)
+		cancel(context.Canceled)
+	}
+	if runTimeout == 0 {
+		return ctx, stop
+	}
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, runTimeout)
+	return timeoutCtx, func() {
+		cancelTimeout()
+		stop()
+	}
+}
+
+// Limit one phase of the run by its timeout
+func phaseContext(ctx context.Context, phase string) (context.Context, context.CancelFunc) {
+	if timeout, ok := phaseTimeouts[phase]; ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// The safe point before tagging. Runs interrupted or timed out so far stop here without changing any tag. Past it,
+// interrupts and the run timeout are ignored so the tags are never left half updated, only the tag phase timeout
+// applies.
+func tagPhaseContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	if ctx.Err() != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrStoppedBeforeTagging, context.Cause(ctx))
+	}
+	tagCtx, cancel := phaseContext(context.WithoutCancel(ctx), PhaseTag)
+	return tagCtx, cancel, nil
+}
+
+// Pick the message for a tagging error
+func tagErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrTagMoved):
+		return TagMovedMessage
+	case errors.Is(err, ErrStoppedBeforeTagging):
+		return InterruptedMessage
+	default:
+		return PushFailedMessage
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		total    time.Duration
+		phases   map[string]time.Duration
+		errorMsg string
+	}{
+		{name: "none", phases: map[string]time.Duration{}},
+		{
+			name:   "whole run and phases",
+			values: []string{"1h", "pull=10m", "tag=30s"},
+			total:  time.Hour,
+			phases: map[string]time.Duration{PhasePull: 10 * time.Minute, PhaseTag: 30 * time.Second},
+		},
+		{
+			name:   "last one wins",
+			values: []string{"build=1m", "build=2m"},
+			phases: map[string]time.Duration{PhaseBuild: 2 * time.Minute},
+		},
+		{name: "unknown phase", values: []string{"index=1m"}, errorMsg: "unknown phase index"},
+		{name: "invalid duration", values: []string{"push=soon"}, errorMsg: "invalid timeout push=soon"},
+		{name: "zero", values: []string{"0s"}, errorMsg: "must be positive"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			total, phases, err := parseTimeouts(test.values)
+			if test.errorMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+					t.Fatalf("expected an error about %q, got %v", test.errorMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeouts returned error: %v", err)
+			}
+			if total != test.total {
+				t.Errorf("expected run timeout %s, got %s", test.total, total)
+			}
+			if fmt.Sprint(phases) != fmt.Sprint(test.phases) {
+				t.Errorf("expected phase timeouts %v, got %v", test.phases, phases)
+			}
+		})
+	}
+}
+
+func TestIndexAndPushStopsBeforeTagging(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+	}
+	convertedDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222"),
+	}
+	interrupted := fmt.Errorf("%w by %s", ErrInterrupted, syscall.SIGTERM)
+
+	registry := &fakeRegistry{headDescriptor: imageDesc, pullDescriptor: imageDesc}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	installTestHooks(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+		// the signal arrives while building, which isn't interruptible itself
+		cancel(interrupted)
+		return &convertedDesc, nil
+	})
+
+	message, err := indexAndPush(ctx, testSource, []string{"latest", "stable"}, "")
+	if message != InterruptedMessage {
+		t.Fatalf("unexpected message: %s (%v)", message, err)
+	}
+	if !errors.Is(err, ErrStoppedBeforeTagging) || !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected the run to stop before tagging because of the signal, got %v", err)
+	}
+	if exitCode(err) != interruptedExitCode {
+		t.Fatalf("expected exit code %d, got %d", interruptedExitCode, exitCode(err))
+	}
+	if len(registry.tags) != 0 {
+		t.Fatalf("expected no tag to change, got %#v", registry.tags)
+	}
+}
+
+func TestIndexAndPushPhaseTimeout(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111"),
+	}
+
+	oldPhaseTimeouts := phaseTimeouts
+	t.Cleanup(func() {
+		phaseTimeouts = oldPhaseTimeouts
+	})
+	phaseTimeouts = map[string]time.Duration{PhaseBuild: 10 * time.Millisecond}
+
+	registry := &fakeRegistry{headDescriptor: imageDesc, pullDescriptor: imageDesc}
+	installTestHooks(t, registry, func(ctx context.Context, _ string, _ *store.SociStore, _ images.Image) (*ocispec.Descriptor, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	_, err := indexAndPush(context.Background(), testSource, []string{"latest"}, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the build phase to time out, got %v", err)
+	}
+	if exitCode(err) != timeoutExitCode {
+		t.Fatalf("expected exit code %d, got %d", timeoutExitCode, exitCode(err))
+	}
+	if len(registry.pushes) != 0 || len(registry.tags) != 0 {
+		t.Fatalf("expected nothing to be pushed or tagged, got %#v and %#v", registry.pushes, registry.tags)
+	}
+}
+
+func TestTagPhaseContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	tagCtx, cancelTag, err := tagPhaseContext(ctx)
+	if err != nil {
+		t.Fatalf("tagPhaseContext returned error: %v", err)
+	}
+	defer cancelTag()
+
+	// once tagging started, the run context being canceled doesn't stop it halfway
+	cancel()
+	if tagCtx.Err() != nil {
+		t.Fatalf("expected tagging to go on, got %v", tagCtx.Err())
+	}
+
+	if _, _, err := tagPhaseContext(ctx); !errors.Is(err, ErrStoppedBeforeTagging) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled run to stop before tagging, got %v", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{err: errors.New("push failed"), expected: 1},
+		{err: fmt.Errorf("tag latest: %w", ErrTagMoved), expected: tagMovedExitCode},
+		{err: fmt.Errorf("%w: %w", ErrStoppedBeforeTagging, fmt.Errorf("%w by interrupt", ErrInterrupted)), expected: interruptedExitCode},
+		{err: fmt.Errorf("%w: %w", ErrStoppedBeforeTagging, context.DeadlineExceeded), expected: timeoutExitCode},
+	}
+
+	for _, test := range tests {
+		if code := exitCode(test.err); code != test.expected {
+			t.Errorf("expected exit code %d for %v, got %d", test.expected, test.err, code)
+		}
+	}
+}
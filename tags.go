@@ -0,0 +1,150 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// What happened to each tag of a multi-tag update
+const (
+	TagUpdated        = "updated"
+	TagFailed         = "failed"
+	TagNotUpdated     = "not updated"
+	TagRolledBack     = "rolled back"
+	TagRollbackFailed = "rollback failed"
+)
+
+// tagUpdate reports what happened to one tag
+type tagUpdate struct {
+	tag string
+	// previous is the descriptor the tag pointed at before the update, nil when the tag didn't exist
+	previous *ocispec.Descriptor
+	status   string
+	err      error
+}
+
+// Move every tag to desc, or none of them. The previous target of every tag is recorded before moving any, so the
+// tags already moved can be restored when one fails. Tags are resolved with the upstream registry only, mirrors may
+// hold stale tags. Tags in expected, moved or not, must still point at the given
+// digest, or nothing is moved and ErrTagMoved is returned.
+func updateTags(ctx context.Context, registry registryClient, repo string, tags []string, desc ocispec.Descriptor, expected map[string]digest.Digest) ([]tagUpdate, error) {
+	updates := make([]tagUpdate, len(tags))
+	for i, tag := range tags {
+		updates[i] = tagUpdate{tag: tag, status: TagNotUpdated}
+	}
+
+	for i, tag := range tags {
+		previous, err := registry.ResolveUpstream(ctx, repo, tag)
+		if errors.Is(err, errdef.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return updates, fmt.Errorf("failed to resolve %s before tagging: %w", tag, err)
+		}
+		updates[i].previous = &previous
+	}
+	for tag, dgst := range expected {
+		var current *ocispec.Descriptor
+		if i := slices.Index(tags, tag); i >= 0 {
+			current = updates[i].previous
+		} else {
+			resolved, err := registry.ResolveUpstream(ctx, repo, tag)
+			if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+				return updates, fmt.Errorf("failed to resolve %s before tagging: %w", tag, err)
+			} else if err == nil {
+				current = &resolved
+			}
+		}
+		if current == nil {
+			return updates, fmt.Errorf("%w: %s was deleted, it pointed at %s", ErrTagMoved, tag, dgst)
+		}
+		if current.Digest != dgst {
+			return updates, fmt.Errorf("%w: %s points at %s instead of %s", ErrTagMoved, tag, current.Digest, dgst)
+		}
+	}
+
+	for i, tag := range tags {
+		err := registry.Tag(ctx, desc, repo, tag)
+		if err == nil {
+			updates[i].status = TagUpdated
+			continue
+		}
+
+		updates[i].status = TagFailed
+		updates[i].err = err
+		rollbackTags(ctx, registry, repo, desc, updates[:i])
+		logTagUpdates(ctx, updates)
+		return updates, fmt.Errorf("failed to tag %s, restored the previous tags: %w", tag, err)
+	}
+
+	logTagUpdates(ctx, updates)
+	return updates, nil
+}
+
+// Point updated tags back to their previous target. Tags that didn't exist before are deleted, registries that
+// refuse deleting tags leave them pointing at the new target. Tags that no longer point at desc were pushed to since
+// they were updated and are left alone. The rollback isn't canceled with the tagging that failed, like when the tag
+// phase timed out.
+func rollbackTags(ctx context.Context, registry registryClient, repo string, desc ocispec.Descriptor, updates []tagUpdate) {
+	ctx = context.WithoutCancel(ctx)
+	for i := range updates {
+		update := &updates[i]
+		if update.status != TagUpdated {
+			continue
+		}
+		current, err := registry.ResolveUpstream(ctx, repo, update.tag)
+		if errors.Is(err, errdef.ErrNotFound) {
+			update.status = TagRollbackFailed
+			update.err = fmt.Errorf("%w: %s was deleted after it was updated, left alone", ErrTagMoved, update.tag)
+			continue
+		} else if err != nil {
+			update.status = TagRollbackFailed
+			update.err = fmt.Errorf("failed to resolve %s before rolling back: %w", update.tag, err)
+			continue
+		}
+		if current.Digest != desc.Digest {
+			update.status = TagRollbackFailed
+			update.err = fmt.Errorf("%w: %s points at %s instead of %s, left alone", ErrTagMoved, update.tag, current.Digest, desc.Digest)
+			continue
+		}
+		if update.previous == nil {
+			if err := registry.DeleteTag(ctx, repo, update.tag); err != nil {
+				update.status = TagRollbackFailed
+				update.err = fmt.Errorf("the tag didn't exist before and the registry refused to delete it: %w", err)
+				continue
+			}
+			update.status = TagRolledBack
+			continue
+		}
+		if err := registry.Tag(ctx, *update.previous, repo, update.tag); err != nil {
+			update.status = TagRollbackFailed
+			update.err = err
+			continue
+		}
+		update.status = TagRolledBack
+	}
+}
+
+func logTagUpdates(ctx context.Context, updates []tagUpdate) {
+	for _, update := range updates {
+		previous := "nothing"
+		if update.previous != nil {
+			previous = update.previous.Digest.String()
+		}
+		message := fmt.Sprintf("Tag %s %s, previously pointing at %s", update.tag, update.status, previous)
+		if update.err != nil {
+			log.Warn(ctx, fmt.Sprintf("%s: %v", message, update.err))
+		} else {
+			log.Info(ctx, message)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUpdateTags(t *testing.T) {
+	oldDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("old")}
+	otherDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("other")}
+	newDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("new")}
+	movedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("moved")}
+	errTag := errors.New("tag failed")
+	errDelete := errors.New("tag deletion is not supported")
+
+	tests := []struct {
+		name         string
+		tags         []string
+		expected     map[string]digest.Digest
+		tagErr       func(desc ocispec.Descriptor, tag string) error
+		deleteTagErr error
+		// movedTags are pushed by someone else when tagging fails, before the rollback
+		movedTags        map[string]ocispec.Descriptor
+		expectedErr      error
+		expectedStatuses []string
+		expectedState    map[string]digest.Digest
+	}{
+		{
+			name:             "moves all tags",
+			expected:         map[string]digest.Digest{"latest": oldDesc.Digest},
+			expectedStatuses: []string{TagUpdated, TagUpdated, TagUpdated},
+			expectedState:    map[string]digest.Digest{"latest": newDesc.Digest, "stable": newDesc.Digest, "v1": newDesc.Digest},
+		},
+		{
+			name:             "moves nothing when an expected tag moved",
+			expected:         map[string]digest.Digest{"latest": otherDesc.Digest},
+			expectedErr:      ErrTagMoved,
+			expectedStatuses: []string{TagNotUpdated, TagNotUpdated, TagNotUpdated},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest},
+		},
+		{
+			name: "restores moved tags when one fails",
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "v1" {
+					return errTag
+				}
+				return nil
+			},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRolledBack, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest},
+		},
+		{
+			name: "stops at the first failure",
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "stable" {
+					return errTag
+				}
+				return nil
+			},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagFailed, TagNotUpdated},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest},
+		},
+		{
+			name: "reports tags that couldn't be restored",
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "v1" || (tag == "stable" && desc.Digest == otherDesc.Digest) {
+					return errTag
+				}
+				return nil
+			},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRollbackFailed, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": newDesc.Digest},
+		},
+		{
+			name: "deletes new tags when one fails",
+			tags: []string{"latest", "v1", "stable"},
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "stable" {
+					return errTag
+				}
+				return nil
+			},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRolledBack, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest},
+		},
+		{
+			name: "reports new tags the registry refused to delete",
+			tags: []string{"latest", "v1", "stable"},
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "stable" {
+					return errTag
+				}
+				return nil
+			},
+			deleteTagErr:     errDelete,
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRollbackFailed, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest, "v1": newDesc.Digest},
+		},
+		{
+			name: "leaves tags pushed to since they were updated",
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "v1" {
+					return errTag
+				}
+				return nil
+			},
+			movedTags:        map[string]ocispec.Descriptor{"stable": movedDesc},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRollbackFailed, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": movedDesc.Digest},
+		},
+		{
+			name: "doesn't delete new tags pushed to since they were updated",
+			tags: []string{"latest", "v1", "stable"},
+			tagErr: func(desc ocispec.Descriptor, tag string) error {
+				if tag == "stable" {
+					return errTag
+				}
+				return nil
+			},
+			movedTags:        map[string]ocispec.Descriptor{"v1": movedDesc},
+			expectedErr:      errTag,
+			expectedStatuses: []string{TagRolledBack, TagRollbackFailed, TagFailed},
+			expectedState:    map[string]digest.Digest{"latest": oldDesc.Digest, "stable": otherDesc.Digest, "v1": movedDesc.Digest},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &fakeRegistry{
+				tagDescriptors: map[string]ocispec.Descriptor{"latest": oldDesc, "stable": otherDesc},
+				deleteTagErr:   test.deleteTagErr,
+			}
+			if test.tagErr != nil {
+				registry.tagErr = func(desc ocispec.Descriptor, tag string) error {
+					err := test.tagErr(desc, tag)
+					if err != nil {
+						for movedTag, movedDesc := range test.movedTags {
+							registry.tagDescriptors[movedTag] = movedDesc
+						}
+					}
+					return err
+				}
+			}
+			tags := test.tags
+			if tags == nil {
+				tags = []string{"latest", "stable", "v1"}
+			}
+
+			updates, err := updateTags(context.Background(), registry, "example/repo", tags, newDesc, test.expected)
+			if test.expectedErr == nil && err != nil {
+				t.Fatalf("updateTags returned error: %v", err)
+			}
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+
+			// every tag is resolved before tagging, and every updated tag again before rolling it back
+			expectedResolves := 3
+			for _, update := range updates {
+				if update.status == TagRolledBack || update.status == TagRollbackFailed {
+					expectedResolves++
+				}
+			}
+			if len(registry.upstreamResolves) != expectedResolves || registry.headCalls != len(registry.upstreamResolves) {
+				t.Fatalf("expected every tag to be resolved without mirrors, got %#v", registry.upstreamResolves)
+			}
+			if len(updates) != len(test.expectedStatuses) {
+				t.Fatalf("expected a report for every tag, got %#v", updates)
+			}
+			for i, update := range updates {
+				if update.status != test.expectedStatuses[i] {
+					t.Errorf("expected %s to be %s, got %s", update.tag, test.expectedStatuses[i], update.status)
+				}
+			}
+			for _, update := range updates {
+				if (update.previous == nil) != (update.tag == "v1") {
+					t.Errorf("expected the previous targets to be recorded, got %#v", updates)
+				}
+				if update.tag == "v1" && update.status == TagRollbackFailed && test.deleteTagErr != nil && !errors.Is(update.err, errDelete) {
+					t.Errorf("expected the refused delete to be reported, got %v", update.err)
+				}
+				if _, moved := test.movedTags[update.tag]; moved && !errors.Is(update.err, ErrTagMoved) {
+					t.Errorf("expected %s to be reported as moved, got %v", update.tag, update.err)
+				}
+			}
+
+			if len(registry.tagDescriptors) != len(test.expectedState) {
+				t.Fatalf("expected tags %v, got %#v", test.expectedState, registry.tagDescriptors)
+			}
+			for tag, dgst := range test.expectedState {
+				if registry.tagDescriptors[tag].Digest != dgst {
+					t.Errorf("expected %s to point at %s, got %s", tag, dgst, registry.tagDescriptors[tag].Digest)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexAndPushBackupTag(t *testing.T) {
+	imageDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("image")}
+	movedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("moved")}
+	convertedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("converted")}
+
+	tests := []struct {
+		name            string
+		template        string
+		moved           bool
+		expectedMessage string
+		expectedState   map[string]digest.Digest
+	}{
+		{
+			name:            "backs up the original image before replacing the tag",
+			template:        "{{.Tag}}-orig",
+			expectedMessage: BuildAndPushSuccessMessage,
+			expectedState:   map[string]digest.Digest{"latest-orig": imageDesc.Digest, "latest": convertedDesc.Digest, "stable": convertedDesc.Digest},
+		},
+		{
+			name:            "renders the backup tag like the new tags",
+			template:        "{{.Repo}}-{{.ShortDigest}}-orig",
+			expectedMessage: BuildAndPushSuccessMessage,
+			expectedState: map[string]digest.Digest{
+				"example-repo-" + imageDesc.Digest.Encoded()[:shortDigestLength] + "-orig": imageDesc.Digest,
+				"latest": convertedDesc.Digest,
+				"stable": convertedDesc.Digest,
+			},
+		},
+		{
+			name:            "refuses a backup tag that is replaced too",
+			template:        "{{.Tag}}",
+			expectedMessage: PushFailedMessage,
+			expectedState:   map[string]digest.Digest{"latest": imageDesc.Digest},
+		},
+		{
+			name:            "refuses an invalid backup tag",
+			template:        "{{.Tag}}/orig",
+			expectedMessage: PushFailedMessage,
+			expectedState:   map[string]digest.Digest{"latest": imageDesc.Digest},
+		},
+		{
+			name:            "doesn't back up a tag that moved",
+			template:        "{{.Tag}}-orig",
+			moved:           true,
+			expectedMessage: TagMovedMessage,
+			expectedState:   map[string]digest.Digest{"latest": movedDesc.Digest},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldBackupTagTemplate := backupTagTemplate
+			t.Cleanup(func() {
+				backupTagTemplate = oldBackupTagTemplate
+			})
+			backupTagTemplate = test.template
+
+			registry := &fakeRegistry{
+				pullDescriptor: imageDesc,
+				tagDescriptors: map[string]ocispec.Descriptor{"latest": imageDesc},
+			}
+			message, err := runIndexAndPushTest(t, registry, func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+				if test.moved {
+					registry.tagDescriptors["latest"] = movedDesc
+				}
+				return &convertedDesc, nil
+			})
+			if message != test.expectedMessage {
+				t.Fatalf("unexpected message: %s (%v)", message, err)
+			}
+
+			if len(registry.tagDescriptors) != len(test.expectedState) {
+				t.Fatalf("expected tags %v, got %#v", test.expectedState, registry.tagDescriptors)
+			}
+			for tag, dgst := range test.expectedState {
+				if registry.tagDescriptors[tag].Digest != dgst {
+					t.Errorf("expected %s to point at %s, got %s", tag, dgst, registry.tagDescriptors[tag].Digest)
+				}
+			}
+			if len(test.expectedState) > 1 && registry.tags[0].desc.Digest != imageDesc.Digest {
+				t.Errorf("expected the backup before the other tags, got %#v", registry.tags)
+			}
+		})
+	}
+}
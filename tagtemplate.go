@@ -0,0 +1,143 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tagPattern is the tag grammar of the OCI distribution specification
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// shortDigestLength is how many hex characters of the source digest {{.ShortDigest}} keeps, like docker images
+const shortDigestLength = 12
+
+// tagTemplateData is what tag templates like {{.Tag}}-orig can refer to
+type tagTemplateData struct {
+	// Tag is the source tag, empty when the source is a digest
+	Tag string
+	// Repo is the source repository with / replaced by -, which tags can't contain
+	Repo string
+	// ShortDigest is the start of the hex part of the source digest
+	ShortDigest string
+	// platforms lists the platforms of the source image, only read when a template uses {{.Platform}}
+	platforms func() ([]ocispec.Platform, error)
+}
+
+// Platform is the platform of the source image as os-arch[-variant]. Multi-platform images join every platform
+// with _ in the order of their index.
+func (data tagTemplateData) Platform() (string, error) {
+	if data.platforms == nil {
+		return "", fmt.Errorf("platform of the source image is unknown")
+	}
+	platforms, err := data.platforms()
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, platform := range platforms {
+		name := strings.Join(slices.DeleteFunc([]string{platform.OS, platform.Architecture, platform.Variant}, func(s string) bool { return s == "" }), "-")
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("source image has no platform")
+	}
+	return strings.Join(names, "_"), nil
+}
+
+// Describe a pulled source image for tag templates
+func newTagTemplateData(ctx context.Context, sociStore *store.SociStore, repo string, tag string, imageDesc ocispec.Descriptor) tagTemplateData {
+	return tagTemplateData{
+		Tag:         tag,
+		Repo:        strings.ReplaceAll(repo, "/", "-"),
+		ShortDigest: imageDesc.Digest.Encoded()[:shortDigestLength],
+		platforms: func() ([]ocispec.Platform, error) {
+			return imagePlatforms(ctx, sociStore, imageDesc)
+		},
+	}
+}
+
+// List the platforms of the image manifests of a pulled image, skipping attestation manifests without a platform
+func imagePlatforms(ctx context.Context, sociStore *store.SociStore, imageDesc ocispec.Descriptor) ([]ocispec.Platform, error) {
+	if !images.IsIndexType(imageDesc.MediaType) {
+		platform, err := manifestPlatform(ctx, sociStore, imageDesc)
+		if err != nil {
+			return nil, err
+		}
+		return []ocispec.Platform{*platform}, nil
+	}
+
+	var index ocispec.Index
+	if err := fetchJSON(ctx, sociStore, imageDesc, &index); err != nil {
+		return nil, err
+	}
+	var platforms []ocispec.Platform
+	for _, desc := range index.Manifests {
+		if !images.IsManifestType(desc.MediaType) || desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		platforms = append(platforms, *desc.Platform)
+	}
+	return platforms, nil
+}
+
+func parseTagTemplate(text string) (*template.Template, error) {
+	return template.New("tag").Option("missingkey=error").Parse(text)
+}
+
+// Check tag templates parse, so typos fail before anything is pulled
+func parseTagTemplates(texts []string) error {
+	for _, text := range texts {
+		if _, err := parseTagTemplate(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Render a tag template and make sure the result is a valid tag
+func renderTagTemplate(text string, data tagTemplateData) (string, error) {
+	tmpl, err := parseTagTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var tag strings.Builder
+	if err := tmpl.Execute(&tag, data); err != nil {
+		return "", err
+	}
+	if !tagPattern.MatchString(tag.String()) {
+		return "", fmt.Errorf("template %q rendered invalid tag %q", text, tag.String())
+	}
+	return tag.String(), nil
+}
+
+// Render every --new-tag template for one image, dropping tags rendered twice. The source tag, which is the default
+// new tag, is kept as is.
+func renderNewTags(texts []string, source string, data tagTemplateData) ([]string, error) {
+	var tags []string
+	for _, text := range texts {
+		tag := text
+		if text != source {
+			var err error
+			if tag, err = renderTagTemplate(text, data); err != nil {
+				return nil, err
+			}
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRenderTagTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+		fails    bool
+	}{
+		{template: "{{.Tag}}-orig", expected: "latest-orig"},
+		{template: "backup", expected: "backup"},
+		{template: "{{.Tag}}/orig", fails: true},
+		{template: "-{{.Tag}}", fails: true},
+		{template: "{{.Unknown}}", fails: true},
+		{template: "{{.Tag", fails: true},
+		{template: "", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			tag, err := renderTagTemplate(test.template, tagTemplateData{Tag: "latest"})
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", tag)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTagTemplate returned error: %v", err)
+			}
+			if tag != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, tag)
+			}
+		})
+	}
+}
+
+func TestRenderNewTags(t *testing.T) {
+	ctx := context.Background()
+	sociStore := newTestSociStore(t)
+	image := writeTestImage(t, sociStore)
+
+	tests := []struct {
+		name      string
+		templates []string
+		tag       string
+		imageDesc ocispec.Descriptor
+		expected  []string
+		fails     bool
+	}{
+		{
+			name:      "source values",
+			templates: []string{"{{.Tag}}-soci", "{{.Repo}}-{{.ShortDigest}}", "{{.Platform}}"},
+			tag:       "latest",
+			imageDesc: image.index,
+			expected:  []string{"latest-soci", "example-repo-" + image.index.Digest.Encoded()[:12], "linux-amd64_linux-arm64"},
+		},
+		{
+			name:      "single platform",
+			templates: []string{"{{.Tag}}-{{.Platform}}"},
+			tag:       "latest",
+			imageDesc: image.manifests[0],
+			expected:  []string{"latest-linux-amd64"},
+		},
+		{
+			name:      "keeps the source tag and drops duplicates",
+			templates: []string{"latest", "{{.Tag}}", "stable"},
+			tag:       "latest",
+			imageDesc: image.index,
+			expected:  []string{"latest", "stable"},
+		},
+		{
+			name:      "digests have no tag",
+			templates: []string{"{{.Tag}}-soci"},
+			tag:       "",
+			imageDesc: image.index,
+			fails:     true,
+		},
+		{
+			name:      "invalid tag",
+			templates: []string{"stable", "{{.Tag}}:soci"},
+			tag:       "latest",
+			imageDesc: image.index,
+			fails:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags, err := renderNewTags(test.templates, test.tag, newTagTemplateData(ctx, sociStore, "example/repo", test.tag, test.imageDesc))
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderNewTags returned error: %v", err)
+			}
+			if !slices.Equal(tags, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, tags)
+			}
+		})
+	}
+}
+
+func TestIndexAndPushNewTagTemplates(t *testing.T) {
+	imageDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")}
+	convertedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("converted")}
+	var registry *fakeRegistry
+	build := func(context.Context, string, *store.SociStore, images.Image) (*ocispec.Descriptor, error) {
+		registry.buildCalls++
+		return &convertedDesc, nil
+	}
+
+	registry = &fakeRegistry{headDescriptor: imageDesc, pullDescriptor: imageDesc}
+	installTestHooks(t, registry, build)
+	message, err := indexAndPush(context.Background(), testSource, []string{"{{.Tag}}-soci", "{{.ShortDigest}}"}, "")
+	if message != BuildAndPushSuccessMessage {
+		t.Fatalf("unexpected message: %s (%v)", message, err)
+	}
+	if len(registry.tags) != 2 || registry.tags[0].tag != "latest-soci" || registry.tags[1].tag != "111111111111" {
+		t.Fatalf("expected rendered tags, got %#v", registry.tags)
+	}
+
+	registry = &fakeRegistry{headDescriptor: imageDesc, pullDescriptor: imageDesc}
+	installTestHooks(t, registry, build)
+	message, _ = indexAndPush(context.Background(), testSource, []string{"stable", "{{.Tag}}/soci"}, "")
+	if message != InvalidTagMessage {
+		t.Fatalf("unexpected message: %s", message)
+	}
+	if registry.buildCalls != 0 || len(registry.pushes) != 0 || len(registry.tags) != 0 {
+		t.Fatalf("expected nothing built, pushed or tagged, got %d %#v %#v", registry.buildCalls, registry.pushes, registry.tags)
+	}
+}
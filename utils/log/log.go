@@ -6,27 +6,64 @@ package log
 
 import (
 	"context"
+	"strings"
+	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const redacted = "[REDACTED]"
+
+var (
+	secretsLock sync.RWMutex
+	secrets     []string
+)
+
+// RegisterSecret makes sure a credential value is never written to the log, even as part of an error
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, existing := range secrets {
+		if existing == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// Redact replaces every registered secret in s
+func Redact(s string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
 func Error(ctx context.Context, msg string, err error) {
-	logEvent := log.Error().Err(err)
+	logEvent := log.Error()
+	if err != nil {
+		logEvent.Str(zerolog.ErrorFieldName, Redact(err.Error()))
+	}
 	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+	logEvent.Msg(Redact(msg))
 }
 
 func Warn(ctx context.Context, msg string) {
 	logEvent := log.Warn()
 	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+	logEvent.Msg(Redact(msg))
 }
 
 func Info(ctx context.Context, msg string) {
 	logEvent := log.Info()
 	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+	logEvent.Msg(Redact(msg))
 }
 
 // Add more context to the log event
@@ -40,7 +77,7 @@ func addContext(ctx context.Context, logEvent *zerolog.Event) {
 
 	for _, contextKey := range contextKeys {
 		if value := ctx.Value(contextKey); value != nil {
-			logEvent.Str(contextKey, value.(string))
+			logEvent.Str(contextKey, Redact(value.(string)))
 		}
 	}
 }
@@ -0,0 +1,41 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestSecretsAreRedacted(t *testing.T) {
+	var output bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&output)
+	defer func() { log.Logger = logger }()
+
+	RegisterSecret("hunter2")
+	RegisterSecret("")
+
+	ctx := context.WithValue(context.Background(), "RegistryURL", "user:hunter2@registry.example.com")
+	Info(ctx, "logging in with hunter2")
+	Warn(ctx, "password hunter2 rejected")
+	Error(ctx, "failed", errors.New("401 for user:hunter2"))
+	Error(ctx, "failed without error", nil)
+
+	if strings.Contains(output.String(), "hunter2") {
+		t.Fatalf("secret leaked into the log: %s", output.String())
+	}
+	if count := strings.Count(output.String(), redacted); count != 7 {
+		t.Fatalf("expected 7 redactions, got %d: %s", count, output.String())
+	}
+	if strings.Contains(output.String(), `"error":null`) {
+		t.Fatalf("nil error should not be logged: %s", output.String())
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// emptyJSON is the content of the empty config blob SOCI indexes use
+var emptyJSON = []byte("{}")
+
+// ociManifestMediaTypes are the manifest media types SOCI indexes are pushed with
+var ociManifestMediaTypes = []string{ocispec.MediaTypeImageIndex, ocispec.MediaTypeImageManifest}
+
+// unsupportedArtifactError turns a distribution error response that means the registry can't store
+// OCI image indexes or artifacts into RegistryNotSupportingOciArtifacts. Other errors are returned as is.
+// mediaTypes holds the media type of every manifest being pushed by digest. MANIFEST_INVALID and UNSUPPORTED only
+// count for OCI manifests, a rejected Docker manifest is more likely broken.
+func unsupportedArtifactError(err error, mediaTypes map[digest.Digest]string) error {
+	var errResp *errcode.ErrorResponse
+	if !errors.As(err, &errResp) {
+		return err
+	}
+
+	// only manifest uploads are rejected for their media type, blobs are opaque to the registry
+	if errResp.Method != http.MethodPut || errResp.URL == nil {
+		return err
+	}
+	_, reference, found := strings.Cut(errResp.URL.Path, "/manifests/")
+	if !found {
+		return err
+	}
+
+	if errResp.StatusCode == http.StatusUnsupportedMediaType {
+		return fmt.Errorf("%w: %s", RegistryNotSupportingOciArtifacts, http.StatusText(errResp.StatusCode))
+	}
+	if !slices.Contains(ociManifestMediaTypes, mediaTypes[digest.Digest(reference)]) {
+		return err
+	}
+	for _, e := range errResp.Errors {
+		switch e.Code {
+		// ECR used to answer with 405 UNSUPPORTED and distribution v2 with 400 MANIFEST_INVALID
+		case errcode.ErrorCodeUnsupported, errcode.ErrorCodeManifestInvalid:
+			return fmt.Errorf("%w: %s", RegistryNotSupportingOciArtifacts, e.Error())
+		}
+	}
+	return err
+}
+
+// Map the manifests of a graph to their media types by digest, to tell which manifest a registry rejected
+func manifestMediaTypes(ctx context.Context, fetcher content.Fetcher, root ocispec.Descriptor) map[digest.Digest]string {
+	mediaTypes := map[digest.Digest]string{}
+	var walk func(desc ocispec.Descriptor)
+	walk = func(desc ocispec.Descriptor) {
+		if _, seen := mediaTypes[desc.Digest]; seen {
+			return
+		}
+		mediaTypes[desc.Digest] = desc.MediaType
+		// content missing locally is already in the registry, so it isn't pushed
+		successors, err := content.Successors(ctx, fetcher, desc)
+		if err != nil {
+			return
+		}
+		for _, successor := range successors {
+			walk(successor)
+		}
+	}
+	walk(root)
+	return mediaTypes
+}
+
+// ProbeOciArtifactSupport checks that the repository accepts an OCI image index pointing to a SOCI index manifest,
+// which is what pushing a SOCI index manifest v2 needs. It returns an error wrapping RegistryNotSupportingOciArtifacts
+// when the registry rejects them. The probe is small and always the same, so it is only pushed when missing and
+// deleted afterwards when the registry allows it. Registries that refuse deletes keep the probe, an untagged index
+// and manifest with two tiny blobs.
+func (registry *Registry) ProbeOciArtifactSupport(ctx context.Context, repositoryName string) error {
+	log.Info(ctx, "Checking registry support for OCI image indexes")
+
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+
+	probeStore := memory.New()
+	indexDesc, manifestDesc, err := buildArtifactProbe(ctx, probeStore)
+	if err != nil {
+		return err
+	}
+
+	exists, err := repo.Exists(ctx, indexDesc)
+	if err == nil && exists {
+		return nil
+	}
+
+	err = oras.CopyGraph(ctx, probeStore, repo, indexDesc, oras.DefaultCopyGraphOptions)
+	if err != nil {
+		return unsupportedArtifactError(err, manifestMediaTypes(ctx, probeStore, indexDesc))
+	}
+
+	// best effort, many registries don't allow deleting manifests
+	for _, desc := range []ocispec.Descriptor{indexDesc, manifestDesc} {
+		if err := repo.Delete(ctx, desc); err != nil {
+			log.Info(ctx, fmt.Sprintf("Couldn't delete OCI image index probe %s: %v", desc.Digest, err))
+			break
+		}
+	}
+	return nil
+}
+
+// Build an OCI image index with a SOCI index manifest v2 that has no zTOCs
+func buildArtifactProbe(ctx context.Context, probeStore *memory.Store) (ocispec.Descriptor, ocispec.Descriptor, error) {
+	emptyDesc := ocispec.Descriptor{
+		MediaType: soci.SociLayerMediaType,
+		Digest:    digest.FromBytes(emptyJSON),
+		Size:      int64(len(emptyJSON)),
+	}
+	configDesc := emptyDesc
+	configDesc.MediaType = soci.SociIndexArtifactTypeV2
+	// the memory store tells descriptors apart by media type, so the same blob is stored for each
+	for _, desc := range []ocispec.Descriptor{emptyDesc, configDesc} {
+		if err := probeStore.Push(ctx, desc, bytes.NewReader(emptyJSON)); err != nil {
+			return ocispec.Descriptor{}, ocispec.Descriptor{}, err
+		}
+	}
+
+	manifestDesc, err := pushJSON(ctx, probeStore, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{emptyDesc},
+		Annotations: map[string]string{
+			soci.IndexAnnotationBuildToolIdentifier: "github.com/CloudSnorkel/standalone-soci-indexer",
+		},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Descriptor{}, err
+	}
+	manifestDesc.ArtifactType = soci.SociIndexArtifactTypeV2
+
+	indexDesc, err := pushJSON(ctx, probeStore, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifestDesc},
+	})
+	return indexDesc, manifestDesc, err
+}
+
+func pushJSON(ctx context.Context, probeStore *memory.Store, mediaType string, v any) (ocispec.Descriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	return desc, probeStore.Push(ctx, desc, bytes.NewReader(content))
+}
@@ -0,0 +1,456 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// testRegistry is a minimal in-memory distribution API for a single repository
+type testRegistry struct {
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]testManifest
+	uploads   int
+
+	// rejectManifest is called for every manifest upload and can answer with an error instead
+	rejectManifest func(w http.ResponseWriter, mediaType string) bool
+	// rejectUploads denies all blob uploads
+	rejectUploads bool
+	// rejectCredentials answers 401 to everything but the /v2/ base endpoint
+	rejectCredentials bool
+	// referrers enables the referrers API
+	referrers bool
+	// subjects lists the manifests pushed with a subject by subject digest, when the referrers API is enabled
+	subjects map[string][]ocispec.Descriptor
+	// immutableTags rejects moving an existing tag to another manifest
+	immutableTags bool
+	// rejectTagDeletes refuses deleting manifests by tag
+	rejectTagDeletes bool
+	// requests records METHOD PATH for every request
+	requests []string
+}
+
+type testManifest struct {
+	mediaType string
+	content   []byte
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, string) {
+	registry := &testRegistry{blobs: map[string][]byte{}, manifests: map[string]testManifest{}, subjects: map[string][]ocispec.Descriptor{}}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	return registry, hostOf(t, server.URL)
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": []errcode.Error{{Code: code, Message: message}}})
+}
+
+func (registry *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.requests = append(registry.requests, r.Method+" "+r.URL.Path)
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case registry.rejectCredentials:
+		writeErrorResponse(w, http.StatusUnauthorized, errcode.ErrorCodeUnauthorized, "authentication required")
+	case strings.Contains(path, "/blobs/uploads/"):
+		registry.serveUpload(w, r)
+	case strings.Contains(path, "/blobs/"):
+		registry.serveBlob(w, r, path[strings.LastIndex(path, "/")+1:])
+	case strings.HasSuffix(path, "/tags/list"):
+		registry.serveTags(w)
+	case strings.Contains(path, "/referrers/") && registry.referrers:
+		manifests := registry.subjects[path[strings.LastIndex(path, "/")+1:]]
+		if manifests == nil {
+			manifests = []ocispec.Descriptor{}
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		_ = json.NewEncoder(w).Encode(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: manifests})
+	case strings.Contains(path, "/referrers/"):
+		w.WriteHeader(http.StatusNotFound)
+	case strings.Contains(path, "/manifests/"):
+		registry.serveManifest(w, r, path[strings.LastIndex(path, "/")+1:])
+	default:
+		writeErrorResponse(w, http.StatusNotFound, errcode.ErrorCodeNameUnknown, "not found")
+	}
+}
+
+func (registry *testRegistry) serveUpload(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if registry.rejectUploads {
+			writeErrorResponse(w, http.StatusForbidden, errcode.ErrorCodeDenied, "requested access to the resource is denied")
+			return
+		}
+		registry.uploads++
+		w.Header().Set("Location", fmt.Sprintf("%supload-%d", r.URL.Path, registry.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content, _ := io.ReadAll(r.Body)
+		dgst := r.URL.Query().Get("digest")
+		if digest.FromBytes(content).String() != dgst {
+			writeErrorResponse(w, http.StatusBadRequest, errcode.ErrorCodeDigestInvalid, "digest mismatch")
+			return
+		}
+		registry.blobs[dgst] = content
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (registry *testRegistry) serveBlob(w http.ResponseWriter, r *http.Request, dgst string) {
+	content, ok := registry.blobs[dgst]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			writeErrorResponse(w, http.StatusNotFound, errcode.ErrorCodeBlobUnknown, "blob unknown")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case http.MethodDelete:
+		if !ok {
+			writeErrorResponse(w, http.StatusNotFound, errcode.ErrorCodeBlobUnknown, "blob unknown")
+			return
+		}
+		delete(registry.blobs, dgst)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (registry *testRegistry) serveManifest(w http.ResponseWriter, r *http.Request, reference string) {
+	manifest, ok := registry.manifests[reference]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			writeErrorResponse(w, http.StatusNotFound, errcode.ErrorCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest.content)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.content).String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(manifest.content)
+		}
+	case http.MethodPut:
+		mediaType := r.Header.Get("Content-Type")
+		if registry.rejectManifest != nil && registry.rejectManifest(w, mediaType) {
+			return
+		}
+		content, _ := io.ReadAll(r.Body)
+		manifest := testManifest{mediaType: mediaType, content: content}
+		dgst := digest.FromBytes(content).String()
+		if existing, ok := registry.manifests[reference]; ok && registry.immutableTags && reference != dgst && !bytes.Equal(existing.content, content) {
+			writeErrorResponse(w, http.StatusBadRequest, "TAG_INVALID", "tag is immutable")
+			return
+		}
+		registry.manifests[dgst] = manifest
+		registry.manifests[reference] = manifest
+		w.Header().Set("Docker-Content-Digest", dgst)
+		var withSubject ocispec.Manifest
+		if registry.referrers && json.Unmarshal(content, &withSubject) == nil && withSubject.Subject != nil {
+			subject := withSubject.Subject.Digest.String()
+			registry.subjects[subject] = append(registry.subjects[subject], ocispec.Descriptor{
+				MediaType:    mediaType,
+				ArtifactType: withSubject.ArtifactType,
+				Digest:       digest.Digest(dgst),
+				Size:         int64(len(content)),
+			})
+			w.Header().Set("OCI-Subject", subject)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if !ok {
+			writeErrorResponse(w, http.StatusNotFound, errcode.ErrorCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		// deleting a tag only removes the tag
+		if !strings.Contains(reference, ":") {
+			if registry.rejectTagDeletes {
+				writeErrorResponse(w, http.StatusMethodNotAllowed, errcode.ErrorCodeUnsupported, "tag deletion is not supported")
+				return
+			}
+			delete(registry.manifests, reference)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		for ref, m := range registry.manifests {
+			if digest.FromBytes(m.content) == digest.FromBytes(manifest.content) {
+				delete(registry.manifests, ref)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (registry *testRegistry) serveTags(w http.ResponseWriter) {
+	tags := []string{}
+	for ref := range registry.manifests {
+		if !strings.Contains(ref, ":") {
+			tags = append(tags, ref)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": "repo", "tags": tags})
+}
+
+func (registry *testRegistry) count(request string) int {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	count := 0
+	for _, r := range registry.requests {
+		if strings.HasPrefix(r, request) {
+			count++
+		}
+	}
+	return count
+}
+
+func initTestRegistry(t *testing.T, host string) *Registry {
+	registry, err := Init(context.Background(), host, "",
+		WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1)),
+		WithHostConfig(host, HostConfig{PlainHTTP: Bool(true)}),
+	)
+	if err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+	return registry
+}
+
+func TestUnsupportedArtifactError(t *testing.T) {
+	indexUrl, _ := url.Parse("https://registry.example.com/v2/repo/manifests/sha256:1234")
+	dockerUrl, _ := url.Parse("https://registry.example.com/v2/repo/manifests/sha256:5678")
+	blobUrl, _ := url.Parse("https://registry.example.com/v2/repo/blobs/uploads/1")
+	mediaTypes := map[digest.Digest]string{
+		"sha256:1234": ocispec.MediaTypeImageIndex,
+		"sha256:5678": MediaTypeDockerManifest,
+	}
+
+	tests := []struct {
+		name        string
+		err         error
+		unsupported bool
+	}{
+		{
+			name: "ECR invalid parameter",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusMethodNotAllowed, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeUnsupported, Message: "Invalid parameter at 'ImageManifest' failed to satisfy constraint: 'Invalid JSON syntax'"},
+			}},
+			unsupported: true,
+		},
+		{
+			name: "manifest invalid for an image index",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeManifestInvalid, Message: "manifest invalid"},
+			}},
+			unsupported: true,
+		},
+		{
+			name: "manifest invalid for a Docker manifest",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: dockerUrl, StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeManifestInvalid, Message: "manifest invalid", Detail: "unsupported manifest media type"},
+			}},
+		},
+		{
+			name: "manifest invalid for an unknown manifest",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl.JoinPath("..", "latest"), StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeManifestInvalid, Message: "manifest invalid"},
+			}},
+		},
+		{
+			name: "missing blob",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeManifestBlobUnknown, Message: "blob unknown to registry"},
+			}},
+		},
+		{
+			name:        "unsupported media type",
+			err:         &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusUnsupportedMediaType},
+			unsupported: true,
+		},
+		{
+			name: "wrapped",
+			err: fmt.Errorf("push failed: %w", &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeManifestInvalid, Message: "manifest invalid", Detail: "unrecognized manifest content type"},
+			}}),
+			unsupported: true,
+		},
+		{
+			name: "denied",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusForbidden, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeDenied, Message: "requested access to the resource is denied"},
+			}},
+		},
+		{
+			name:        "read only registry",
+			err:         &errcode.ErrorResponse{Method: http.MethodPut, URL: indexUrl, StatusCode: http.StatusMethodNotAllowed},
+			unsupported: false,
+		},
+		{
+			name: "blob upload",
+			err: &errcode.ErrorResponse{Method: http.MethodPut, URL: blobUrl, StatusCode: http.StatusBadRequest, Errors: errcode.Errors{
+				{Code: errcode.ErrorCodeUnsupported, Message: "unsupported"},
+			}},
+		},
+		{
+			name: "network error",
+			err:  errors.New("connection reset by peer"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := unsupportedArtifactError(test.err, mediaTypes)
+			if errors.Is(err, RegistryNotSupportingOciArtifacts) != test.unsupported {
+				t.Fatalf("expected unsupported to be %t, got %v", test.unsupported, err)
+			}
+			if !test.unsupported && err != test.err {
+				t.Fatalf("expected original error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestManifestMediaTypes(t *testing.T) {
+	probeStore := memory.New()
+	indexDesc, manifestDesc, err := buildArtifactProbe(context.Background(), probeStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaTypes := manifestMediaTypes(context.Background(), probeStore, indexDesc)
+	if mediaTypes[indexDesc.Digest] != ocispec.MediaTypeImageIndex || mediaTypes[manifestDesc.Digest] != ocispec.MediaTypeImageManifest {
+		t.Fatalf("expected the index and its manifest, got %v", mediaTypes)
+	}
+}
+
+func TestProbeOciArtifactSupport(t *testing.T) {
+	t.Run("supported", func(t *testing.T) {
+		server, host := newTestRegistry(t)
+		registry := initTestRegistry(t, host)
+
+		if err := registry.ProbeOciArtifactSupport(context.Background(), "repo"); err != nil {
+			t.Fatalf("ProbeOciArtifactSupport returned error: %v", err)
+		}
+		if server.count("PUT /v2/repo/manifests/") != 2 {
+			t.Fatalf("expected the probe manifest and index to be pushed, got %v", server.requests)
+		}
+		if server.count("DELETE /v2/repo/manifests/") != 2 {
+			t.Fatalf("expected the probe to be deleted, got %v", server.requests)
+		}
+		for ref, manifest := range server.manifests {
+			t.Fatalf("expected no manifests left, found %s (%s)", ref, manifest.mediaType)
+		}
+	})
+
+	t.Run("already probed", func(t *testing.T) {
+		server, host := newTestRegistry(t)
+		registry := initTestRegistry(t, host)
+
+		probeStore := memory.New()
+		indexDesc, _, err := buildArtifactProbe(context.Background(), probeStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexContent, err := content.FetchAll(context.Background(), probeStore, indexDesc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.manifests[indexDesc.Digest.String()] = testManifest{mediaType: ocispec.MediaTypeImageIndex, content: indexContent}
+
+		if err := registry.ProbeOciArtifactSupport(context.Background(), "repo"); err != nil {
+			t.Fatalf("ProbeOciArtifactSupport returned error: %v", err)
+		}
+		if server.count("PUT ") != 0 {
+			t.Fatalf("expected nothing to be pushed, got %v", server.requests)
+		}
+	})
+
+	t.Run("image index rejected", func(t *testing.T) {
+		server, host := newTestRegistry(t)
+		server.rejectManifest = func(w http.ResponseWriter, mediaType string) bool {
+			if mediaType != ocispec.MediaTypeImageIndex {
+				return false
+			}
+			writeErrorResponse(w, http.StatusBadRequest, errcode.ErrorCodeManifestInvalid, "unrecognized manifest content type")
+			return true
+		}
+		registry := initTestRegistry(t, host)
+
+		err := registry.ProbeOciArtifactSupport(context.Background(), "repo")
+		if !errors.Is(err, RegistryNotSupportingOciArtifacts) {
+			t.Fatalf("expected unsupported registry error, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "unrecognized manifest content type") {
+			t.Fatalf("expected registry message in error, got %v", err)
+		}
+	})
+
+	t.Run("image index rejected without a reason", func(t *testing.T) {
+		server, host := newTestRegistry(t)
+		server.rejectManifest = func(w http.ResponseWriter, mediaType string) bool {
+			if mediaType != ocispec.MediaTypeImageIndex {
+				return false
+			}
+			writeErrorResponse(w, http.StatusBadRequest, errcode.ErrorCodeManifestInvalid, "manifest invalid")
+			return true
+		}
+		registry := initTestRegistry(t, host)
+
+		err := registry.ProbeOciArtifactSupport(context.Background(), "repo")
+		if !errors.Is(err, RegistryNotSupportingOciArtifacts) {
+			t.Fatalf("expected unsupported registry error, got %v", err)
+		}
+	})
+
+	t.Run("push denied", func(t *testing.T) {
+		server, host := newTestRegistry(t)
+		server.rejectManifest = func(w http.ResponseWriter, _ string) bool {
+			writeErrorResponse(w, http.StatusForbidden, errcode.ErrorCodeDenied, "denied")
+			return true
+		}
+		registry := initTestRegistry(t, host)
+
+		err := registry.ProbeOciArtifactSupport(context.Background(), "repo")
+		if err == nil || errors.Is(err, RegistryNotSupportingOciArtifacts) {
+			t.Fatalf("expected a push error that isn't about OCI support, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+const (
+	credentialProviderApiVersion = "credentialprovider.kubelet.k8s.io/v1"
+	credentialProviderTimeout    = time.Minute
+)
+
+// CredentialProvider is an external executable that returns registry credentials using the
+// kubelet credential provider protocol: a CredentialProviderRequest is written to its stdin and
+// a CredentialProviderResponse is read from its stdout.
+type CredentialProvider struct {
+	// MatchImages are registry host globs the provider is used for, e.g. *.pkg.dev or *.azurecr.io.
+	// A provider without any is used for every registry.
+	MatchImages []string
+	Command     string
+	Args        []string
+	// Env is added to the environment of the executable, as KEY=VALUE
+	Env []string
+	// DefaultCacheDuration is used when the response doesn't set cacheDuration
+	DefaultCacheDuration time.Duration
+}
+
+type credentialProviderRequest struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type credentialProviderResponse struct {
+	ApiVersion    string                                  `json:"apiVersion"`
+	Kind          string                                  `json:"kind"`
+	CacheDuration string                                  `json:"cacheDuration,omitempty"`
+	Auth          map[string]credentialProviderAuthConfig `json:"auth"`
+}
+
+type credentialProviderAuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Token is an extension to the kubelet protocol for registries that take a bearer token directly
+	Token string `json:"token,omitempty"`
+}
+
+// WithCredentialProvider adds an external credential provider. The first provider matching a registry is used.
+func WithCredentialProvider(provider CredentialProvider) Option {
+	return func(o *options) {
+		o.credentialProviders = append(o.credentialProviders, provider)
+	}
+}
+
+// credentialProviderFor returns the first provider matching the registry host
+func (o *options) credentialProviderFor(registryUrl string) (CredentialProvider, bool) {
+	for _, provider := range o.credentialProviders {
+		if len(provider.MatchImages) == 0 {
+			return provider, true
+		}
+		for _, pattern := range provider.MatchImages {
+			if matchRegistryHost(pattern, registryUrl) {
+				return provider, true
+			}
+		}
+	}
+	return CredentialProvider{}, false
+}
+
+// credential returns a cached credential backed by the provider, for an image on the registry
+func (provider CredentialProvider) credential(registryUrl string, image string) *cachedCredential {
+	return newCachedCredential(func(ctx context.Context) (auth.Credential, time.Time, error) {
+		return provider.exec(ctx, registryUrl, image)
+	})
+}
+
+// Run the provider executable with the image reference and pick the credential matching the registry
+func (provider CredentialProvider) exec(ctx context.Context, registryUrl string, image string) (auth.Credential, time.Time, error) {
+	log.Info(ctx, fmt.Sprintf("Getting credentials from %s", provider.Command))
+
+	request, err := json.Marshal(credentialProviderRequest{
+		ApiVersion: credentialProviderApiVersion,
+		Kind:       "CredentialProviderRequest",
+		Image:      image,
+	})
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, credentialProviderTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, provider.Command, provider.Args...)
+	cmd.Env = append(os.Environ(), provider.Env...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s failed: %w: %s", provider.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response credentialProviderResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s returned invalid JSON: %w", provider.Command, err)
+	}
+	if response.Kind != "CredentialProviderResponse" {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s returned unexpected kind %q", provider.Command, response.Kind)
+	}
+
+	cacheDuration := provider.DefaultCacheDuration
+	if response.CacheDuration != "" {
+		cacheDuration, err = time.ParseDuration(response.CacheDuration)
+		if err != nil {
+			return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s returned invalid cacheDuration: %w", provider.Command, err)
+		}
+	}
+
+	authConfig, ok := bestAuthConfig(response.Auth, registryUrl)
+	if !ok {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s returned no credentials for %s", provider.Command, registryUrl)
+	}
+
+	credential := auth.Credential{Username: authConfig.Username, Password: authConfig.Password}
+	if authConfig.Token != "" {
+		credential = auth.Credential{AccessToken: authConfig.Token}
+	}
+	if credential == auth.EmptyCredential {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("credential provider %s returned empty credentials for %s", provider.Command, registryUrl)
+	}
+	// Get treats a credential that expires within the refresh window as stale, so push the expiry out by that much
+	return credential, time.Now().Add(cacheDuration + credentialRefreshWindow), nil
+}
+
+// bestAuthConfig picks the most specific entry matching the registry, like the kubelet does
+func bestAuthConfig(configs map[string]credentialProviderAuthConfig, registryUrl string) (credentialProviderAuthConfig, bool) {
+	var best string
+	found := false
+	for pattern := range configs {
+		if !matchRegistryHost(pattern, registryUrl) {
+			continue
+		}
+		if !found || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+			found = true
+		}
+	}
+	return configs[best], found
+}
+
+// matchRegistryHost matches a host against a glob like the kubelet does for matchImages.
+// Globs apply to each dot separated part of the host and the port must match exactly if given.
+func matchRegistryHost(pattern string, registryUrl string) bool {
+	// matchImages may include a repository path, which we don't have at this point
+	pattern, _, _ = strings.Cut(strings.TrimPrefix(strings.TrimPrefix(pattern, "https://"), "http://"), "/")
+
+	patternHost, patternPort := splitPort(pattern)
+	host, port := splitPort(registryUrl)
+	if patternPort != "" && patternPort != port {
+		return false
+	}
+
+	patternParts := strings.Split(strings.ToLower(patternHost), ".")
+	hostParts := strings.Split(strings.ToLower(host), ".")
+	if len(patternParts) != len(hostParts) {
+		return false
+	}
+	for i := range patternParts {
+		matched, err := path.Match(patternParts[i], hostParts[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPort(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, ""
+	}
+	return host, port
+}
@@ -0,0 +1,215 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestMatchRegistryHost(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{"registry.example.com", "registry.example.com", true},
+		{"REGISTRY.example.com", "registry.EXAMPLE.com", true},
+		{"*.pkg.dev", "us-docker.pkg.dev", true},
+		{"*.pkg.dev", "pkg.dev", false},
+		{"*.pkg.dev", "a.b.pkg.dev", false},
+		{"*.*.pkg.dev", "a.b.pkg.dev", true},
+		{"*-docker.pkg.dev", "europe-docker.pkg.dev", true},
+		{"*.azurecr.io", "myregistry.azurecr.io", true},
+		{"*.azurecr.io", "myregistry.azurecr.cn", false},
+		{"registry.example.com:5000", "registry.example.com:5000", true},
+		{"registry.example.com:5000", "registry.example.com:5001", false},
+		{"registry.example.com", "registry.example.com:5000", true},
+		{"https://registry.example.com/team/repo", "registry.example.com", true},
+	}
+
+	for _, test := range tests {
+		if matchRegistryHost(test.pattern, test.host) != test.expected {
+			t.Errorf("matchRegistryHost(%s, %s) should be %t", test.pattern, test.host, test.expected)
+		}
+	}
+}
+
+func TestCredentialProviderFor(t *testing.T) {
+	o := defaultOptions()
+	WithCredentialProvider(CredentialProvider{MatchImages: []string{"*.pkg.dev"}, Command: "gcp"})(&o)
+	WithCredentialProvider(CredentialProvider{MatchImages: []string{"*.azurecr.io", "*.azurecr.cn"}, Command: "acr"})(&o)
+	WithCredentialProvider(CredentialProvider{Command: "fallback"})(&o)
+
+	tests := map[string]string{
+		"us-docker.pkg.dev":     "gcp",
+		"myregistry.azurecr.cn": "acr",
+		"registry.example.com":  "fallback",
+	}
+	for host, expected := range tests {
+		provider, ok := o.credentialProviderFor(host)
+		if !ok || provider.Command != expected {
+			t.Errorf("expected %s for %s, got %+v", expected, host, provider)
+		}
+	}
+
+	o = defaultOptions()
+	WithCredentialProvider(CredentialProvider{MatchImages: []string{"*.pkg.dev"}, Command: "gcp"})(&o)
+	if _, ok := o.credentialProviderFor("docker.io"); ok {
+		t.Error("expected no provider for docker.io")
+	}
+}
+
+// Write a provider script that logs its input and prints the response
+func writeCredentialProvider(t *testing.T, response string) (string, string) {
+	dir := t.TempDir()
+	requests := filepath.Join(dir, "requests")
+	script := filepath.Join(dir, "provider")
+	content := fmt.Sprintf("#!/bin/sh\ncat >> %s\necho >> %s\ncat <<'EOF'\n%s\nEOF\n", requests, requests, response)
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return script, requests
+}
+
+func TestCredentialProviderExec(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      string
+		expected      auth.Credential
+		expectedCache time.Duration
+		expectErr     bool
+	}{
+		{
+			name:          "username and password",
+			response:      `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"1h","auth":{"*.example.com":{"username":"user","password":"pass"}}}`,
+			expected:      auth.Credential{Username: "user", Password: "pass"},
+			expectedCache: time.Hour,
+		},
+		{
+			name:          "most specific entry",
+			response:      `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","auth":{"*.example.com":{"username":"wide","password":"pass"},"registry.example.com":{"username":"exact","password":"pass"}}}`,
+			expected:      auth.Credential{Username: "exact", Password: "pass"},
+			expectedCache: 5 * time.Minute,
+		},
+		{
+			name:          "bearer token",
+			response:      `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","auth":{"registry.example.com":{"token":"secret"}}}`,
+			expected:      auth.Credential{AccessToken: "secret"},
+			expectedCache: 5 * time.Minute,
+		},
+		{
+			name:      "no matching entry",
+			response:  `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","auth":{"other.example.org":{"username":"user","password":"pass"}}}`,
+			expectErr: true,
+		},
+		{
+			name:      "wrong kind",
+			response:  `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest"}`,
+			expectErr: true,
+		},
+		{
+			name:      "invalid JSON",
+			response:  `not json`,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, requests := writeCredentialProvider(t, test.response)
+			provider := CredentialProvider{Command: script, DefaultCacheDuration: 5 * time.Minute}
+
+			before := time.Now()
+			credential, expiresAt, err := provider.exec(context.Background(), "registry.example.com", "registry.example.com/team/repo:latest")
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exec returned error: %v", err)
+			}
+			if credential != test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, credential)
+			}
+			if expiresAt.Before(before.Add(test.expectedCache + credentialRefreshWindow)) {
+				t.Fatalf("credential should be cached for %s, expires at %s", test.expectedCache, expiresAt)
+			}
+
+			request, err := os.ReadFile(requests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(request), `"kind":"CredentialProviderRequest"`) || !strings.Contains(string(request), `"image":"registry.example.com/team/repo:latest"`) {
+				t.Fatalf("unexpected request: %s", request)
+			}
+		})
+	}
+}
+
+func TestCredentialProviderFailure(t *testing.T) {
+	provider := CredentialProvider{Command: "sh", Args: []string{"-c", "echo not logged in >&2; exit 1"}}
+	_, _, err := provider.exec(context.Background(), "registry.example.com", "registry.example.com/repo")
+	if err == nil || !strings.Contains(err.Error(), "not logged in") {
+		t.Fatalf("expected error with provider output, got %v", err)
+	}
+}
+
+func TestInitWithCredentialProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		newManifestHandler().ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := hostOf(t, server.URL)
+
+	script, requests := writeCredentialProvider(t, `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheDuration":"1h","auth":{"127.0.0.1":{"username":"user","password":"pass"}}}`)
+
+	registry, err := Init(context.Background(), host, "",
+		WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1)),
+		WithHostConfig(host, HostConfig{PlainHTTP: Bool(true)}),
+		WithCredentialProvider(CredentialProvider{MatchImages: []string{"127.0.0.1"}, Command: script}),
+		WithImage(host+"/team/repo:latest"),
+	)
+	if err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	for range 2 {
+		desc, err := registry.HeadManifest(context.Background(), "repo", "latest")
+		if err != nil {
+			t.Fatalf("HeadManifest returned error: %v", err)
+		}
+		if desc.Digest.String() != testManifestDigest {
+			t.Fatalf("unexpected digest: %s", desc.Digest)
+		}
+	}
+
+	request, err := os.ReadFile(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Count(string(request), "CredentialProviderRequest"); calls != 1 {
+		t.Fatalf("expected the provider to be called once, got %d", calls)
+	}
+	if !strings.Contains(string(request), fmt.Sprintf(`"image":%q`, host+"/team/repo:latest")) {
+		t.Fatalf("expected the provider to get the image reference, got %s", request)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/credentials"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// Credentials are refreshed this long before they expire so long requests don't outlive them
+const credentialRefreshWindow = 15 * time.Minute
+
+// credentialFetcher gets a new credential and the time it expires
+type credentialFetcher func(ctx context.Context) (auth.Credential, time.Time, error)
+
+// cachedCredential caches a credential until shortly before it expires. It is safe for concurrent use.
+type cachedCredential struct {
+	fetch credentialFetcher
+	now   func() time.Time
+
+	lock       sync.Mutex
+	credential auth.Credential
+	expiresAt  time.Time
+}
+
+func newCachedCredential(fetch credentialFetcher) *cachedCredential {
+	return &cachedCredential{fetch: fetch, now: time.Now, credential: auth.EmptyCredential}
+}
+
+// Get returns the cached credential, fetching a new one if there is none or it is about to expire
+func (c *cachedCredential) Get(ctx context.Context) (auth.Credential, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.credential != auth.EmptyCredential && c.now().Before(c.expiresAt.Add(-credentialRefreshWindow)) {
+		return c.credential, nil
+	}
+
+	if c.credential != auth.EmptyCredential {
+		log.Info(ctx, "Refreshing registry credentials")
+	}
+	credential, expiresAt, err := c.fetch(ctx)
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	registerSecrets(credential)
+	c.credential = credential
+	c.expiresAt = expiresAt
+	return credential, nil
+}
+
+// registerSecrets keeps the credential out of the log, including the basic auth header built from it
+func registerSecrets(credential auth.Credential) {
+	log.RegisterSecret(credential.Password)
+	log.RegisterSecret(credential.RefreshToken)
+	log.RegisterSecret(credential.AccessToken)
+	if credential.Password != "" {
+		log.RegisterSecret(base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password)))
+	}
+}
+
+// Invalidate drops the credential if it is still the one that was rejected, so the next Get fetches a new one
+func (c *cachedCredential) Invalidate(rejected auth.Credential) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.credential == rejected {
+		c.credential = auth.EmptyCredential
+	}
+}
+
+// Look up credentials saved by docker login, including docker credential helpers
+func dockerConfigCredential(ctx context.Context, registryUrl string) (auth.Credential, bool) {
+	store, err := credentials.NewStoreFromDocker(credentials.StoreOptions{})
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't read docker config: %v", err))
+		return auth.EmptyCredential, false
+	}
+	credential, err := store.Get(ctx, credentials.ServerAddressFromRegistry(registryUrl))
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't get credentials from docker config: %v", err))
+		return auth.EmptyCredential, false
+	}
+	if credential == auth.EmptyCredential {
+		return auth.EmptyCredential, false
+	}
+	registerSecrets(credential)
+	log.Info(ctx, "Using credentials from docker config")
+	return credential, true
+}
+
+// Decode a base64 USER:PASSWORD token as returned by ECR
+func decodeBasicAuthToken(token string) (auth.Credential, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("failed to decode authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return auth.EmptyCredential, errors.New("authorization token is not in USER:PASSWORD format")
+	}
+	return auth.Credential{Username: username, Password: password}, nil
+}
+
+// basicAuthClient sends every request with basic authentication from a cached credential.
+// A 401 invalidates the credential and the request is retried once with a fresh one.
+type basicAuthClient struct {
+	client     *auth.Client
+	credential *cachedCredential
+}
+
+func (c *basicAuthClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	credential, err := c.credential.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(withBasicAuth(req, credential))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// requests with a body can only be sent again if the body can be rewound, the caller's request is left alone
+	retryReq := req
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retryReq = req.Clone(ctx)
+		retryReq.Body = body
+	}
+
+	log.Warn(ctx, "Registry rejected credentials, re-authenticating")
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+
+	c.credential.Invalidate(credential)
+	credential, err = c.credential.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-authenticate: %w", err)
+	}
+	return c.client.Do(withBasicAuth(retryReq, credential))
+}
+
+func withBasicAuth(req *http.Request, credential auth.Credential) *http.Request {
+	req = req.Clone(req.Context())
+	token := base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password))
+	req.Header.Set("Authorization", "Basic "+token)
+	return req
+}
@@ -0,0 +1,166 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+func TestCachedCredentialRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetches := 0
+	credential := newCachedCredential(func(context.Context) (auth.Credential, time.Time, error) {
+		fetches++
+		return auth.Credential{Username: "AWS", Password: fmt.Sprintf("token-%d", fetches)}, now.Add(12 * time.Hour), nil
+	})
+	credential.now = func() time.Time { return now }
+
+	get := func(expected string) {
+		t.Helper()
+		cred, err := credential.Get(context.Background())
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		if cred.Password != expected {
+			t.Fatalf("expected %s, got %s", expected, cred.Password)
+		}
+	}
+
+	get("token-1")
+	get("token-1")
+
+	// refreshed proactively before expiring
+	now = now.Add(12*time.Hour - credentialRefreshWindow + time.Second)
+	get("token-2")
+
+	// a stale rejection doesn't throw away the new token
+	credential.Invalidate(auth.Credential{Username: "AWS", Password: "token-1"})
+	get("token-2")
+
+	credential.Invalidate(auth.Credential{Username: "AWS", Password: "token-2"})
+	get("token-3")
+}
+
+func TestCachedCredentialConcurrentUse(t *testing.T) {
+	var lock sync.Mutex
+	fetches := 0
+	credential := newCachedCredential(func(context.Context) (auth.Credential, time.Time, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		time.Sleep(10 * time.Millisecond)
+		return auth.Credential{Username: "AWS", Password: "token"}, time.Now().Add(12 * time.Hour), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := credential.Get(context.Background()); err != nil {
+				t.Errorf("Get returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Fatalf("expected a single fetch, got %d", fetches)
+	}
+}
+
+func TestBasicAuthClientReauthenticates(t *testing.T) {
+	validToken := "token-2"
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("AWS:"+validToken))
+		if r.Header.Get("Authorization") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	fetches := 0
+	client := &basicAuthClient{
+		client: &auth.Client{},
+		credential: newCachedCredential(func(context.Context) (auth.Credential, time.Time, error) {
+			fetches++
+			return auth.Credential{Username: "AWS", Password: fmt.Sprintf("token-%d", fetches)}, time.Now().Add(12 * time.Hour), nil
+		}),
+	}
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/v2/repo/manifests/latest", strings.NewReader("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalBody := req.Body
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do returned error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if req.Body != originalBody || req.Header.Get("Authorization") != "" {
+		t.Fatal("expected the caller's request to be left alone")
+	}
+	if len(bodies) != 2 || bodies[0] != "manifest" || bodies[1] != "manifest" {
+		t.Fatalf("expected the body to be sent on both attempts, got %q", bodies)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected request to succeed after re-authenticating, got %d", resp.StatusCode)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected 2 credential fetches, got %d", fetches)
+	}
+}
+
+func TestDecodeBasicAuthToken(t *testing.T) {
+	cred, err := decodeBasicAuthToken(base64.StdEncoding.EncodeToString([]byte("AWS:some:password")))
+	if err != nil {
+		t.Fatalf("decodeBasicAuthToken returned error: %v", err)
+	}
+	if cred.Username != "AWS" || cred.Password != "some:password" {
+		t.Fatalf("unexpected credential: %+v", cred)
+	}
+
+	if _, err := decodeBasicAuthToken(base64.StdEncoding.EncodeToString([]byte("no-separator"))); err == nil {
+		t.Fatal("expected error for token without separator")
+	}
+	if _, err := decodeBasicAuthToken("not base64!"); err == nil {
+		t.Fatal("expected error for invalid base64")
+	}
+}
+
+func TestCachedCredentialIsRedacted(t *testing.T) {
+	credential := newCachedCredential(func(context.Context) (auth.Credential, time.Time, error) {
+		return auth.Credential{Username: "AWS", Password: "redact-me"}, time.Now().Add(time.Hour), nil
+	})
+	if _, err := credential.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	header := base64.StdEncoding.EncodeToString([]byte("AWS:redact-me"))
+	message := log.Redact("password redact-me, header Basic " + header)
+	if strings.Contains(message, "redact-me") || strings.Contains(message, header) {
+		t.Fatalf("credential not redacted: %s", message)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// CheckStatus is the outcome of a doctor check
+type CheckStatus string
+
+const (
+	CheckPassed  CheckStatus = "ok"
+	CheckWarning CheckStatus = "warn"
+	CheckFailed  CheckStatus = "fail"
+	CheckSkipped CheckStatus = "skip"
+)
+
+// Check is the result of a single doctor check
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+const (
+	CheckDNS            = "DNS"
+	CheckReachability   = "TLS and reachability"
+	CheckAuthentication = "Authentication"
+	CheckPull           = "Pull permission"
+	CheckPush           = "Push permission"
+	CheckOciArtifacts   = "OCI image index and artifact media types"
+	CheckReferrers      = "Referrers API"
+	CheckTagMutability  = "Tag mutability"
+
+	// throwaway tags pushed by the tag mutability check start with this
+	doctorTagPrefix = "soci-indexer-doctor-"
+)
+
+// Diagnose checks everything indexing and pushing to a repository needs, without indexing anything.
+// reference is an optional tag or digest used to check pull permission, otherwise tags are listed.
+// Push checks upload small throwaway content and delete it again when the registry allows it.
+func Diagnose(ctx context.Context, registryUrl string, authToken string, repositoryName string, reference string, opts ...Option) []Check {
+	checks := []Check{checkDNS(ctx, registryUrl)}
+	if checks[0].Status == CheckFailed {
+		return skipChecks(checks, "registry host can't be resolved", CheckReachability, CheckAuthentication, CheckPull, CheckPush, CheckOciArtifacts, CheckReferrers, CheckTagMutability)
+	}
+
+	registry, err := Init(ctx, registryUrl, authToken, opts...)
+	if err != nil {
+		checks = append(checks, Check{Name: CheckAuthentication, Status: CheckFailed, Detail: fmt.Sprintf("couldn't set up registry client: %v", err)})
+		return skipChecks(checks, "no registry client", CheckReachability, CheckPull, CheckPush, CheckOciArtifacts, CheckReferrers, CheckTagMutability)
+	}
+
+	reachability := registry.checkReachability(ctx)
+	checks = append(checks, reachability)
+	if reachability.Status == CheckFailed {
+		return skipChecks(checks, "registry is not reachable", CheckAuthentication, CheckPull, CheckPush, CheckOciArtifacts, CheckReferrers, CheckTagMutability)
+	}
+
+	// the credentials are only known to work once the registry answered with them
+	pull, pullErr := registry.checkPull(ctx, repositoryName, reference)
+	push, pushErr := registry.checkPush(ctx, repositoryName)
+	checks = append(checks, registry.checkAuthentication(pullErr, pushErr), pull, push)
+	if push.Status == CheckFailed {
+		checks = skipChecks(checks, "needs push permission", CheckOciArtifacts)
+		checks = append(checks, registry.checkReferrers(ctx, repositoryName))
+		return skipChecks(checks, "needs push permission", CheckTagMutability)
+	}
+
+	artifacts := registry.checkOciArtifacts(ctx, repositoryName)
+	checks = append(checks, artifacts, registry.checkReferrers(ctx, repositoryName))
+	if artifacts.Status == CheckFailed {
+		return skipChecks(checks, "needs OCI image index support", CheckTagMutability)
+	}
+	return append(checks, registry.checkTagMutability(ctx, repositoryName))
+}
+
+func skipChecks(checks []Check, reason string, names ...string) []Check {
+	for _, name := range names {
+		checks = append(checks, Check{Name: name, Status: CheckSkipped, Detail: reason})
+	}
+	return checks
+}
+
+func checkDNS(ctx context.Context, registryUrl string) Check {
+	host, _ := splitPort(registryUrl)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return Check{Name: CheckDNS, Status: CheckFailed, Detail: err.Error()}
+	}
+	return Check{Name: CheckDNS, Status: CheckPassed, Detail: strings.Join(addrs, ", ")}
+}
+
+// Any HTTP answer from /v2/ means the connection and TLS handshake work
+func (registry *Registry) checkReachability(ctx context.Context) Check {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registry.url("/v2/"), nil)
+	if err != nil {
+		return Check{Name: CheckReachability, Status: CheckFailed, Detail: err.Error()}
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := registry.httpClient.Do(req)
+	if err != nil {
+		return Check{Name: CheckReachability, Status: CheckFailed, Detail: describeFailure(nil, err)}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	detail := fmt.Sprintf("plain HTTP, /v2/ answered %d", resp.StatusCode)
+	if resp.TLS != nil {
+		detail = fmt.Sprintf("%s, /v2/ answered %d", tlsVersionName(resp.TLS.Version), resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return Check{Name: CheckReachability, Status: CheckWarning, Detail: detail + ", expected 200 or 401 from a distribution API"}
+	}
+	return Check{Name: CheckReachability, Status: CheckPassed, Detail: detail}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS 0x%04x", version)
+	}
+}
+
+// Tell from the answers to the pull and push checks whether the registry accepted the credentials. 401 means they
+// were rejected, 403 that they were accepted without the permission.
+func (registry *Registry) checkAuthentication(errs ...error) Check {
+	method := registry.AuthMethod()
+	rejected := false
+	for _, err := range errs {
+		var errResp *errcode.ErrorResponse
+		if !errors.As(err, &errResp) {
+			continue
+		}
+		switch errResp.StatusCode {
+		case http.StatusUnauthorized:
+			return Check{Name: CheckAuthentication, Status: CheckFailed, Detail: fmt.Sprintf("%s, the registry rejected the credentials with 401", method)}
+		case http.StatusForbidden:
+			rejected = true
+		}
+	}
+	if rejected {
+		return Check{Name: CheckAuthentication, Status: CheckWarning, Detail: fmt.Sprintf("%s, the registry accepted the credentials but denied access with 403", method)}
+	}
+	return Check{Name: CheckAuthentication, Status: CheckPassed, Detail: method}
+}
+
+func (registry *Registry) checkPull(ctx context.Context, repositoryName string, reference string) (Check, error) {
+	if reference != "" {
+		desc, err := registry.HeadManifest(ctx, repositoryName, reference)
+		if err != nil {
+			return Check{Name: CheckPull, Status: CheckFailed, Detail: err.Error()}, err
+		}
+		return Check{Name: CheckPull, Status: CheckPassed, Detail: fmt.Sprintf("resolved %s to %s", reference, desc.Digest)}, nil
+	}
+
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return Check{Name: CheckPull, Status: CheckFailed, Detail: err.Error()}, err
+	}
+	tagCount := 0
+	errFirstPage := errors.New("first page")
+	err = repo.Tags(ctx, "", func(tags []string) error {
+		tagCount = len(tags)
+		return errFirstPage
+	})
+	if err != nil && !errors.Is(err, errFirstPage) {
+		return Check{Name: CheckPull, Status: CheckFailed, Detail: err.Error()}, err
+	}
+	return Check{Name: CheckPull, Status: CheckPassed, Detail: fmt.Sprintf("listed %d tags", tagCount)}, nil
+}
+
+// Upload a random blob and delete it again
+func (registry *Registry) checkPush(ctx context.Context, repositoryName string) (Check, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return Check{Name: CheckPush, Status: CheckFailed, Detail: err.Error()}, err
+	}
+
+	content := []byte("standalone-soci-indexer doctor " + randomHex())
+	desc := ocispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	if err := repo.Blobs().Push(ctx, desc, bytes.NewReader(content)); err != nil {
+		return Check{Name: CheckPush, Status: CheckFailed, Detail: err.Error()}, err
+	}
+	if err := repo.Blobs().Delete(ctx, desc); err != nil {
+		return Check{Name: CheckPush, Status: CheckPassed, Detail: fmt.Sprintf("uploaded test blob %s, couldn't delete it: %v", desc.Digest, err)}, nil
+	}
+	return Check{Name: CheckPush, Status: CheckPassed, Detail: "uploaded and deleted a test blob"}, nil
+}
+
+func (registry *Registry) checkOciArtifacts(ctx context.Context, repositoryName string) Check {
+	err := registry.ProbeOciArtifactSupport(ctx, repositoryName)
+	if errors.Is(err, RegistryNotSupportingOciArtifacts) {
+		return Check{Name: CheckOciArtifacts, Status: CheckFailed, Detail: fmt.Sprintf("%v, SOCI index manifest v2 can't be pushed here", err)}
+	} else if err != nil {
+		return Check{Name: CheckOciArtifacts, Status: CheckFailed, Detail: err.Error()}
+	}
+	return Check{Name: CheckOciArtifacts, Status: CheckPassed, Detail: "accepted an OCI image index with a SOCI index manifest"}
+}
+
+// The referrers API answers with an OCI image index even for digests without referrers. 404 means it's not supported.
+func (registry *Registry) checkReferrers(ctx context.Context, repositoryName string) Check {
+	ref := registry.registry.Reference
+	ref.Repository = repositoryName
+	ctx = auth.AppendRepositoryScope(ctx, ref, auth.ActionPull)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registry.url(fmt.Sprintf("/v2/%s/referrers/%s", repositoryName, digest.FromBytes(emptyJSON))), nil)
+	if err != nil {
+		return Check{Name: CheckReferrers, Status: CheckFailed, Detail: err.Error()}
+	}
+	req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+	resp, err := registry.registry.RepositoryOptions.Client.Do(req)
+	if err != nil {
+		return Check{Name: CheckReferrers, Status: CheckWarning, Detail: describeFailure(nil, err)}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	switch {
+	case resp.StatusCode == http.StatusOK && mediaType == ocispec.MediaTypeImageIndex:
+		return Check{Name: CheckReferrers, Status: CheckPassed, Detail: "supported"}
+	case resp.StatusCode == http.StatusNotFound:
+		return Check{Name: CheckReferrers, Status: CheckWarning, Detail: "not supported, referrers are stored with the referrers tag schema"}
+	default:
+		return Check{Name: CheckReferrers, Status: CheckWarning, Detail: fmt.Sprintf("unexpected answer %d %s", resp.StatusCode, mediaType)}
+	}
+}
+
+// Point a throwaway tag at one manifest and then another. The manifests are deleted afterwards, which drops the tag.
+func (registry *Registry) checkTagMutability(ctx context.Context, repositoryName string) Check {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return Check{Name: CheckTagMutability, Status: CheckFailed, Detail: err.Error()}
+	}
+
+	probeStore := memory.New()
+	indexDesc, manifestDesc, err := buildArtifactProbe(ctx, probeStore)
+	if err != nil {
+		return Check{Name: CheckTagMutability, Status: CheckFailed, Detail: err.Error()}
+	}
+	if err := oras.CopyGraph(ctx, probeStore, repo, indexDesc, oras.DefaultCopyGraphOptions); err != nil {
+		return Check{Name: CheckTagMutability, Status: CheckFailed, Detail: err.Error()}
+	}
+
+	tag := doctorTagPrefix + randomHex()
+	check := Check{Name: CheckTagMutability, Status: CheckPassed, Detail: "tags can be moved"}
+	if err := repo.Tag(ctx, manifestDesc, tag); err != nil {
+		check = Check{Name: CheckTagMutability, Status: CheckFailed, Detail: fmt.Sprintf("couldn't push a tag: %v", err)}
+	} else if err := repo.Tag(ctx, indexDesc, tag); err != nil {
+		check = Check{Name: CheckTagMutability, Status: CheckFailed, Detail: fmt.Sprintf("tags are immutable, existing tags can't be replaced with the indexed image, use --new-tag with new tags: %v", err)}
+	}
+
+	for _, desc := range []ocispec.Descriptor{indexDesc, manifestDesc} {
+		if err := repo.Delete(ctx, desc); err != nil {
+			check.Detail += fmt.Sprintf(" (couldn't delete test tag %s: %v)", tag, err)
+			break
+		}
+	}
+	return check
+}
+
+// Build a URL on the upstream registry host
+func (registry *Registry) url(path string) string {
+	scheme := "https"
+	if registry.registry.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, registry.registry.Reference.Host(), path)
+}
+
+func randomHex() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,165 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*testRegistry)
+		reference string
+		expected  map[string]CheckStatus
+	}{
+		{
+			name:  "everything supported",
+			setup: func(registry *testRegistry) { registry.referrers = true },
+			expected: map[string]CheckStatus{
+				CheckDNS:            CheckPassed,
+				CheckReachability:   CheckPassed,
+				CheckAuthentication: CheckPassed,
+				CheckPull:           CheckPassed,
+				CheckPush:           CheckPassed,
+				CheckOciArtifacts:   CheckPassed,
+				CheckReferrers:      CheckPassed,
+				CheckTagMutability:  CheckPassed,
+			},
+		},
+		{
+			name:      "missing image, no referrers API and immutable tags",
+			setup:     func(registry *testRegistry) { registry.immutableTags = true },
+			reference: "missing",
+			expected: map[string]CheckStatus{
+				CheckPull:          CheckFailed,
+				CheckPush:          CheckPassed,
+				CheckOciArtifacts:  CheckPassed,
+				CheckReferrers:     CheckWarning,
+				CheckTagMutability: CheckFailed,
+			},
+		},
+		{
+			name: "no OCI image index support",
+			setup: func(registry *testRegistry) {
+				registry.rejectManifest = func(w http.ResponseWriter, mediaType string) bool {
+					writeErrorResponse(w, http.StatusMethodNotAllowed, errcode.ErrorCodeUnsupported, "Invalid parameter at 'ImageManifest'")
+					return true
+				}
+			},
+			expected: map[string]CheckStatus{
+				CheckPush:          CheckPassed,
+				CheckOciArtifacts:  CheckFailed,
+				CheckTagMutability: CheckSkipped,
+			},
+		},
+		{
+			name:  "push denied",
+			setup: func(registry *testRegistry) { registry.rejectUploads = true },
+			expected: map[string]CheckStatus{
+				CheckAuthentication: CheckWarning,
+				CheckPull:           CheckPassed,
+				CheckPush:           CheckFailed,
+				CheckOciArtifacts:   CheckSkipped,
+				CheckReferrers:      CheckWarning,
+				CheckTagMutability:  CheckSkipped,
+			},
+		},
+		{
+			name:  "credentials rejected",
+			setup: func(registry *testRegistry) { registry.rejectCredentials = true },
+			expected: map[string]CheckStatus{
+				CheckReachability:   CheckPassed,
+				CheckAuthentication: CheckFailed,
+				CheckPull:           CheckFailed,
+				CheckPush:           CheckFailed,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, host := newTestRegistry(t)
+			test.setup(server)
+
+			checks := Diagnose(context.Background(), host, "", "repo", test.reference,
+				WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1)),
+				WithHostConfig(host, HostConfig{PlainHTTP: Bool(true)}),
+			)
+
+			if len(checks) != 8 {
+				t.Fatalf("expected 8 checks, got %#v", checks)
+			}
+			for _, check := range checks {
+				if expected, ok := test.expected[check.Name]; ok && check.Status != expected {
+					t.Errorf("expected %s to be %s, got %s: %s", check.Name, expected, check.Status, check.Detail)
+				}
+			}
+			for ref := range server.manifests {
+				if strings.HasPrefix(ref, doctorTagPrefix) {
+					t.Errorf("test tag %s left behind", ref)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnoseUnknownHost(t *testing.T) {
+	checks := Diagnose(context.Background(), "registry.invalid", "", "repo", "")
+	if checks[0].Name != CheckDNS || checks[0].Status != CheckFailed {
+		t.Fatalf("expected DNS check to fail, got %#v", checks[0])
+	}
+	for _, check := range checks[1:] {
+		if check.Status != CheckSkipped {
+			t.Errorf("expected %s to be skipped, got %s", check.Name, check.Status)
+		}
+	}
+}
+
+func TestAuthMethod(t *testing.T) {
+	_, host := newTestRegistry(t)
+	_, otherHost := newTestRegistry(t)
+
+	dockerConfig := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dockerConfig)
+	config := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, otherHost, base64.StdEncoding.EncodeToString([]byte("user:password")))
+	if err := os.WriteFile(filepath.Join(dockerConfig, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host         string
+		authToken    string
+		dockerConfig bool
+		expected     string
+	}{
+		{host, "", true, AuthMethodAnonymous},
+		{host, "user:password", true, AuthMethodToken},
+		{otherHost, "", true, AuthMethodDockerConfig},
+		{otherHost, "", false, AuthMethodAnonymous},
+		{otherHost, "user:password", true, AuthMethodToken},
+	}
+	for _, test := range tests {
+		opts := []Option{WithHostConfig(test.host, HostConfig{PlainHTTP: Bool(true)})}
+		if test.dockerConfig {
+			opts = append(opts, WithDockerConfig())
+		}
+		registry, err := Init(context.Background(), test.host, test.authToken, opts...)
+		if err != nil {
+			t.Fatalf("Init returned error: %v", err)
+		}
+		if registry.AuthMethod() != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, registry.AuthMethod())
+		}
+	}
+}
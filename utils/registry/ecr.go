@@ -0,0 +1,235 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// EcrHost is the information encoded in a private ECR registry hostname
+type EcrHost struct {
+	AccountID string
+	Region    string
+	Partition string
+	FIPS      bool
+	DualStack bool
+}
+
+// AwsConfig selects the AWS credentials used to authorize with ECR
+type AwsConfig struct {
+	// Profile is a shared config profile name, like AWS_PROFILE
+	Profile string
+	// RoleARN is assumed with STS before calling ECR, for registries in other accounts
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+}
+
+const defaultRoleSessionName = "standalone-soci-indexer"
+
+func (awsConfig AwsConfig) merge(other AwsConfig) AwsConfig {
+	if other.Profile != "" {
+		awsConfig.Profile = other.Profile
+	}
+	if other.RoleARN != "" {
+		awsConfig.RoleARN = other.RoleARN
+	}
+	if other.ExternalID != "" {
+		awsConfig.ExternalID = other.ExternalID
+	}
+	if other.RoleSessionName != "" {
+		awsConfig.RoleSessionName = other.RoleSessionName
+	}
+	return awsConfig
+}
+
+// Load AWS configuration for the region, using the profile and role when set
+func (awsConfig AwsConfig) load(ctx context.Context, region string) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if awsConfig.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(awsConfig.Profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if awsConfig.RoleARN != "" {
+		log.Info(ctx, fmt.Sprintf("Assuming role %s", awsConfig.RoleARN))
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), awsConfig.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = awsConfig.RoleSessionName
+			if o.RoleSessionName == "" {
+				o.RoleSessionName = defaultRoleSessionName
+			}
+			if awsConfig.ExternalID != "" {
+				o.ExternalID = aws.String(awsConfig.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+// Private ECR registry hostnames in all partitions, including FIPS and dual-stack variants:
+//
+//	123456789012.dkr.ecr.us-east-1.amazonaws.com
+//	123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com
+//	123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn
+//	123456789012.dkr-ecr.us-east-1.on.aws
+//	123456789012.dkr-ecr-fips.us-east-1.on.aws
+//	123456789012.dkr-ecr.cn-north-1.on.amazonwebservices.com.cn
+var ecrHostRegex = regexp.MustCompile(`^(\d{12})\.dkr([.-])ecr(-fips)?\.([a-z0-9][a-z0-9-]*)\.(amazonaws\.com(?:\.cn)?|on\.aws|on\.amazonwebservices\.com\.cn|c2s\.ic\.gov|sc2s\.sgov\.gov|cloud\.adc-e\.uk|csp\.hci\.ic\.gov)$`)
+
+// ParseEcrHost extracts the account, region, partition and endpoint variant from a private ECR registry hostname.
+// It returns false for anything that isn't a private ECR registry.
+func ParseEcrHost(registryUrl string) (EcrHost, bool) {
+	host := strings.ToLower(registryUrl)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	match := ecrHostRegex.FindStringSubmatch(host)
+	if match == nil {
+		return EcrHost{}, false
+	}
+
+	accountID, separator, fips, region, domain := match[1], match[2], match[3], match[4], match[5]
+	dualStack := separator == "-"
+	// dual-stack hosts use dkr-ecr and legacy hosts use dkr.ecr, never a mix of the two
+	if dualStack != strings.HasPrefix(domain, "on.") {
+		return EcrHost{}, false
+	}
+
+	return EcrHost{
+		AccountID: accountID,
+		Region:    region,
+		Partition: ecrPartition(region, domain),
+		FIPS:      fips != "",
+		DualStack: dualStack,
+	}, true
+}
+
+func ecrPartition(region string, domain string) string {
+	switch {
+	case strings.HasSuffix(domain, ".cn"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case domain == "c2s.ic.gov":
+		return "aws-iso"
+	case domain == "sc2s.sgov.gov":
+		return "aws-iso-b"
+	case domain == "cloud.adc-e.uk":
+		return "aws-iso-e"
+	case domain == "csp.hci.ic.gov":
+		return "aws-iso-f"
+	default:
+		return "aws"
+	}
+}
+
+// Check if a registry is an ECR registry
+func isEcrRegistry(registryUrl string) bool {
+	_, ok := ParseEcrHost(registryUrl)
+	return ok
+}
+
+// Authorize ECR registry
+func authorizeEcr(ctx context.Context, ecrRegistry *remote.Registry, registryUrl string, awsConfig AwsConfig, httpClient *http.Client) error {
+	ecrHost, ok := ParseEcrHost(registryUrl)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+	log.Info(ctx, fmt.Sprintf("Authorizing with ECR registry %s in %s (%s)", ecrHost.AccountID, ecrHost.Region, ecrHost.Partition))
+
+	cfg, err := awsConfig.load(ctx, ecrHost.Region)
+	if err != nil {
+		return err
+	}
+
+	ecrEndpoint := os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
+	ecrClient := ecr.NewFromConfig(cfg, func(o *ecr.Options) {
+		if ecrEndpoint != "" {
+			o.BaseEndpoint = aws.String(ecrEndpoint)
+		}
+		if ecrHost.FIPS {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+		if ecrHost.DualStack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+	})
+
+	credential := newCachedCredential(func(ctx context.Context) (auth.Credential, time.Time, error) {
+		return fetchEcrCredential(ctx, ecrClient, ecrHost.AccountID)
+	})
+	// fail early if we can't authorize at all
+	if _, err := credential.Get(ctx); err != nil {
+		return err
+	}
+
+	ecrRegistry.RepositoryOptions.Client = &basicAuthClient{
+		client: &auth.Client{
+			Client: httpClient,
+			Header: http.Header{
+				"User-Agent": {userAgent},
+			},
+		},
+		credential: credential,
+	}
+	return nil
+}
+
+// Get an authorization token for the account from ECR
+func fetchEcrCredential(ctx context.Context, ecrClient *ecr.Client, accountID string) (auth.Credential, time.Time, error) {
+	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []string{accountID},
+	})
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, err
+	}
+
+	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
+		return auth.EmptyCredential, time.Time{}, errors.New("Couldn't authorize with ECR: empty authorization data returned")
+	}
+
+	authorizationData := getAuthorizationTokenResponse.AuthorizationData[0]
+	if authorizationData.AuthorizationToken == nil || len(*authorizationData.AuthorizationToken) == 0 {
+		return auth.EmptyCredential, time.Time{}, errors.New("Couldn't authorize with ECR: empty authorization token returned")
+	}
+
+	credential, err := decodeBasicAuthToken(*authorizationData.AuthorizationToken)
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, err
+	}
+	return credential, tokenExpiry(authorizationData.ExpiresAt), nil
+}
+
+// ECR tokens last 12 hours, which is assumed when the API doesn't say
+func tokenExpiry(expiresAt *time.Time) time.Time {
+	if expiresAt == nil {
+		return time.Now().Add(12 * time.Hour)
+	}
+	return *expiresAt
+}
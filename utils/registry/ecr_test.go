@@ -0,0 +1,120 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"testing"
+)
+
+func TestParseEcrHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected EcrHost
+		ok       bool
+	}{
+		{
+			host:     "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-east-1", Partition: "aws"},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr.us-east-1.amazonaws.com:443",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-east-1", Partition: "aws"},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr-fips.us-east-1.amazonaws.com",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-east-1", Partition: "aws", FIPS: true},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			expected: EcrHost{AccountID: "123456789012", Region: "cn-north-1", Partition: "aws-cn"},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr.us-gov-west-1.amazonaws.com",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-gov-west-1", Partition: "aws-us-gov"},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr-fips.us-gov-east-1.amazonaws.com",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-gov-east-1", Partition: "aws-us-gov", FIPS: true},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr-ecr.eu-west-1.on.aws",
+			expected: EcrHost{AccountID: "123456789012", Region: "eu-west-1", Partition: "aws", DualStack: true},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr-ecr-fips.us-gov-west-1.on.aws",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-gov-west-1", Partition: "aws-us-gov", FIPS: true, DualStack: true},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr-ecr.cn-northwest-1.on.amazonwebservices.com.cn",
+			expected: EcrHost{AccountID: "123456789012", Region: "cn-northwest-1", Partition: "aws-cn", DualStack: true},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.dkr.ecr.us-iso-east-1.c2s.ic.gov",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-iso-east-1", Partition: "aws-iso"},
+			ok:       true,
+		},
+		{
+			host:     "123456789012.DKR.ECR.US-WEST-2.AMAZONAWS.COM",
+			expected: EcrHost{AccountID: "123456789012", Region: "us-west-2", Partition: "aws"},
+			ok:       true,
+		},
+		{host: "public.ecr.aws"},
+		{host: "docker.io"},
+		{host: "localhost:5000"},
+		{host: "12345678901.dkr.ecr.us-east-1.amazonaws.com"},
+		{host: "123456789012.dkr.ecr.us-east-1.amazonaws.com.evil.example.com"},
+		{host: "mirror.example.com/123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{host: "123456789012.dkr.ecr.us-east-1.on.aws"},
+		{host: "123456789012.dkr-ecr.us-east-1.amazonaws.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			ecrHost, ok := ParseEcrHost(test.host)
+			if ok != test.ok {
+				t.Fatalf("expected ok=%t, got %t", test.ok, ok)
+			}
+			if ecrHost != test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, ecrHost)
+			}
+			if isEcrRegistry(test.host) != test.ok {
+				t.Fatalf("isEcrRegistry disagrees with ParseEcrHost")
+			}
+		})
+	}
+}
+
+func TestAwsConfigPerHost(t *testing.T) {
+	source := "111111111111.dkr.ecr.us-east-1.amazonaws.com"
+	destination := "222222222222.dkr.ecr.eu-west-1.amazonaws.com"
+
+	o := defaultOptions()
+	WithHostConfig(AllHosts, HostConfig{Aws: AwsConfig{Profile: "ci"}})(&o)
+	WithHostConfig(source, HostConfig{Aws: AwsConfig{RoleARN: "arn:aws:iam::111111111111:role/reader"}})(&o)
+	WithHostConfig(destination, HostConfig{Aws: AwsConfig{RoleARN: "arn:aws:iam::222222222222:role/writer", ExternalID: "secret-id"}})(&o)
+
+	tests := []struct {
+		host     string
+		expected AwsConfig
+	}{
+		{source, AwsConfig{Profile: "ci", RoleARN: "arn:aws:iam::111111111111:role/reader"}},
+		{destination, AwsConfig{Profile: "ci", RoleARN: "arn:aws:iam::222222222222:role/writer", ExternalID: "secret-id"}},
+		{"333333333333.dkr.ecr.us-west-2.amazonaws.com", AwsConfig{Profile: "ci"}},
+	}
+
+	for _, test := range tests {
+		if awsConfig := o.hostConfig(test.host).Aws; awsConfig != test.expected {
+			t.Errorf("unexpected AWS config for %s: %+v", test.host, awsConfig)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+const (
+	EcrPublicHost = "public.ecr.aws"
+
+	// ECR Public only has an API endpoint in us-east-1
+	ecrPublicRegion = "us-east-1"
+)
+
+// Check if a registry is ECR Public
+func isEcrPublicRegistry(registryUrl string) bool {
+	host := strings.ToLower(registryUrl)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == EcrPublicHost
+}
+
+// ecrPublicCredential returns credentials for ECR Public. Pulls stay anonymous so pull-only runs don't
+// need AWS credentials. An authorization token is only fetched the first time a push needs one.
+func ecrPublicCredential(awsConfig AwsConfig) auth.CredentialFunc {
+	credential := newCachedCredential(func(ctx context.Context) (auth.Credential, time.Time, error) {
+		return fetchEcrPublicCredential(ctx, awsConfig)
+	})
+
+	return func(ctx context.Context, hostport string) (auth.Credential, error) {
+		if !needsPush(ctx, hostport) {
+			return auth.EmptyCredential, nil
+		}
+		return credential.Get(ctx)
+	}
+}
+
+// needsPush checks if any repository scope requested for the host includes the push action
+func needsPush(ctx context.Context, hostport string) bool {
+	for _, scope := range auth.GetAllScopesForHost(ctx, hostport) {
+		i := strings.LastIndex(scope, ":")
+		if i < 0 {
+			continue
+		}
+		if slices.Contains(strings.Split(scope[i+1:], ","), auth.ActionPush) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get an authorization token from the ECR Public API
+func fetchEcrPublicCredential(ctx context.Context, awsConfig AwsConfig) (auth.Credential, time.Time, error) {
+	log.Info(ctx, "Authorizing with ECR Public")
+
+	cfg, err := awsConfig.load(ctx, ecrPublicRegion)
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, err
+	}
+
+	response, err := ecrpublic.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, fmt.Errorf("failed to get ECR Public authorization token: %w", err)
+	}
+	if response.AuthorizationData == nil || response.AuthorizationData.AuthorizationToken == nil {
+		return auth.EmptyCredential, time.Time{}, errors.New("Couldn't authorize with ECR Public: empty authorization token returned")
+	}
+
+	credential, err := decodeBasicAuthToken(*response.AuthorizationData.AuthorizationToken)
+	if err != nil {
+		return auth.EmptyCredential, time.Time{}, err
+	}
+	return credential, tokenExpiry(response.AuthorizationData.ExpiresAt), nil
+}
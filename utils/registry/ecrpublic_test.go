@@ -0,0 +1,63 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestIsEcrPublicRegistry(t *testing.T) {
+	tests := map[string]bool{
+		"public.ecr.aws":     true,
+		"PUBLIC.ECR.AWS":     true,
+		"public.ecr.aws:443": true,
+		"gallery.ecr.aws":    false,
+		"docker.io":          false,
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": false,
+	}
+
+	for host, expected := range tests {
+		if isEcrPublicRegistry(host) != expected {
+			t.Errorf("isEcrPublicRegistry(%s) should be %t", host, expected)
+		}
+	}
+}
+
+func TestEcrPublicCredentialStaysAnonymousForPulls(t *testing.T) {
+	credential := ecrPublicCredential(AwsConfig{})
+
+	ctx := auth.AppendScopesForHost(context.Background(), EcrPublicHost, auth.ScopeRepository("alias/repo", auth.ActionPull))
+	cred, err := credential(ctx, EcrPublicHost)
+	if err != nil {
+		t.Fatalf("credential returned error: %v", err)
+	}
+	if cred != auth.EmptyCredential {
+		t.Fatalf("expected anonymous credential for pull, got %+v", cred)
+	}
+}
+
+func TestNeedsPush(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		expected bool
+	}{
+		{"no scopes", nil, false},
+		{"pull", []string{auth.ScopeRepository("alias/repo", auth.ActionPull)}, false},
+		{"pull and push", []string{auth.ScopeRepository("alias/repo", auth.ActionPull, auth.ActionPush)}, true},
+		{"mount from another repository", []string{auth.ScopeRepository("alias/other", auth.ActionPull), auth.ScopeRepository("alias/repo", auth.ActionPush)}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := auth.WithScopesForHost(context.Background(), EcrPublicHost, test.scopes...)
+			if needsPush(ctx, EcrPublicHost) != test.expected {
+				t.Fatalf("expected needsPush to be %t for %v", test.expected, test.scopes)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/errdefs"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// registryHost is one endpoint serving a registry, either the registry itself or a mirror
+type registryHost struct {
+	host         string
+	plainHTTP    bool
+	transport    http.RoundTripper
+	capabilities docker.HostCapabilities
+}
+
+// mirror is a remote registry that is tried before the upstream registry for pulls and resolves
+type mirror struct {
+	registry     *remote.Registry
+	capabilities docker.HostCapabilities
+}
+
+// WithHostsDir reads containerd style <dir>/<host>/hosts.toml files to find mirrors and TLS settings
+func WithHostsDir(dir string) Option {
+	return func(o *options) {
+		o.hostsDir = dir
+	}
+}
+
+// registryHosts returns the endpoints for a registry in the order they should be tried.
+// Without a hosts.toml for the registry, that is just the registry itself.
+func (o *options) registryHosts(ctx context.Context, registryUrl string) ([]registryHost, error) {
+	hostConfig := o.hostConfig(registryUrl)
+	transport, err := hostConfig.transport()
+	if err != nil {
+		return nil, err
+	}
+	defaultHosts := []registryHost{{
+		host:         registryUrl,
+		plainHTTP:    hostConfig.usePlainHTTP(),
+		transport:    transport,
+		capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+	}}
+
+	if o.hostsDir == "" {
+		return defaultHosts, nil
+	}
+
+	hostDir := config.HostDirFromRoot(o.hostsDir)
+	if dir, err := hostDir(registryUrl); err != nil {
+		if errdefs.IsNotFound(err) {
+			return defaultHosts, nil
+		}
+		return nil, err
+	} else {
+		log.Info(ctx, fmt.Sprintf("Using host configuration from %s", dir))
+	}
+
+	tlsConfig, err := hostConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	defaultScheme := "https"
+	if hostConfig.usePlainHTTP() {
+		defaultScheme = "http"
+	}
+
+	configuredHosts, err := config.ConfigureHosts(ctx, config.HostOptions{
+		HostDir:       hostDir,
+		DefaultTLS:    tlsConfig,
+		DefaultScheme: defaultScheme,
+	})(registryUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts.toml for %s: %w", registryUrl, err)
+	}
+	if len(configuredHosts) == 0 {
+		return nil, fmt.Errorf("hosts.toml for %s does not configure any host", registryUrl)
+	}
+
+	var hosts []registryHost
+	for _, configuredHost := range configuredHosts {
+		namespace := ""
+		if configuredHost.Host != registryUrl && !(registryUrl == "docker.io" && configuredHost.Host == "registry-1.docker.io") {
+			namespace = registryUrl
+		}
+		hosts = append(hosts, registryHost{
+			host:      configuredHost.Host,
+			plainHTTP: configuredHost.Scheme == "http",
+			transport: &hostsTransport{
+				base:      configuredHost.Client.Transport,
+				host:      configuredHost.Host,
+				path:      configuredHost.Path,
+				header:    configuredHost.Header,
+				namespace: namespace,
+			},
+			capabilities: configuredHost.Capabilities,
+		})
+	}
+	return hosts, nil
+}
+
+// hostsTransport applies hosts.toml settings to requests sent to a configured host
+type hostsTransport struct {
+	base http.RoundTripper
+	host string
+	// path is the API root, "/v2" unless override_path is used
+	path   string
+	header http.Header
+	// namespace is the upstream registry, passed as ns to mirrors like containerd does
+	namespace string
+}
+
+func (t *hostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// token endpoints and blob redirects live elsewhere
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if t.path != "" && t.path != "/v2" && strings.HasPrefix(req.URL.Path, "/v2/") {
+		req.URL.Path = t.path + strings.TrimPrefix(req.URL.Path, "/v2")
+		req.URL.RawPath = ""
+	}
+	if t.namespace != "" {
+		query := req.URL.Query()
+		query.Set("ns", t.namespace)
+		req.URL.RawQuery = query.Encode()
+	}
+	for key, values := range t.header {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newMirrors creates clients for all hosts but the upstream one. Their credentials are resolved like the ones of the
+// upstream registry, for the mirror host: its auth token, a credential provider or docker config.
+func newMirrors(ctx context.Context, hosts []registryHost, upstream int, o *options) ([]mirror, error) {
+	var mirrors []mirror
+	for i, host := range hosts {
+		if i == upstream || host.capabilities&(docker.HostCapabilityPull|docker.HostCapabilityResolve) == 0 {
+			continue
+		}
+		registry, err := remote.NewRegistry(host.host)
+		if err != nil {
+			return nil, err
+		}
+		registry.PlainHTTP = host.plainHTTP
+		registry.RepositoryOptions.Client, err = o.mirrorClient(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, mirror{registry: registry, capabilities: host.capabilities})
+	}
+	return mirrors, nil
+}
+
+// Build the client of a mirror. Credentials that fail make the mirror fail, so the next host is tried.
+func (o *options) mirrorClient(ctx context.Context, host registryHost) (remote.Client, error) {
+	httpClient := o.httpClient(host.transport)
+	if o.hostAuth != nil {
+		authToken, err := o.hostAuth(host.host)
+		if err != nil {
+			return nil, err
+		}
+		if authToken != "" {
+			log.Info(ctx, fmt.Sprintf("Using auth token for mirror %s", host.host))
+			return newTokenClient(httpClient, authToken), nil
+		}
+	}
+
+	client := &auth.Client{
+		Client: httpClient,
+		Header: http.Header{
+			"User-Agent": {userAgent},
+		},
+		Cache: auth.NewCache(),
+	}
+	if provider, ok := o.credentialProviderFor(host.host); ok {
+		credential := provider.credential(host.host, o.imageOn(host.host))
+		client.Credential = func(ctx context.Context, hostport string) (auth.Credential, error) {
+			return credential.Get(ctx)
+		}
+	} else if o.dockerConfig {
+		if credential, ok := dockerConfigCredential(ctx, host.host); ok {
+			client.Credential = auth.StaticCredential(host.host, credential)
+		}
+	}
+	return client, nil
+}
+
+// upstreamHost picks the host that receives pushes and credentials: the first one that can push, or the last one
+func upstreamHost(hosts []registryHost) int {
+	for i, host := range hosts {
+		if host.capabilities&docker.HostCapabilityPush != 0 {
+			return i
+		}
+	}
+	return len(hosts) - 1
+}
+
+// withMirrors calls fn with every mirror that has all the capabilities and then with the upstream registry,
+// returning the first success. Failures on mirrors are logged and the next host is tried.
+func (registry *Registry) withMirrors(ctx context.Context, capability docker.HostCapabilities, fn func(*remote.Registry) error) error {
+	var errs []error
+	for _, m := range registry.mirrors {
+		if m.capabilities&capability != capability {
+			continue
+		}
+		err := fn(m.registry)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Warn(ctx, fmt.Sprintf("Mirror %s failed, trying next host: %v", m.registry.Reference.Registry, err))
+		errs = append(errs, err)
+	}
+
+	err := fn(registry.registry)
+	if err != nil && len(errs) > 0 {
+		return errors.Join(append([]error{err}, errs...)...)
+	}
+	return err
+}
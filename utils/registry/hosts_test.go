@@ -0,0 +1,227 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostsDirMirrors(t *testing.T) {
+	tests := []struct {
+		name             string
+		mirrorStatus     int
+		overridePath     bool
+		capabilities     string
+		expectedMirror   int
+		expectedUpstream int
+	}{
+		{
+			name:           "resolves through mirror",
+			mirrorStatus:   http.StatusOK,
+			capabilities:   `["pull", "resolve"]`,
+			expectedMirror: 1,
+		},
+		{
+			name:           "resolves through mirror with overridden path",
+			mirrorStatus:   http.StatusOK,
+			overridePath:   true,
+			capabilities:   `["pull", "resolve"]`,
+			expectedMirror: 1,
+		},
+		{
+			name:             "falls back to upstream when mirror fails",
+			mirrorStatus:     http.StatusNotFound,
+			capabilities:     `["pull", "resolve"]`,
+			expectedMirror:   1,
+			expectedUpstream: 1,
+		},
+		{
+			name:             "skips mirror without resolve capability",
+			mirrorStatus:     http.StatusOK,
+			capabilities:     `["pull"]`,
+			expectedUpstream: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamCalls := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls++
+				newManifestHandler().ServeHTTP(w, r)
+			}))
+			defer upstream.Close()
+			upstreamHost := hostOf(t, upstream.URL)
+
+			mirrorCalls := 0
+			mirrorPath := "/v2/repo/manifests/latest"
+			if test.overridePath {
+				mirrorPath = "/cache/repo/manifests/latest"
+			}
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mirrorCalls++
+				if r.URL.Path != mirrorPath {
+					t.Errorf("unexpected mirror path: %s", r.URL.Path)
+				}
+				if r.URL.Query().Get("ns") != upstreamHost {
+					t.Errorf("unexpected ns parameter: %s", r.URL.RawQuery)
+				}
+				if r.Header.Get("X-Mirror-Test") != "yes" {
+					t.Errorf("missing configured header")
+				}
+				if test.mirrorStatus != http.StatusOK {
+					w.WriteHeader(test.mirrorStatus)
+					return
+				}
+				newManifestHandler().ServeHTTP(w, r)
+			}))
+			defer mirror.Close()
+
+			mirrorUrl := mirror.URL
+			if test.overridePath {
+				mirrorUrl += "/cache"
+			}
+			hostsToml := fmt.Sprintf(`server = "%s"
+
+[host."%s"]
+  capabilities = %s
+  override_path = %t
+  [host."%s".header]
+    x-mirror-test = "yes"
+`, upstream.URL, mirrorUrl, test.capabilities, test.overridePath, mirrorUrl)
+
+			hostsDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(hostsDir, upstreamHost), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(hostsDir, upstreamHost, "hosts.toml"), []byte(hostsToml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			registry, err := Init(context.Background(), upstreamHost, "",
+				WithHostsDir(hostsDir),
+				WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1)),
+			)
+			if err != nil {
+				t.Fatalf("Init returned error: %v", err)
+			}
+
+			desc, err := registry.HeadManifest(context.Background(), "repo", "latest")
+			if err != nil {
+				t.Fatalf("HeadManifest returned error: %v", err)
+			}
+			if desc.Digest.String() != testManifestDigest {
+				t.Fatalf("unexpected digest: %s", desc.Digest)
+			}
+			if mirrorCalls != test.expectedMirror || upstreamCalls != test.expectedUpstream {
+				t.Fatalf("expected %d mirror and %d upstream calls, got %d and %d", test.expectedMirror, test.expectedUpstream, mirrorCalls, upstreamCalls)
+			}
+
+			// tags are checked before replacing them without the mirrors, which can hold stale tags
+			if _, err := registry.ResolveUpstream(context.Background(), "repo", "latest"); err != nil {
+				t.Fatalf("ResolveUpstream returned error: %v", err)
+			}
+			if mirrorCalls != test.expectedMirror || upstreamCalls != test.expectedUpstream+1 {
+				t.Fatalf("expected only the upstream registry to resolve, got %d mirror and %d upstream calls", mirrorCalls, upstreamCalls)
+			}
+		})
+	}
+}
+
+func TestHostsDirMirrorCredentials(t *testing.T) {
+	tests := []struct {
+		name         string
+		hostAuth     bool
+		dockerConfig bool
+	}{
+		{name: "auth token for the mirror host", hostAuth: true},
+		{name: "docker config", dockerConfig: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamCalls := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls++
+				newManifestHandler().ServeHTTP(w, r)
+			}))
+			defer upstream.Close()
+			upstreamHost := hostOf(t, upstream.URL)
+
+			mirrorCalls := 0
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if username, password, ok := r.BasicAuth(); !ok || username != "mirror" || password != "secret" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				mirrorCalls++
+				newManifestHandler().ServeHTTP(w, r)
+			}))
+			defer mirror.Close()
+			mirrorHost := hostOf(t, mirror.URL)
+
+			hostsDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(hostsDir, upstreamHost), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			hostsToml := fmt.Sprintf("server = %q\n\n[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n", upstream.URL, mirror.URL)
+			if err := os.WriteFile(filepath.Join(hostsDir, upstreamHost, "hosts.toml"), []byte(hostsToml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			dockerConfig := t.TempDir()
+			t.Setenv("DOCKER_CONFIG", dockerConfig)
+			opts := []Option{
+				WithHostsDir(hostsDir),
+				WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1)),
+				// the token of the registry is never sent to mirrors
+				WithHostAuth(func(host string) (string, error) {
+					if test.hostAuth && host == mirrorHost {
+						return "mirror:secret", nil
+					}
+					return "", nil
+				}),
+			}
+			if test.dockerConfig {
+				config := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, mirrorHost, base64.StdEncoding.EncodeToString([]byte("mirror:secret")))
+				if err := os.WriteFile(filepath.Join(dockerConfig, "config.json"), []byte(config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				opts = append(opts, WithDockerConfig())
+			}
+
+			registry, err := Init(context.Background(), upstreamHost, "upstream:token", opts...)
+			if err != nil {
+				t.Fatalf("Init returned error: %v", err)
+			}
+			if _, err := registry.HeadManifest(context.Background(), "repo", "latest"); err != nil {
+				t.Fatalf("HeadManifest returned error: %v", err)
+			}
+			if mirrorCalls != 1 || upstreamCalls != 0 {
+				t.Fatalf("expected the mirror to accept its credentials, got %d mirror and %d upstream calls", mirrorCalls, upstreamCalls)
+			}
+		})
+	}
+}
+
+func TestHostsDirWithoutHostConfiguration(t *testing.T) {
+	o := defaultOptions()
+	WithHostsDir(t.TempDir())(&o)
+
+	hosts, err := o.registryHosts(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("registryHosts returned error: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].host != "registry.example.com" {
+		t.Fatalf("unexpected hosts: %#v", hosts)
+	}
+}
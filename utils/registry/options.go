@@ -0,0 +1,99 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"net/http"
+	"strings"
+)
+
+const userAgent = "Standalone SOCI Index Builder (oras-go)"
+
+// Option configures how Init connects to a registry
+type Option func(*options)
+
+type options struct {
+	retryPolicy RetryPolicy
+	hosts       map[string]HostConfig
+	hostsDir    string
+
+	credentialProviders []CredentialProvider
+	// hostAuth resolves the auth token of hosts other than the registry, like mirrors
+	hostAuth func(host string) (string, error)
+	// image is the image the client is for, as registry/repo[:tag]
+	image string
+	// dockerConfig falls back to credentials saved by docker login
+	dockerConfig bool
+}
+
+func defaultOptions() options {
+	return options{
+		retryPolicy: DefaultRetryPolicy,
+		hosts:       map[string]HostConfig{},
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for all registry calls
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithHostConfig sets connection settings for a registry host (host[:port]), or for all hosts with AllHosts.
+// Settings for the same host are merged.
+func WithHostConfig(host string, config HostConfig) Option {
+	return func(o *options) {
+		o.hosts[host] = o.hosts[host].Merge(config)
+	}
+}
+
+// WithDockerConfig falls back to credentials saved by docker login, including docker credential helpers, for
+// registries without other credentials
+func WithDockerConfig() Option {
+	return func(o *options) {
+		o.dockerConfig = true
+	}
+}
+
+// WithHostAuth resolves the auth token of mirror hosts, which don't get the token of the registry. An empty token
+// falls back to credential providers and docker config like for the registry.
+func WithHostAuth(resolve func(host string) (string, error)) Option {
+	return func(o *options) {
+		o.hostAuth = resolve
+	}
+}
+
+// WithImage names the image the client is for, as registry/repo[:tag]. Credential providers get it in their request,
+// like the kubelet sends the image it pulls.
+func WithImage(image string) Option {
+	return func(o *options) {
+		o.image = image
+	}
+}
+
+// imageOn returns the image with its registry replaced by host, like a mirror, or just the host without an image
+func (o *options) imageOn(host string) string {
+	_, name, ok := strings.Cut(o.image, "/")
+	if !ok {
+		return host
+	}
+	return host + "/" + name
+}
+
+// hostConfig returns the settings for a host, layered over the settings for all hosts
+func (o *options) hostConfig(host string) HostConfig {
+	config := o.hosts[AllHosts]
+	if host != AllHosts {
+		config = config.Merge(o.hosts[host])
+	}
+	return config
+}
+
+// Build the HTTP client used for all requests to a registry host
+func (o *options) httpClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: newRetryTransport(transport, o.retryPolicy),
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// Artifact and layer media types of signatures and signed attestations. They sign the digest of their subject,
+// so they can't be moved to another subject without signing again. Plain in-toto statements aren't signed, they're
+// copied like SBOMs.
+var signatureMediaTypes = []string{
+	"application/vnd.cncf.notary.signature",
+	"application/vnd.dev.cosign.artifact.sig",
+	"application/vnd.dev.cosign.simplesigning",
+	"application/vnd.dev.sigstore.bundle",
+	"application/vnd.dsse.envelope",
+}
+
+// Suffixes of the tags cosign uses for artifacts of sha256-<digest hex> when not using the referrers API
+const (
+	cosignSignatureSuffix   = ".sig"
+	cosignAttestationSuffix = ".att"
+	cosignSbomSuffix        = ".sbom"
+)
+
+// ReferrerCopy describes what happened to one referrer of the original image
+type ReferrerCopy struct {
+	// Referrer is the original referrer, ArtifactType is always set
+	Referrer ocispec.Descriptor
+	// Copy refers to the new subject, nil when the referrer couldn't be copied
+	Copy *ocispec.Descriptor
+	// Reason explains why the referrer wasn't copied
+	Reason string
+}
+
+// CopyReferrers attaches a copy of every referrer of from to to, so SBOMs and other artifacts stay discoverable
+// from an image with a new digest. Referrers listed by cosign's sha256-<digest hex>.sbom style tags are copied too.
+// Signatures and signed attestations are returned with a reason instead, because they sign the digest of from.
+func (registry *Registry) CopyReferrers(ctx context.Context, repositoryName string, from ocispec.Descriptor, to ocispec.Descriptor) ([]ReferrerCopy, error) {
+	log.Info(ctx, fmt.Sprintf("Copying referrers of %s to %s", from.Digest, to.Digest))
+
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := registry.Referrers(ctx, repositoryName, from, "")
+	if err != nil {
+		return nil, err
+	}
+
+	subject := ocispec.Descriptor{MediaType: to.MediaType, Digest: to.Digest, Size: to.Size}
+	var copies []ReferrerCopy
+	for _, referrer := range referrers {
+		manifestContent, err := content.FetchAll(ctx, repo, referrer)
+		if err != nil {
+			return copies, err
+		}
+
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+			return copies, fmt.Errorf("failed to decode referrer %s: %w", referrer.Digest, err)
+		}
+		referrer.ArtifactType = manifestArtifactType(manifest)
+
+		if referrer.ArtifactType == soci.SociIndexArtifactTypeV1 {
+			copies = append(copies, ReferrerCopy{Referrer: referrer, Reason: "SOCI index manifest v1 only applies to the original image"})
+			continue
+		}
+		if isSignature(manifest) {
+			copies = append(copies, ReferrerCopy{Referrer: referrer, Reason: fmt.Sprintf("it signs %s and must be signed again for %s", from.Digest, to.Digest)})
+			continue
+		}
+
+		copyContent, err := replaceSubject(manifestContent, subject)
+		if err != nil {
+			return copies, fmt.Errorf("failed to copy referrer %s: %w", referrer.Digest, err)
+		}
+		copyDesc := ocispec.Descriptor{
+			MediaType:    referrer.MediaType,
+			ArtifactType: referrer.ArtifactType,
+			Digest:       digest.FromBytes(copyContent),
+			Size:         int64(len(copyContent)),
+		}
+		// the referrer's blobs are already in the repository, only the manifest changes
+		if err := repo.Push(ctx, copyDesc, bytes.NewReader(copyContent)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return copies, fmt.Errorf("failed to copy referrer %s: %w", referrer.Digest, err)
+		}
+		copies = append(copies, ReferrerCopy{Referrer: referrer, Copy: &copyDesc})
+	}
+
+	cosignCopies, err := registry.copyCosignTags(ctx, repositoryName, from, to)
+	return append(copies, cosignCopies...), err
+}
+
+// cosign without the referrers API points tags derived from the subject digest at its artifacts.
+// Only SBOMs are unsigned and can be tagged for the new digest.
+func (registry *Registry) copyCosignTags(ctx context.Context, repositoryName string, from ocispec.Descriptor, to ocispec.Descriptor) ([]ReferrerCopy, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []ReferrerCopy
+	for _, suffix := range []string{cosignSignatureSuffix, cosignAttestationSuffix, cosignSbomSuffix} {
+		tag := referrersTag(from.Digest) + suffix
+		desc, err := repo.Resolve(ctx, tag)
+		if errors.Is(err, errdef.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return copies, err
+		}
+		desc.ArtifactType = "cosign " + strings.TrimPrefix(suffix, ".")
+
+		if suffix != cosignSbomSuffix {
+			copies = append(copies, ReferrerCopy{Referrer: desc, Reason: fmt.Sprintf("tag %s signs %s and must be signed again for %s", tag, from.Digest, to.Digest)})
+			continue
+		}
+
+		if err := repo.Tag(ctx, desc, referrersTag(to.Digest)+suffix); err != nil {
+			return copies, fmt.Errorf("failed to copy %s: %w", tag, err)
+		}
+		copyDesc := desc
+		copies = append(copies, ReferrerCopy{Referrer: desc, Copy: &copyDesc})
+	}
+	return copies, nil
+}
+
+// The referrers tag schema, also used by cosign, replaces the colon of the digest with a dash
+func referrersTag(dgst digest.Digest) string {
+	return dgst.Algorithm().String() + "-" + dgst.Encoded()
+}
+
+func manifestArtifactType(manifest ocispec.Manifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	return manifest.Config.MediaType
+}
+
+func isSignature(manifest ocispec.Manifest) bool {
+	mediaTypes := []string{manifestArtifactType(manifest)}
+	for _, layer := range manifest.Layers {
+		mediaTypes = append(mediaTypes, layer.MediaType)
+	}
+	for _, mediaType := range mediaTypes {
+		for _, signatureMediaType := range signatureMediaTypes {
+			if strings.HasPrefix(mediaType, signatureMediaType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Point a manifest at another subject, keeping every other field as is
+func replaceSubject(manifestContent []byte, subject ocispec.Descriptor) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(manifestContent, &fields); err != nil {
+		return nil, err
+	}
+	subjectContent, err := json.Marshal(subject)
+	if err != nil {
+		return nil, err
+	}
+	fields["subject"] = subjectContent
+	return json.Marshal(fields)
+}
@@ -0,0 +1,155 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestCopyReferrers(t *testing.T) {
+	for _, referrers := range []bool{true, false} {
+		name := "referrers API"
+		if !referrers {
+			name = "referrers tag schema"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			server, host := newTestRegistry(t)
+			server.referrers = referrers
+			registry := initTestRegistry(t, host)
+
+			ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sociStore := &store.SociStore{Store: ociStore}
+
+			var subjects []ocispec.Descriptor
+			for _, operatingSystem := range []string{"linux", "windows"} {
+				subject := pushTestManifest(t, sociStore, ocispec.Manifest{
+					Versioned: specs.Versioned{SchemaVersion: 2},
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    pushTestContent(t, sociStore, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"`+operatingSystem+`"}`)),
+					Layers:    []ocispec.Descriptor{},
+				})
+				if err := registry.Push(ctx, sociStore, subject, "repo"); err != nil {
+					t.Fatalf("Push returned error: %v", err)
+				}
+				subjects = append(subjects, subject)
+			}
+			from, to := subjects[0], subjects[1]
+
+			emptyConfig := pushTestContent(t, sociStore, ocispec.MediaTypeEmptyJSON, emptyJSON)
+			referrer := func(artifactType string, layerMediaType string, content string) ocispec.Descriptor {
+				return pushTestManifest(t, sociStore, ocispec.Manifest{
+					Versioned:    specs.Versioned{SchemaVersion: 2},
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: artifactType,
+					Config:       emptyConfig,
+					Layers:       []ocispec.Descriptor{pushTestContent(t, sociStore, layerMediaType, []byte(content))},
+					Subject:      &from,
+					Annotations:  map[string]string{"org.opencontainers.image.created": "2024-01-01T00:00:00Z"},
+				})
+			}
+			sbom := referrer("application/spdx+json", "application/spdx+json", `{"spdxVersion":"SPDX-2.3"}`)
+			for _, desc := range []ocispec.Descriptor{
+				sbom,
+				referrer("application/vnd.cncf.notary.signature", "application/jose+json", "jws"),
+				referrer("application/vnd.dev.cosign.artifact.sig.v1+json", "application/vnd.dev.cosign.simplesigning.v1+json", "simple signing"),
+				referrer(soci.SociIndexArtifactTypeV1, soci.SociLayerMediaType, "ztoc"),
+				referrer("application/vnd.in-toto+json", "application/vnd.in-toto+json", `{"_type":"https://in-toto.io/Statement/v1"}`),
+				referrer("application/vnd.dev.sigstore.bundle.v0.3+json", "application/vnd.dev.sigstore.bundle.v0.3+json", "bundle"),
+				referrer("application/vnd.in-toto.attestation", "application/vnd.dsse.envelope.v1+json", "envelope"),
+			} {
+				if err := registry.PushReferrer(ctx, sociStore, desc, "repo"); err != nil {
+					t.Fatalf("PushReferrer returned error: %v", err)
+				}
+			}
+
+			cosignSbom := pushTestManifest(t, sociStore, ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    emptyConfig,
+				Layers:    []ocispec.Descriptor{pushTestContent(t, sociStore, "text/spdx", []byte("SPDXVersion: SPDX-2.3"))},
+			})
+			for tag, desc := range map[string]ocispec.Descriptor{
+				referrersTag(from.Digest) + ".sbom": cosignSbom,
+				referrersTag(from.Digest) + ".sig":  cosignSbom,
+			} {
+				if err := registry.Push(ctx, sociStore, desc, "repo"); err != nil {
+					t.Fatalf("Push returned error: %v", err)
+				}
+				if err := registry.Tag(ctx, desc, "repo", tag); err != nil {
+					t.Fatalf("Tag returned error: %v", err)
+				}
+			}
+
+			copies, err := registry.CopyReferrers(ctx, "repo", from, to)
+			if err != nil {
+				t.Fatalf("CopyReferrers returned error: %v", err)
+			}
+
+			copied := map[string]bool{}
+			for _, referrerCopy := range copies {
+				if (referrerCopy.Copy == nil) == (referrerCopy.Reason == "") {
+					t.Errorf("expected either a copy or a reason, got %#v", referrerCopy)
+				}
+				copied[referrerCopy.Referrer.ArtifactType] = referrerCopy.Copy != nil
+			}
+			expected := map[string]bool{
+				"application/spdx+json":                           true,
+				"application/vnd.cncf.notary.signature":           false,
+				"application/vnd.dev.cosign.artifact.sig.v1+json": false,
+				soci.SociIndexArtifactTypeV1:                      false,
+				"application/vnd.in-toto+json":                    true,
+				"application/vnd.dev.sigstore.bundle.v0.3+json":   false,
+				"application/vnd.in-toto.attestation":             false,
+				"cosign sbom":                                     true,
+				"cosign sig":                                      false,
+			}
+			if len(copied) != len(expected) {
+				t.Fatalf("expected %v, got %v", expected, copied)
+			}
+			for artifactType, wasCopied := range expected {
+				if copied[artifactType] != wasCopied {
+					t.Errorf("expected %s to be copied: %t", artifactType, wasCopied)
+				}
+			}
+
+			found, err := registry.Referrers(ctx, "repo", to, "application/spdx+json")
+			if err != nil {
+				t.Fatalf("Referrers returned error: %v", err)
+			}
+			if len(found) != 1 {
+				t.Fatalf("expected the SBOM to refer to the new subject, got %#v", found)
+			}
+			if all, err := registry.Referrers(ctx, "repo", to, ""); err != nil || len(all) != 2 {
+				t.Fatalf("expected only the SBOM and the in-toto statement to refer to the new subject, got %#v, %v", all, err)
+			}
+			var sbomCopy ocispec.Manifest
+			if err := json.Unmarshal(server.manifests[found[0].Digest.String()].content, &sbomCopy); err != nil {
+				t.Fatal(err)
+			}
+			if sbomCopy.Subject == nil || sbomCopy.Subject.Digest != to.Digest || sbomCopy.Annotations["org.opencontainers.image.created"] == "" {
+				t.Errorf("expected a copy pointing at the new subject, got %#v", sbomCopy)
+			}
+
+			if manifest, ok := server.manifests[referrersTag(to.Digest)+".sbom"]; !ok || digest.FromBytes(manifest.content) != cosignSbom.Digest {
+				t.Errorf("expected cosign SBOM tag for the new subject")
+			}
+			if _, ok := server.manifests[referrersTag(to.Digest)+".sig"]; ok {
+				t.Errorf("did not expect cosign signature tag for the new subject")
+			}
+		})
+	}
+}
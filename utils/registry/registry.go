@@ -11,20 +11,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"regexp"
 	"strings"
 
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ecr"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 
 	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -43,8 +43,23 @@ var ImageConfigMediaTypes = []string{MediaTypeDockerImageConfig, MediaTypeOCIIma
 
 type Registry struct {
 	registry *remote.Registry
+	// mirrors are tried in order before registry for pulls and resolves
+	mirrors []mirror
+	// httpClient talks to the registry without authentication
+	httpClient *http.Client
+	authMethod string
 }
 
+// How Init authenticates with the registry, as reported by AuthMethod
+const (
+	AuthMethodToken              = "auth token"
+	AuthMethodCredentialProvider = "credential provider"
+	AuthMethodEcr                = "ECR"
+	AuthMethodEcrPublic          = "ECR Public"
+	AuthMethodDockerConfig       = "docker config"
+	AuthMethodAnonymous          = "anonymous"
+)
+
 var RegistryNotSupportingOciArtifacts = errors.New("Registry does not support OCI artifacts")
 var ImageAlreadyIndexed = errors.New("Image already indexed")
 
@@ -55,44 +70,188 @@ type Manifest struct {
 }
 
 // Initialize a remote registry
-func Init(ctx context.Context, registryUrl string, authToken string) (*Registry, error) {
+func Init(ctx context.Context, registryUrl string, authToken string, opts ...Option) (*Registry, error) {
 	log.Info(ctx, "Initializing registry client")
-	registry, err := remote.NewRegistry(registryUrl)
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	hosts, err := o.registryHosts(ctx, registryUrl)
 	if err != nil {
 		return nil, err
 	}
+	upstream := upstreamHost(hosts)
+	mirrors, err := newMirrors(ctx, hosts, upstream, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := remote.NewRegistry(hosts[upstream].host)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.PlainHTTP = hosts[upstream].plainHTTP
+	if registry.PlainHTTP {
+		log.Warn(ctx, "Using plain HTTP")
+	}
+	if o.hostConfig(registryUrl).skipVerify() {
+		log.Warn(ctx, "Skipping TLS certificate verification")
+	}
+
+	httpClient := o.httpClient(hosts[upstream].transport)
+	anonymousClient := &auth.Client{
+		Client: httpClient,
+		Header: http.Header{
+			"User-Agent": {userAgent},
+		},
+		Cache: auth.NewCache(),
+	}
+	registry.RepositoryOptions.Client = anonymousClient
+	authMethod := AuthMethodAnonymous
 	if authToken != "" {
-		registry.RepositoryOptions.Client = &auth.Client{
-			Header: http.Header{
-				"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(authToken))},
-				"User-Agent":    {"Standalone SOCI Index Builder (oras-go)"},
-			},
-		}
+		registry.RepositoryOptions.Client = newTokenClient(httpClient, authToken)
 		log.Info(ctx, "Using auth token")
+		authMethod = AuthMethodToken
+	} else if provider, ok := o.credentialProviderFor(registryUrl); ok {
+		credential := provider.credential(registryUrl, o.imageOn(registryUrl))
+		// fail early if the provider doesn't work at all
+		if _, err := credential.Get(ctx); err != nil {
+			return nil, err
+		}
+		anonymousClient.Credential = func(ctx context.Context, hostport string) (auth.Credential, error) {
+			return credential.Get(ctx)
+		}
+		authMethod = fmt.Sprintf("%s (%s)", AuthMethodCredentialProvider, provider.Command)
 	} else if isEcrRegistry(registryUrl) {
-		err := authorizeEcr(ctx, registry)
+		err := authorizeEcr(ctx, registry, registryUrl, o.hostConfig(registryUrl).Aws, httpClient)
 		if err != nil {
 			return nil, err
 		}
+		authMethod = AuthMethodEcr
+	} else if isEcrPublicRegistry(registryUrl) {
+		anonymousClient.Credential = ecrPublicCredential(o.hostConfig(registryUrl).Aws)
+		authMethod = AuthMethodEcrPublic
+	} else if o.dockerConfig {
+		if credential, ok := dockerConfigCredential(ctx, registryUrl); ok {
+			anonymousClient.Credential = auth.StaticCredential(registry.Reference.Registry, credential)
+			authMethod = AuthMethodDockerConfig
+		}
 	}
-	return &Registry{registry}, nil
+	return &Registry{registry: registry, mirrors: mirrors, httpClient: httpClient, authMethod: authMethod}, nil
+}
+
+// Client sending an auth token as basic authentication with every request
+func newTokenClient(httpClient *http.Client, authToken string) *auth.Client {
+	username, password, _ := strings.Cut(authToken, ":")
+	registerSecrets(auth.Credential{Username: username, Password: password})
+	log.RegisterSecret(authToken)
+	log.RegisterSecret(base64.StdEncoding.EncodeToString([]byte(authToken)))
+	return &auth.Client{
+		Client: httpClient,
+		Header: http.Header{
+			"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(authToken))},
+			"User-Agent":    {userAgent},
+		},
+	}
+}
+
+// AuthMethod returns how the registry client authenticates
+func (registry *Registry) AuthMethod() string {
+	return registry.authMethod
 }
 
 // Pull an image from the remote registry to a local OCI Store
 // imageReference can be either a digest or a tag
 func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
 	log.Info(ctx, "Pulling image")
+	return registry.pull(ctx, repositoryName, sociStore, imageReference, oras.DefaultCopyOptions)
+}
+
+// PullManifests pulls an image like Pull but skips the layers, leaving only manifests and configs in the local OCI Store
+func (registry *Registry) PullManifests(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
+	log.Info(ctx, "Pulling image manifests")
+	opts := oras.DefaultCopyOptions
+	opts.FindSuccessors = func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, desc)
+		if err != nil {
+			return nil, err
+		}
+		var withoutLayers []ocispec.Descriptor
+		for _, successor := range successors {
+			if !images.IsLayerType(successor.MediaType) {
+				withoutLayers = append(withoutLayers, successor)
+			}
+		}
+		return withoutLayers, nil
+	}
+	return registry.pull(ctx, repositoryName, sociStore, imageReference, opts)
+}
+
+// PullReferrer pulls an artifact that refers to a subject, like a signature, without pulling the subject
+func (registry *Registry) PullReferrer(ctx context.Context, repositoryName string, sociStore *store.SociStore, reference string) (*ocispec.Descriptor, error) {
+	log.Info(ctx, fmt.Sprintf("Pulling referrer %s", reference))
+	opts := oras.DefaultCopyOptions
+	opts.FindSuccessors = func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, desc)
+		if err != nil {
+			return nil, err
+		}
+		// the only manifest an artifact manifest points to is its subject
+		var withoutSubject []ocispec.Descriptor
+		for _, successor := range successors {
+			if !images.IsManifestType(successor.MediaType) && !images.IsIndexType(successor.MediaType) {
+				withoutSubject = append(withoutSubject, successor)
+			}
+		}
+		return withoutSubject, nil
+	}
+	return registry.pull(ctx, repositoryName, sociStore, reference, opts)
+}
+
+func (registry *Registry) pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, opts oras.CopyOptions) (*ocispec.Descriptor, error) {
+	// mirrors that can only pull are limited to digests, tags must be resolved by a mirror that can resolve
+	capabilities := docker.HostCapabilityPull
+	if _, err := digest.Parse(imageReference); err != nil {
+		capabilities |= docker.HostCapabilityResolve
+	}
+
+	var imageDescriptor ocispec.Descriptor
+	err := registry.withMirrors(ctx, capabilities, func(reg *remote.Registry) error {
+		repo, err := reg.Repository(ctx, repositoryName)
+		if err != nil {
+			return err
+		}
+
+		imageDescriptor, err = oras.Copy(ctx, repo, imageReference, sociStore, imageReference, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageDescriptor, nil
+}
+
+// Referrers lists the manifests with subject as their subject and the given artifact type.
+// Registries without the referrers API are read with the referrers tag schema.
+func (registry *Registry) Referrers(ctx context.Context, repositoryName string, subject ocispec.Descriptor, artifactType string) ([]ocispec.Descriptor, error) {
 	repo, err := registry.registry.Repository(ctx, repositoryName)
 	if err != nil {
 		return nil, err
 	}
 
-	imageDescriptor, err := oras.Copy(ctx, repo, imageReference, sociStore, imageReference, oras.DefaultCopyOptions)
+	var referrers []ocispec.Descriptor
+	err = repo.Referrers(ctx, subject, artifactType, func(page []ocispec.Descriptor) error {
+		referrers = append(referrers, page...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &imageDescriptor, nil
+	return referrers, nil
 }
 
 // Push a OCI artifact to remote registry
@@ -108,10 +267,9 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 
 	err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, oras.DefaultCopyGraphOptions)
 	if err != nil {
-		// TODO: There might be a better way to check if a registry supporting OCI or not
-		if strings.Contains(err.Error(), "Response status code 405: unsupported: Invalid parameter at 'ImageManifest' failed to satisfy constraint: 'Invalid JSON syntax'") {
+		err = unsupportedArtifactError(err, manifestMediaTypes(ctx, sociStore, indexDesc))
+		if errors.Is(err, RegistryNotSupportingOciArtifacts) {
 			log.Warn(ctx, fmt.Sprintf("Error when pushing: %v", err))
-			return RegistryNotSupportingOciArtifacts
 		}
 		return err
 	}
@@ -119,6 +277,31 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 	return nil
 }
 
+// PushReferrer pushes an artifact whose manifest has a subject, like a SOCI index manifest v1, without tagging it.
+// Registries with the referrers API index it themselves. For the others, the referrers index tagged with the
+// referrers tag schema (sha256-<subject digest hex>) is updated instead.
+func (registry *Registry) PushReferrer(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, repositoryName string) error {
+	log.Info(ctx, "Pushing referrer")
+
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+
+	err = oras.CopyGraph(ctx, sociStore, repo, desc, oras.DefaultCopyGraphOptions)
+	var referrersErr *remote.ReferrersError
+	if errors.As(err, &referrersErr) && referrersErr.IsReferrersIndexDelete() {
+		// the new referrers index is already pushed, only the replaced one is left behind
+		log.Warn(ctx, fmt.Sprintf("Couldn't delete the previous referrers index: %v", err))
+		return nil
+	}
+	if err != nil {
+		return unsupportedArtifactError(err, manifestMediaTypes(ctx, sociStore, desc))
+	}
+
+	return nil
+}
+
 func (registry *Registry) Tag(ctx context.Context, indexDesc ocispec.Descriptor, repositoryName, tag string) error {
 	repo, err := registry.registry.Repository(ctx, repositoryName)
 	if err != nil {
@@ -136,34 +319,86 @@ func (registry *Registry) Tag(ctx context.Context, indexDesc ocispec.Descriptor,
 
 // Call registry's headManifest and return the manifest's descriptor
 func (registry *Registry) HeadManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	var descriptor ocispec.Descriptor
+	err := registry.withMirrors(ctx, docker.HostCapabilityResolve, func(reg *remote.Registry) error {
+		repo, err := reg.Repository(ctx, repositoryName)
+		if err != nil {
+			return err
+		}
+
+		descriptor, err = repo.Resolve(ctx, reference)
+		return err
+	})
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
 
-	descriptor, err := repo.Resolve(ctx, reference)
+	return descriptor, nil
+}
+
+// DeleteTag removes a tag without deleting the manifest it points at, with DELETE /v2/<repo>/manifests/<tag> as the
+// distribution spec allows. Many registries refuse it, the error then holds their answer.
+func (registry *Registry) DeleteTag(ctx context.Context, repositoryName string, tag string) error {
+	ref := registry.registry.Reference
+	ref.Repository = repositoryName
+	ctx = auth.AppendRepositoryScope(ctx, ref, auth.ActionDelete)
+
+	log.Info(ctx, fmt.Sprintf("Deleting tag %s", tag))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, registry.url(fmt.Sprintf("/v2/%s/manifests/%s", repositoryName, tag)), nil)
 	if err != nil {
-		return descriptor, err
+		return err
+	}
+	resp, err := registry.registry.RepositoryOptions.Client.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	return descriptor, nil
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		// a tag that is already gone is as good as deleted
+		return nil
+	}
+	errResp := &errcode.ErrorResponse{Method: req.Method, URL: req.URL, StatusCode: resp.StatusCode}
+	var body struct {
+		Errors errcode.Errors `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err == nil {
+		errResp.Errors = body.Errors
+	}
+	return fmt.Errorf("failed to delete tag %s: %w", tag, errResp)
+}
+
+// ResolveUpstream resolves a reference like HeadManifest, but only with the upstream registry. Mirrors and
+// pull-through caches can answer with stale tags, which must not decide whether a tag is replaced or restored.
+func (registry *Registry) ResolveUpstream(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return repo.Resolve(ctx, reference)
 }
 
 // Call registry's getManifest and return the image's manifest
 // The image reference must be a digest because that's what oras-go FetchReference takes
 func (registry *Registry) GetManifest(ctx context.Context, repositoryName string, digest string) (Manifest, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
 	var manifest Manifest
-	if err != nil {
-		return manifest, err
-	}
+	var bytes []byte
+	err := registry.withMirrors(ctx, docker.HostCapabilityPull, func(reg *remote.Registry) error {
+		repo, err := reg.Repository(ctx, repositoryName)
+		if err != nil {
+			return err
+		}
 
-	_, rc, err := repo.FetchReference(ctx, digest)
-	if err != nil {
-		return manifest, err
-	}
+		_, rc, err := repo.FetchReference(ctx, digest)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
 
-	bytes, err := io.ReadAll(rc)
+		bytes, err = io.ReadAll(rc)
+		return err
+	})
 	if err != nil {
 		return manifest, err
 	}
@@ -243,53 +478,3 @@ func (registry *Registry) GetImageDigests(ctx context.Context, repositoryName st
 	err = fmt.Errorf("Unexpected config media type: %s, expected one of: %v.", manifest.Config.MediaType, ImageConfigMediaTypes)
 	return
 }
-
-// Check if a registry is an ECR registry
-func isEcrRegistry(registryUrl string) bool {
-	ecrRegistryUrlRegex := "\\d{12}\\.dkr\\.ecr\\.\\S+\\.amazonaws\\.com"
-	match, err := regexp.MatchString(ecrRegistryUrlRegex, registryUrl)
-	if err != nil {
-		panic(err)
-	}
-	return match
-}
-
-// Authorize ECR registry
-func authorizeEcr(ctx context.Context, ecrRegistry *remote.Registry) error {
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %w", err)
-	}
-
-	var ecrClient *ecr.Client
-	ecrEndpoint := os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
-	if ecrEndpoint != "" {
-		ecrClient = ecr.NewFromConfig(cfg, func(o *ecr.Options) {
-			o.BaseEndpoint = aws.String(ecrEndpoint)
-		})
-	} else {
-		ecrClient = ecr.NewFromConfig(cfg)
-	}
-
-	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
-	if err != nil {
-		return err
-	}
-
-	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization data returned")
-	}
-
-	ecrAuthorizationToken := getAuthorizationTokenResponse.AuthorizationData[0].AuthorizationToken
-	if len(*ecrAuthorizationToken) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization token returned")
-	}
-
-	ecrRegistry.RepositoryOptions.Client = &auth.Client{
-		Header: http.Header{
-			"Authorization": {"Basic " + *ecrAuthorizationToken},
-			"User-Agent":    {"Standalone SOCI Index Builder (oras-go)"},
-		},
-	}
-	return nil
-}
@@ -4,10 +4,22 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 type ExpectedResponse struct {
@@ -104,3 +116,231 @@ func TestGetManifest(t *testing.T) {
 	}
 	doTest("docker.io", "library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", expected)
 }
+
+func pushTestContent(t *testing.T, sociStore *store.SociStore, mediaType string, content []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if err := sociStore.Push(context.Background(), desc, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func pushTestManifest(t *testing.T, sociStore *store.SociStore, manifest ocispec.Manifest) ocispec.Descriptor {
+	t.Helper()
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := pushTestContent(t, sociStore, ocispec.MediaTypeImageManifest, content)
+	desc.ArtifactType = manifest.ArtifactType
+	return desc
+}
+
+func TestPushReferrer(t *testing.T) {
+	for _, referrers := range []bool{true, false} {
+		name := "referrers API"
+		if !referrers {
+			name = "referrers tag schema"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			server, host := newTestRegistry(t)
+			server.referrers = referrers
+			registry := initTestRegistry(t, host)
+
+			ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sociStore := &store.SociStore{Store: ociStore}
+
+			imageDesc := pushTestManifest(t, sociStore, ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    pushTestContent(t, sociStore, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+				Layers:    []ocispec.Descriptor{},
+			})
+			if err := registry.Push(ctx, sociStore, imageDesc, "repo"); err != nil {
+				t.Fatalf("Push returned error: %v", err)
+			}
+			if err := registry.Tag(ctx, imageDesc, "repo", "latest"); err != nil {
+				t.Fatalf("Tag returned error: %v", err)
+			}
+
+			configDesc := pushTestContent(t, sociStore, soci.SociIndexArtifactTypeV1, emptyJSON)
+			var indexDescs []ocispec.Descriptor
+			for _, ztoc := range []string{"ztoc 1", "ztoc 2"} {
+				indexDesc := pushTestManifest(t, sociStore, ocispec.Manifest{
+					Versioned:    specs.Versioned{SchemaVersion: 2},
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: soci.SociIndexArtifactTypeV1,
+					Config:       configDesc,
+					Layers:       []ocispec.Descriptor{pushTestContent(t, sociStore, soci.SociLayerMediaType, []byte(ztoc))},
+					Subject:      &imageDesc,
+				})
+				if err := registry.PushReferrer(ctx, sociStore, indexDesc, "repo"); err != nil {
+					t.Fatalf("PushReferrer returned error: %v", err)
+				}
+				indexDescs = append(indexDescs, indexDesc)
+			}
+
+			found, err := registry.Referrers(ctx, "repo", imageDesc, soci.SociIndexArtifactTypeV1)
+			if err != nil {
+				t.Fatalf("Referrers returned error: %v", err)
+			}
+			if len(found) != len(indexDescs) {
+				t.Fatalf("expected %d referrers, got %#v", len(indexDescs), found)
+			}
+
+			referrersTag := strings.Replace(imageDesc.Digest.String(), ":", "-", 1)
+			if _, ok := server.manifests[referrersTag]; ok == referrers {
+				t.Errorf("expected referrers tag %s to exist: %t", referrersTag, !referrers)
+			}
+			if latest := server.manifests["latest"]; digest.FromBytes(latest.content) != imageDesc.Digest {
+				t.Errorf("expected latest to still point at the image, got %s", digest.FromBytes(latest.content))
+			}
+			if _, err := registry.HeadManifest(ctx, "repo", imageDesc.Digest.String()); err != nil {
+				t.Errorf("expected the image to still exist: %v", err)
+			}
+		})
+	}
+}
+
+func TestPullManifests(t *testing.T) {
+	ctx := context.Background()
+	server, host := newTestRegistry(t)
+	registry := initTestRegistry(t, host)
+
+	ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sociStore := &store.SociStore{Store: ociStore}
+	layerDesc := pushTestContent(t, sociStore, ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	imageDesc := pushTestManifest(t, sociStore, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    pushTestContent(t, sociStore, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	if err := registry.Push(ctx, sociStore, imageDesc, "repo"); err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	if err := registry.Tag(ctx, imageDesc, "repo", "latest"); err != nil {
+		t.Fatalf("Tag returned error: %v", err)
+	}
+
+	pullStore, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulledDesc, err := registry.PullManifests(ctx, "repo", &store.SociStore{Store: pullStore}, "latest")
+	if err != nil {
+		t.Fatalf("PullManifests returned error: %v", err)
+	}
+	if pulledDesc.Digest != imageDesc.Digest {
+		t.Fatalf("expected %s, got %s", imageDesc.Digest, pulledDesc.Digest)
+	}
+	if exists, err := pullStore.Exists(ctx, imageDesc); err != nil || !exists {
+		t.Errorf("expected the manifest to be pulled: %v", err)
+	}
+	if exists, _ := pullStore.Exists(ctx, layerDesc); exists {
+		t.Errorf("expected the layer to be skipped")
+	}
+	if server.count("GET /v2/repo/blobs/"+layerDesc.Digest.String()) != 0 {
+		t.Errorf("expected the layer not to be downloaded, got %v", server.requests)
+	}
+}
+
+func TestPullReferrer(t *testing.T) {
+	ctx := context.Background()
+	_, host := newTestRegistry(t)
+	registry := initTestRegistry(t, host)
+
+	ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sociStore := &store.SociStore{Store: ociStore}
+	imageDesc := pushTestManifest(t, sociStore, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    pushTestContent(t, sociStore, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    []ocispec.Descriptor{pushTestContent(t, sociStore, ocispec.MediaTypeImageLayerGzip, []byte("layer"))},
+	})
+	signatureLayer := pushTestContent(t, sociStore, "application/jose+json", []byte("jws"))
+	signatureDesc := pushTestManifest(t, sociStore, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.cncf.notary.signature",
+		Config:       pushTestContent(t, sociStore, ocispec.MediaTypeEmptyJSON, emptyJSON),
+		Layers:       []ocispec.Descriptor{signatureLayer},
+		Subject:      &imageDesc,
+	})
+	if err := registry.Push(ctx, sociStore, imageDesc, "repo"); err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	if err := registry.PushReferrer(ctx, sociStore, signatureDesc, "repo"); err != nil {
+		t.Fatalf("PushReferrer returned error: %v", err)
+	}
+
+	pullStore, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulledDesc, err := registry.PullReferrer(ctx, "repo", &store.SociStore{Store: pullStore}, signatureDesc.Digest.String())
+	if err != nil {
+		t.Fatalf("PullReferrer returned error: %v", err)
+	}
+	if pulledDesc.Digest != signatureDesc.Digest {
+		t.Fatalf("expected %s, got %s", signatureDesc.Digest, pulledDesc.Digest)
+	}
+	if exists, err := pullStore.Exists(ctx, signatureLayer); err != nil || !exists {
+		t.Errorf("expected the referrer layer to be pulled: %v", err)
+	}
+	if exists, _ := pullStore.Exists(ctx, imageDesc); exists {
+		t.Errorf("expected the subject to be skipped")
+	}
+
+	_, err = registry.PullReferrer(ctx, "repo", &store.SociStore{Store: pullStore}, "sha256-missing.sig")
+	if !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing tag, got %v", err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	ctx := context.Background()
+	server, host := newTestRegistry(t)
+	registry := initTestRegistry(t, host)
+
+	manifest := testManifest{mediaType: ocispec.MediaTypeImageIndex, content: []byte(`{"schemaVersion":2}`)}
+	dgst := digest.FromBytes(manifest.content).String()
+	server.manifests[dgst] = manifest
+	server.manifests["latest"] = manifest
+	server.manifests["v1"] = manifest
+
+	if err := registry.DeleteTag(ctx, "repo", "v1"); err != nil {
+		t.Fatalf("DeleteTag returned error: %v", err)
+	}
+	if _, ok := server.manifests["v1"]; ok {
+		t.Errorf("expected v1 to be deleted")
+	}
+	if _, ok := server.manifests["latest"]; !ok {
+		t.Errorf("expected latest to be kept")
+	}
+	if _, ok := server.manifests[dgst]; !ok {
+		t.Errorf("expected the manifest to be kept")
+	}
+
+	if err := registry.DeleteTag(ctx, "repo", "v1"); err != nil {
+		t.Errorf("expected a missing tag to be deleted already, got %v", err)
+	}
+
+	server.rejectTagDeletes = true
+	err := registry.DeleteTag(ctx, "repo", "latest")
+	var errResp *errcode.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.StatusCode != http.StatusMethodNotAllowed || !strings.Contains(err.Error(), "tag deletion is not supported") {
+		t.Fatalf("expected the registry's refusal, got %v", err)
+	}
+}
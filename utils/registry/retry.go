@@ -0,0 +1,263 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/CloudSnorkel/standalone-soci-indexer/utils/log"
+)
+
+// Operation is the kind of registry call a request belongs to. Retry limits are set per operation.
+type Operation string
+
+const (
+	OperationResolve Operation = "resolve" // HEAD manifests, tag and referrer listings
+	OperationPull    Operation = "pull"    // GET manifests and blobs
+	OperationPush    Operation = "push"    // blob uploads and manifest PUTs
+	OperationDelete  Operation = "delete"  // manifest and blob DELETEs
+	OperationAuth    Operation = "auth"    // token endpoint and anything else outside /v2/
+)
+
+// RetryPolicy controls how registry HTTP calls are retried
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts (including the first one) for each operation.
+	// Operations missing from the map get DefaultMaxAttempts.
+	MaxAttempts map[Operation]int
+	// DefaultMaxAttempts is used for operations not listed in MaxAttempts.
+	DefaultMaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles with every attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff.
+	MaxDelay time.Duration
+	// Jitter is the fraction of the delay that is randomized, between 0 and 1.
+	Jitter float64
+	// MaxRetryAfter is the longest Retry-After we are willing to wait. Longer values fail the request instead.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy retries transient failures a few times with exponential backoff.
+// Pushes get fewer attempts because blob uploads are expensive to repeat.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: map[Operation]int{
+		OperationResolve: 5,
+		OperationPull:    5,
+		OperationPush:    3,
+		OperationDelete:  3,
+		OperationAuth:    3,
+	},
+	DefaultMaxAttempts: 3,
+	BaseDelay:          500 * time.Millisecond,
+	MaxDelay:           30 * time.Second,
+	Jitter:             0.2,
+	MaxRetryAfter:      2 * time.Minute,
+}
+
+// WithMaxAttempts returns a copy of the policy where every operation is limited to maxAttempts attempts
+func (policy RetryPolicy) WithMaxAttempts(maxAttempts int) RetryPolicy {
+	attempts := make(map[Operation]int, len(policy.MaxAttempts))
+	for operation := range policy.MaxAttempts {
+		attempts[operation] = maxAttempts
+	}
+	policy.MaxAttempts = attempts
+	policy.DefaultMaxAttempts = maxAttempts
+	return policy
+}
+
+func (policy RetryPolicy) maxAttempts(operation Operation) int {
+	if attempts, ok := policy.MaxAttempts[operation]; ok {
+		return attempts
+	}
+	return policy.DefaultMaxAttempts
+}
+
+// backoff returns the delay before the given retry (1 for the first retry)
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	delay := float64(policy.BaseDelay) * math.Pow(2, float64(retry-1))
+	if delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		delay = delay * (1 - policy.Jitter + 2*policy.Jitter*rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// retryTransport is an http.RoundTripper that retries transient registry failures
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+	// sleep is replaceable for tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(base http.RoundTripper, policy RetryPolicy) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base, policy: policy, sleep: sleepContext}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	operation := operationForRequest(req)
+	maxAttempts := t.policy.maxAttempts(operation)
+
+	// retries send clones, RoundTrip must not modify the caller's request
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= maxAttempts || !isRetryable(ctx, resp, err) {
+			return resp, err
+		}
+
+		delay := t.policy.backoff(attempt)
+		if retryAfter, ok := parseRetryAfter(resp, time.Now()); ok {
+			if retryAfter > t.policy.MaxRetryAfter {
+				log.Warn(ctx, fmt.Sprintf("Not retrying %s %s: Retry-After of %s exceeds the maximum of %s", req.Method, req.URL.Path, retryAfter, t.policy.MaxRetryAfter))
+				return resp, err
+			}
+			delay = retryAfter
+		}
+
+		// requests with a body can only be retried if the body can be rewound
+		nextReq := req.Clone(ctx)
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			nextReq.Body = body
+		}
+		attemptReq = nextReq
+
+		log.Warn(ctx, fmt.Sprintf("Retrying %s %s in %s (%s attempt %d of %d): %s", req.Method, req.URL.Path, delay.Round(time.Millisecond), operation, attempt+1, maxAttempts, describeFailure(resp, err)))
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+		}
+
+		if err := t.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// operationForRequest maps a registry API request to its Operation
+func operationForRequest(req *http.Request) Operation {
+	path := req.URL.Path
+	if !strings.HasPrefix(path, "/v2/") {
+		return OperationAuth
+	}
+
+	switch req.Method {
+	case http.MethodDelete:
+		return OperationDelete
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return OperationPush
+	case http.MethodHead:
+		return OperationResolve
+	}
+
+	if strings.Contains(path, "/manifests/") || strings.Contains(path, "/blobs/") {
+		return OperationPull
+	}
+	return OperationResolve
+}
+
+// isRetryable reports whether a response or error is worth another attempt
+func isRetryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		return errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, syscall.EPIPE)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, either in seconds or as an HTTP date
+func parseRetryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// describeFailure summarizes a failed attempt without the request URL, which may carry presigned query strings
+func describeFailure(resp *http.Response, err error) string {
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err.Error()
+		}
+		return err.Error()
+	}
+	return resp.Status
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRetryTransport(policy RetryPolicy) (*retryTransport, *[]time.Duration) {
+	var sleeps []time.Duration
+	transport := newRetryTransport(http.DefaultTransport, policy)
+	transport.sleep = func(_ context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return transport, &sleeps
+}
+
+func TestRetryTransport(t *testing.T) {
+	policy := DefaultRetryPolicy
+	policy.Jitter = 0
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		statuses       []int
+		retryAfter     string
+		expectedStatus int
+		expectedCalls  int
+		expectedSleeps []time.Duration
+	}{
+		{
+			name:           "retries 502 with exponential backoff",
+			method:         http.MethodGet,
+			path:           "/v2/repo/manifests/latest",
+			statuses:       []int{502, 502, 200},
+			expectedStatus: 200,
+			expectedCalls:  3,
+			expectedSleeps: []time.Duration{500 * time.Millisecond, time.Second},
+		},
+		{
+			name:           "honors Retry-After on 429",
+			method:         http.MethodHead,
+			path:           "/v2/repo/manifests/latest",
+			statuses:       []int{429, 200},
+			retryAfter:     "7",
+			expectedStatus: 200,
+			expectedCalls:  2,
+			expectedSleeps: []time.Duration{7 * time.Second},
+		},
+		{
+			name:           "gives up when Retry-After is too long",
+			method:         http.MethodGet,
+			path:           "/v2/repo/blobs/sha256:abc",
+			statuses:       []int{429, 200},
+			retryAfter:     "3600",
+			expectedStatus: 429,
+			expectedCalls:  1,
+		},
+		{
+			name:           "does not retry client errors",
+			method:         http.MethodGet,
+			path:           "/v2/repo/manifests/latest",
+			statuses:       []int{404, 200},
+			expectedStatus: 404,
+			expectedCalls:  1,
+		},
+		{
+			name:           "stops at push attempt limit",
+			method:         http.MethodPut,
+			path:           "/v2/repo/manifests/latest",
+			body:           "{}",
+			statuses:       []int{503, 503, 503, 503, 200},
+			expectedStatus: 503,
+			expectedCalls:  3,
+			expectedSleeps: []time.Duration{500 * time.Millisecond, time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := test.statuses[calls]
+				calls++
+				if received, _ := io.ReadAll(r.Body); string(received) != test.body {
+					t.Errorf("attempt %d got body %q, expected %q", calls, received, test.body)
+				}
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			transport, sleeps := newTestRetryTransport(policy)
+			var body io.Reader
+			if test.body != "" {
+				body = strings.NewReader(test.body)
+			}
+			req, err := http.NewRequest(test.method, server.URL+test.path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			originalBody := req.Body
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip returned error: %v", err)
+			}
+			_ = resp.Body.Close()
+			if req.Body != originalBody {
+				t.Fatal("expected the caller's request body to be left alone")
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if calls != test.expectedCalls {
+				t.Fatalf("expected %d calls, got %d", test.expectedCalls, calls)
+			}
+			if len(*sleeps) != len(test.expectedSleeps) {
+				t.Fatalf("unexpected sleeps: %v", *sleeps)
+			}
+			for i, sleep := range test.expectedSleeps {
+				if (*sleeps)[i] != sleep {
+					t.Fatalf("unexpected sleeps: %v", *sleeps)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Mon, 01 Jan 2024 00:00:30 GMT", 30 * time.Second, true},
+		{"Sun, 31 Dec 2023 23:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.value != "" {
+			resp.Header.Set("Retry-After", test.value)
+		}
+		delay, ok := parseRetryAfter(resp, now)
+		if delay != test.expected || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t; expected %s, %t", test.value, delay, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestOperationForRequest(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		expected Operation
+	}{
+		{http.MethodHead, "/v2/repo/manifests/latest", OperationResolve},
+		{http.MethodGet, "/v2/repo/manifests/latest", OperationPull},
+		{http.MethodGet, "/v2/repo/blobs/sha256:abc", OperationPull},
+		{http.MethodGet, "/v2/repo/tags/list", OperationResolve},
+		{http.MethodPost, "/v2/repo/blobs/uploads/", OperationPush},
+		{http.MethodPut, "/v2/repo/manifests/latest", OperationPush},
+		{http.MethodDelete, "/v2/repo/manifests/sha256:abc", OperationDelete},
+		{http.MethodGet, "/token", OperationAuth},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "https://registry.example.com"+test.path, nil)
+		if operation := operationForRequest(req); operation != test.expected {
+			t.Errorf("operationForRequest(%s %s) = %s; expected %s", test.method, test.path, operation, test.expected)
+		}
+	}
+}
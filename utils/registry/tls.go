@@ -0,0 +1,119 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// AllHosts is the host key for settings that apply to every registry without its own entry
+const AllHosts = "*"
+
+// HostConfig holds the connection settings for a single registry host
+type HostConfig struct {
+	// PlainHTTP talks to the registry over http:// instead of https://. Nil keeps the setting of all hosts.
+	PlainHTTP *bool
+	// InsecureSkipVerify disables TLS certificate verification. Nil keeps the setting of all hosts.
+	InsecureSkipVerify *bool
+	// CAFiles are PEM bundles trusted in addition to the system roots
+	CAFiles []string
+	// CertFile and KeyFile are a PEM client certificate and key for mTLS
+	CertFile string
+	KeyFile  string
+	// Aws selects the credentials used for ECR registries
+	Aws AwsConfig
+}
+
+// Bool returns a pointer to value, for the optional HostConfig switches
+func Bool(value bool) *bool {
+	return &value
+}
+
+// Merge returns the settings of config overridden by any setting in other
+func (config HostConfig) Merge(other HostConfig) HostConfig {
+	if other.PlainHTTP != nil {
+		config.PlainHTTP = other.PlainHTTP
+	}
+	if other.InsecureSkipVerify != nil {
+		config.InsecureSkipVerify = other.InsecureSkipVerify
+	}
+	config.CAFiles = append(append([]string{}, config.CAFiles...), other.CAFiles...)
+	if other.CertFile != "" {
+		config.CertFile = other.CertFile
+	}
+	if other.KeyFile != "" {
+		config.KeyFile = other.KeyFile
+	}
+	config.Aws = config.Aws.merge(other.Aws)
+	return config
+}
+
+func (config HostConfig) usePlainHTTP() bool {
+	return config.PlainHTTP != nil && *config.PlainHTTP
+}
+
+func (config HostConfig) skipVerify() bool {
+	return config.InsecureSkipVerify != nil && *config.InsecureSkipVerify
+}
+
+// tlsConfig builds the TLS client configuration, or nil when the defaults are fine
+func (config HostConfig) tlsConfig() (*tls.Config, error) {
+	if !config.skipVerify() && len(config.CAFiles) == 0 && config.CertFile == "" && config.KeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.skipVerify(),
+	}
+
+	if len(config.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range config.CAFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be specified together")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// transport returns the base HTTP transport for the host
+func (config HostConfig) transport() (http.RoundTripper, error) {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return http.DefaultTransport, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
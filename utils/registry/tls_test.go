@@ -0,0 +1,139 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testManifestDigest = "sha256:9a161b6fc2f8ef74bb368f56edcac33a91b494d082da3693a600751a1a68b7d8"
+
+func newManifestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", testManifestDigest)
+		w.Header().Set("Content-Length", "2")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestHostConfig(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(newManifestHandler())
+	defer tlsServer.Close()
+	tlsHost := hostOf(t, tlsServer.URL)
+
+	plainServer := httptest.NewServer(newManifestHandler())
+	defer plainServer.Close()
+	plainHost := hostOf(t, plainServer.URL)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		host      string
+		opts      []Option
+		expectErr bool
+	}{
+		{
+			name:      "rejects unknown CA",
+			host:      tlsHost,
+			expectErr: true,
+		},
+		{
+			name: "trusts CA bundle for host",
+			host: tlsHost,
+			opts: []Option{WithHostConfig(tlsHost, HostConfig{CAFiles: []string{caFile}})},
+		},
+		{
+			name: "trusts CA bundle for all hosts",
+			host: tlsHost,
+			opts: []Option{WithHostConfig(AllHosts, HostConfig{CAFiles: []string{caFile}})},
+		},
+		{
+			name:      "ignores CA bundle for other host",
+			host:      tlsHost,
+			opts:      []Option{WithHostConfig("other.example.com", HostConfig{CAFiles: []string{caFile}})},
+			expectErr: true,
+		},
+		{
+			name: "skips verification when asked",
+			host: tlsHost,
+			opts: []Option{WithHostConfig(tlsHost, HostConfig{InsecureSkipVerify: Bool(true)})},
+		},
+		{
+			name: "uses plain HTTP",
+			host: plainHost,
+			opts: []Option{WithHostConfig(plainHost, HostConfig{PlainHTTP: Bool(true)})},
+		},
+		{
+			name: "host turns off plain HTTP of all hosts",
+			host: tlsHost,
+			opts: []Option{
+				WithHostConfig(AllHosts, HostConfig{PlainHTTP: Bool(true), InsecureSkipVerify: Bool(true)}),
+				WithHostConfig(tlsHost, HostConfig{PlainHTTP: Bool(false), CAFiles: []string{caFile}}),
+			},
+		},
+		{
+			name: "host turns off skipping verification of all hosts",
+			host: tlsHost,
+			opts: []Option{
+				WithHostConfig(AllHosts, HostConfig{InsecureSkipVerify: Bool(true)}),
+				WithHostConfig(tlsHost, HostConfig{InsecureSkipVerify: Bool(false)}),
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append([]Option{WithRetryPolicy(DefaultRetryPolicy.WithMaxAttempts(1))}, test.opts...)
+			registry, err := Init(context.Background(), test.host, "", opts...)
+			if err != nil {
+				t.Fatalf("Init returned error: %v", err)
+			}
+
+			desc, err := registry.HeadManifest(context.Background(), "repo", "latest")
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HeadManifest returned error: %v", err)
+			}
+			if desc.Digest.String() != testManifestDigest {
+				t.Fatalf("unexpected digest: %s", desc.Digest)
+			}
+		})
+	}
+}
+
+func TestHostConfigRequiresCertAndKey(t *testing.T) {
+	_, err := HostConfig{CertFile: "client.pem"}.tlsConfig()
+	if err == nil {
+		t.Fatal("expected error for certificate without key")
+	}
+}
+
+func hostOf(t *testing.T, rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
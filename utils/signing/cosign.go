@@ -0,0 +1,95 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+const (
+	CosignArtifactType           = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	CosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignSignatureType         = "cosign container image signature"
+)
+
+// The simple signing payload cosign signs, see github.com/sigstore/cosign/pkg/cosign/payload
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// Sign a simple signing payload and store it the way cosign does with --registry-referrers-mode=oci-1-1
+func (signer *Signer) signCosign(ctx context.Context, store content.Pusher, repository string, subject ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var payload simpleSigning
+	payload.Critical.Identity.DockerReference = repository
+	payload.Critical.Image.DockerManifestDigest = subject.Digest.String()
+	payload.Critical.Type = cosignSignatureType
+	payloadContent, err := json.Marshal(payload)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	signature, err := signCosignPayload(signer.key, payloadContent)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	layer := ocispec.Descriptor{
+		MediaType:   CosignSimpleSigningMediaType,
+		Digest:      digest.FromBytes(payloadContent),
+		Size:        int64(len(payloadContent)),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+	}
+	if len(signer.certificates) > 0 {
+		layer.Annotations[cosignCertificateAnnotation] = string(encodeCertificates(signer.certificates[:1]))
+		if len(signer.certificates) > 1 {
+			layer.Annotations[cosignChainAnnotation] = string(encodeCertificates(signer.certificates[1:]))
+		}
+	}
+
+	annotations := map[string]string{annotationCreated: signer.now().UTC().Format(time.RFC3339)}
+	return pushSignatureManifest(ctx, store, CosignArtifactType, layer, payloadContent, subject, annotations)
+}
+
+// cosign signs the SHA-256 of the payload, except for ed25519 which signs the payload itself
+func signCosignPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func encodeCertificates(certificates []*x509.Certificate) []byte {
+	var encoded []byte
+	for _, certificate := range certificates {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+	}
+	return encoded
+}
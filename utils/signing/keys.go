@@ -0,0 +1,151 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PEM block types of private keys created by cosign generate-key-pair
+const (
+	encryptedSigstoreKeyType = "ENCRYPTED SIGSTORE PRIVATE KEY"
+	encryptedCosignKeyType   = "ENCRYPTED COSIGN PRIVATE KEY"
+)
+
+var ErrPasswordRequired = errors.New("private key is encrypted and no password was provided")
+
+// Encrypted private keys of cosign, see github.com/secure-systems-lab/go-securesystemslib/encrypted
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// LoadPrivateKey reads a PEM private key file. PKCS#8, SEC 1 EC and PKCS#1 RSA keys are supported, as well as
+// encrypted keys created by cosign generate-key-pair, which are decrypted with password.
+func LoadPrivateKey(path string, password []byte) (crypto.Signer, error) {
+	pemContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemContent)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case encryptedSigstoreKeyType, encryptedCosignKeyType:
+		var der []byte
+		der, err = decryptCosignKey(block.Bytes, password)
+		if err == nil {
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+	}
+	return signer, nil
+}
+
+// LoadCertificates reads every PEM certificate of a file, leaf certificate first
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	pemContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := parseCertificates(pemContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificates %s: %w", path, err)
+	}
+	return certificates, nil
+}
+
+func parseCertificates(pemContent []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemContent = pem.Decode(pemContent)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certificates, nil
+}
+
+// Decrypt the scrypt and secretbox sealed PKCS#8 key cosign writes
+func decryptCosignKey(content []byte, password []byte) ([]byte, error) {
+	var key encryptedKey
+	if err := json.Unmarshal(content, &key); err != nil {
+		return nil, err
+	}
+	if key.KDF.Name != "scrypt" || key.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported key encryption %s with %s", key.KDF.Name, key.Cipher.Name)
+	}
+	if len(key.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce length %d", len(key.Cipher.Nonce))
+	}
+	if len(password) == 0 {
+		return nil, ErrPasswordRequired
+	}
+
+	derived, err := scrypt.Key(password, key.KDF.Salt, key.KDF.Params.N, key.KDF.Params.R, key.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], derived)
+	copy(nonce[:], key.Cipher.Nonce)
+
+	der, ok := secretbox.Open(nil, key.Ciphertext, &nonce, &secretKey)
+	if !ok {
+		return nil, errors.New("failed to decrypt private key, wrong password?")
+	}
+	return der, nil
+}
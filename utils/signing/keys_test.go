@@ -0,0 +1,117 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func writePEM(t *testing.T, blockType string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Encrypt a PKCS#8 key the way cosign generate-key-pair does, with cheaper scrypt parameters
+func encryptCosignKey(t *testing.T, der []byte, password []byte) []byte {
+	t.Helper()
+	var key encryptedKey
+	key.KDF.Name = "scrypt"
+	key.KDF.Params.N = 1024
+	key.KDF.Params.R = 8
+	key.KDF.Params.P = 1
+	key.KDF.Salt = make([]byte, 32)
+	key.Cipher.Name = "nacl/secretbox"
+	key.Cipher.Nonce = make([]byte, 24)
+	if _, err := rand.Read(key.KDF.Salt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(key.Cipher.Nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := scrypt.Key(password, key.KDF.Salt, key.KDF.Params.N, key.KDF.Params.R, key.KDF.Params.P, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], derived)
+	copy(nonce[:], key.Cipher.Nonce)
+	key.Ciphertext = secretbox.Seal(nil, der, &nonce, &secretKey)
+
+	content, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encryptCosignKey(t, pkcs8, []byte("secret"))
+
+	tests := []struct {
+		name        string
+		path        string
+		password    string
+		expectedErr error
+		fails       bool
+	}{
+		{name: "pkcs8", path: writePEM(t, "PRIVATE KEY", pkcs8)},
+		{name: "sec1", path: writePEM(t, "EC PRIVATE KEY", sec1)},
+		{name: "encrypted sigstore key", path: writePEM(t, encryptedSigstoreKeyType, encrypted), password: "secret"},
+		{name: "encrypted cosign key", path: writePEM(t, encryptedCosignKeyType, encrypted), password: "secret"},
+		{name: "encrypted key without password", path: writePEM(t, encryptedSigstoreKeyType, encrypted), expectedErr: ErrPasswordRequired, fails: true},
+		{name: "encrypted key with wrong password", path: writePEM(t, encryptedSigstoreKeyType, encrypted), password: "wrong", fails: true},
+		{name: "public key", path: writePEM(t, "PUBLIC KEY", pkcs8), fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := LoadPrivateKey(test.path, []byte(test.password))
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected %v, got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadPrivateKey returned error: %v", err)
+			}
+			if !key.PublicKey.Equal(signer.Public()) {
+				t.Fatal("loaded a different key")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+const (
+	NotationArtifactType         = "application/vnd.cncf.notary.signature"
+	NotationEnvelopeMediaType    = "application/jose+json"
+	NotationPayloadContentType   = "application/vnd.cncf.notary.payload.v1+json"
+	NotationThumbprintAnnotation = "io.cncf.notary.x509chain.thumbprint#S256"
+
+	notationSigningScheme = "notary.x509"
+	notationSigningAgent  = "standalone-soci-indexer"
+)
+
+// The Notary Project signature envelope, see notaryproject/specifications signature-envelope-jws.md
+type jwsEnvelope struct {
+	Payload   string               `json:"payload"`
+	Protected string               `json:"protected"`
+	Header    jwsUnprotectedHeader `json:"header"`
+	Signature string               `json:"signature"`
+}
+
+type jwsProtectedHeader struct {
+	Algorithm     string    `json:"alg"`
+	ContentType   string    `json:"cty"`
+	Critical      []string  `json:"crit"`
+	SigningScheme string    `json:"io.cncf.notary.signingScheme"`
+	SigningTime   time.Time `json:"io.cncf.notary.signingTime"`
+}
+
+type jwsUnprotectedHeader struct {
+	// DER certificates, leaf first
+	CertificateChain [][]byte `json:"x5c"`
+	SigningAgent     string   `json:"io.cncf.notary.signingAgent,omitempty"`
+}
+
+type notationPayload struct {
+	TargetArtifact ocispec.Descriptor `json:"targetArtifact"`
+}
+
+// Sign a JWS envelope and store it the way notation does with the OCI referrers API
+func (signer *Signer) signNotation(ctx context.Context, store content.Pusher, subject ocispec.Descriptor) (ocispec.Descriptor, error) {
+	algorithm, hash, err := jwsAlgorithm(signer.key.Public())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	payloadContent, err := json.Marshal(notationPayload{TargetArtifact: subject})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	protectedContent, err := json.Marshal(jwsProtectedHeader{
+		Algorithm:     algorithm,
+		ContentType:   NotationPayloadContentType,
+		Critical:      []string{"io.cncf.notary.signingScheme"},
+		SigningScheme: notationSigningScheme,
+		SigningTime:   signer.now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	envelope := jwsEnvelope{
+		Payload:   base64.RawURLEncoding.EncodeToString(payloadContent),
+		Protected: base64.RawURLEncoding.EncodeToString(protectedContent),
+		Header:    jwsUnprotectedHeader{SigningAgent: notationSigningAgent},
+	}
+	signature, err := signJWS(signer.key, hash, []byte(envelope.Protected+"."+envelope.Payload))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	envelope.Signature = base64.RawURLEncoding.EncodeToString(signature)
+
+	var thumbprints []string
+	for _, certificate := range signer.certificates {
+		envelope.Header.CertificateChain = append(envelope.Header.CertificateChain, certificate.Raw)
+		thumbprint := sha256.Sum256(certificate.Raw)
+		thumbprints = append(thumbprints, hex.EncodeToString(thumbprint[:]))
+	}
+	thumbprintsContent, err := json.Marshal(thumbprints)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	envelopeContent, err := json.Marshal(envelope)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	layer := ocispec.Descriptor{
+		MediaType: NotationEnvelopeMediaType,
+		Digest:    digest.FromBytes(envelopeContent),
+		Size:      int64(len(envelopeContent)),
+	}
+	annotations := map[string]string{
+		NotationThumbprintAnnotation: string(thumbprintsContent),
+		annotationCreated:            signer.now().UTC().Format(time.RFC3339),
+	}
+	return pushSignatureManifest(ctx, store, NotationArtifactType, layer, envelopeContent, subject, annotations)
+}
+
+// Pick the JWS algorithm the Notary Project specification assigns to a key
+func jwsAlgorithm(publicKey crypto.PublicKey) (string, crypto.Hash, error) {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+	case *rsa.PublicKey:
+		switch key.Size() * 8 {
+		case 2048:
+			return "PS256", crypto.SHA256, nil
+		case 3072:
+			return "PS384", crypto.SHA384, nil
+		case 4096:
+			return "PS512", crypto.SHA512, nil
+		}
+	}
+	return "", 0, fmt.Errorf("notation signatures need an ECDSA P-256, P-384, P-521 or RSA 2048, 3072, 4096 key, not %T", publicKey)
+}
+
+// JWS uses RSASSA-PSS and fixed size r||s ECDSA signatures instead of the ASN.1 ones crypto.Signer returns
+func signJWS(key crypto.Signer, hash crypto.Hash, signingInput []byte) ([]byte, error) {
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	hashed := hasher.Sum(nil)
+
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		return key.Sign(rand.Reader, hashed, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	}
+
+	der, err := key.Sign(rand.Reader, hashed, hash)
+	if err != nil {
+		return nil, err
+	}
+	var signature struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &signature); err != nil {
+		return nil, err
+	}
+	size := (key.Public().(*ecdsa.PublicKey).Curve.Params().BitSize + 7) / 8
+	raw := make([]byte, 2*size)
+	signature.R.FillBytes(raw[:size])
+	signature.S.FillBytes(raw[size:])
+	return raw, nil
+}
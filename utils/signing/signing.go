@@ -0,0 +1,128 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signing signs images with cosign and notation compatible signatures that are pushed as OCI referrers
+package signing
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// FormatCosign signs a cosign simple signing payload, like cosign sign --key
+	FormatCosign = "cosign"
+	// FormatNotation signs a JWS envelope with an X.509 certificate chain, like notation sign
+	FormatNotation = "notation"
+
+	annotationCreated = "org.opencontainers.image.created"
+)
+
+// Signer creates signature manifests for image digests
+type Signer struct {
+	format       string
+	key          crypto.Signer
+	certificates []*x509.Certificate
+	now          func() time.Time
+}
+
+// NewSigner creates a signer for format from a private key and an optional PEM certificate chain.
+// Notation signatures need the certificate chain, its leaf must be the certificate of the key.
+func NewSigner(format string, key crypto.Signer, certificates []*x509.Certificate) (*Signer, error) {
+	switch format {
+	case FormatCosign:
+	case FormatNotation:
+		if len(certificates) == 0 {
+			return nil, errors.New("notation signatures need a certificate chain")
+		}
+		if _, _, err := jwsAlgorithm(key.Public()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown signature format %s, expected %s or %s", format, FormatCosign, FormatNotation)
+	}
+
+	if len(certificates) > 0 {
+		if err := checkCertificateKey(certificates[0], key.Public()); err != nil {
+			return nil, err
+		}
+	}
+	return &Signer{format: format, key: key, certificates: certificates, now: time.Now}, nil
+}
+
+// Format returns FormatCosign or FormatNotation
+func (signer *Signer) Format() string {
+	return signer.format
+}
+
+// Sign writes a signature manifest for subject and its blobs to store and returns the manifest descriptor, so it
+// can be pushed as a referrer of subject. repository is the full repository name the signature identifies.
+func (signer *Signer) Sign(ctx context.Context, store content.Pusher, repository string, subject ocispec.Descriptor) (ocispec.Descriptor, error) {
+	subject = ocispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	switch signer.format {
+	case FormatNotation:
+		return signer.signNotation(ctx, store, subject)
+	default:
+		return signer.signCosign(ctx, store, repository, subject)
+	}
+}
+
+// Write an artifact manifest with an empty config and a single layer
+func pushSignatureManifest(ctx context.Context, store content.Pusher, artifactType string, layer ocispec.Descriptor, layerContent []byte, subject ocispec.Descriptor, annotations map[string]string) (ocispec.Descriptor, error) {
+	if err := pushContent(ctx, store, layer, layerContent); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	config := ocispec.DescriptorEmptyJSON
+	if err := pushContent(ctx, store, config, config.Data); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	config.Data = nil
+
+	manifestContent, err := json.Marshal(ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+		Annotations:  annotations,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Digest:       digest.FromBytes(manifestContent),
+		Size:         int64(len(manifestContent)),
+	}
+	return desc, pushContent(ctx, store, desc, manifestContent)
+}
+
+func pushContent(ctx context.Context, store content.Pusher, desc ocispec.Descriptor, b []byte) error {
+	err := store.Push(ctx, desc, bytes.NewReader(b))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+func checkCertificateKey(certificate *x509.Certificate, publicKey crypto.PublicKey) error {
+	key, ok := publicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !key.Equal(certificate.PublicKey) {
+		return fmt.Errorf("certificate %s is not for the signing key", certificate.Subject)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+var testSubject = ocispec.Descriptor{
+	MediaType: ocispec.MediaTypeImageIndex,
+	Digest:    digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222"),
+	Size:      123,
+}
+
+func newTestCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "soci-indexer-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// Sign testSubject and return the signature manifest and its only layer
+func signTestSubject(t *testing.T, signer *Signer) (ocispec.Manifest, []byte) {
+	t.Helper()
+	ctx := context.Background()
+	store := memory.New()
+	desc, err := signer.Sign(ctx, store, "registry.example.com/example/repo", testSubject)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+
+	manifestContent, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != testSubject.Digest || manifest.Subject.Size != testSubject.Size {
+		t.Fatalf("expected signature of %s, got subject %#v", testSubject.Digest, manifest.Subject)
+	}
+	if manifest.ArtifactType != desc.ArtifactType || manifest.Config.MediaType != ocispec.MediaTypeEmptyJSON {
+		t.Fatalf("unexpected signature manifest %#v", manifest)
+	}
+	if _, err := content.FetchAll(ctx, store, manifest.Config); err != nil {
+		t.Fatalf("expected empty config in the store: %v", err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected a single layer, got %#v", manifest.Layers)
+	}
+	layerContent, err := content.FetchAll(ctx, store, manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, layerContent
+}
+
+func TestSignCosign(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		verify func(payload []byte, signature []byte) bool
+	}{
+		{
+			name: "ecdsa",
+			key:  ecdsaKey,
+			verify: func(payload []byte, signature []byte) bool {
+				hash := sha256.Sum256(payload)
+				return ecdsa.VerifyASN1(&ecdsaKey.PublicKey, hash[:], signature)
+			},
+		},
+		{
+			name: "ed25519",
+			key:  ed25519Key,
+			verify: func(payload []byte, signature []byte) bool {
+				return ed25519.Verify(ed25519Key.Public().(ed25519.PublicKey), payload, signature)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := NewSigner(FormatCosign, test.key, nil)
+			if err != nil {
+				t.Fatalf("NewSigner returned error: %v", err)
+			}
+			manifest, payload := signTestSubject(t, signer)
+
+			if manifest.ArtifactType != CosignArtifactType || manifest.Layers[0].MediaType != CosignSimpleSigningMediaType {
+				t.Fatalf("unexpected cosign signature manifest %#v", manifest)
+			}
+			var simpleSigningPayload simpleSigning
+			if err := json.Unmarshal(payload, &simpleSigningPayload); err != nil {
+				t.Fatal(err)
+			}
+			if simpleSigningPayload.Critical.Image.DockerManifestDigest != testSubject.Digest.String() ||
+				simpleSigningPayload.Critical.Identity.DockerReference != "registry.example.com/example/repo" ||
+				simpleSigningPayload.Critical.Type != cosignSignatureType {
+				t.Fatalf("unexpected simple signing payload %s", payload)
+			}
+
+			signature, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[cosignSignatureAnnotation])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.verify(payload, signature) {
+				t.Fatal("signature doesn't verify")
+			}
+		})
+	}
+}
+
+func TestSignNotation(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		algorithm string
+		verify    func(signingInput []byte, signature []byte) bool
+	}{
+		{
+			name:      "ecdsa",
+			key:       ecdsaKey,
+			algorithm: "ES384",
+			verify: func(signingInput []byte, signature []byte) bool {
+				hash := crypto.SHA384.New()
+				hash.Write(signingInput)
+				r := new(big.Int).SetBytes(signature[:len(signature)/2])
+				s := new(big.Int).SetBytes(signature[len(signature)/2:])
+				return len(signature) == 96 && ecdsa.Verify(&ecdsaKey.PublicKey, hash.Sum(nil), r, s)
+			},
+		},
+		{
+			name:      "rsa",
+			key:       rsaKey,
+			algorithm: "PS256",
+			verify: func(signingInput []byte, signature []byte) bool {
+				hash := sha256.Sum256(signingInput)
+				return rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certificate := newTestCertificate(t, test.key)
+			signer, err := NewSigner(FormatNotation, test.key, []*x509.Certificate{certificate})
+			if err != nil {
+				t.Fatalf("NewSigner returned error: %v", err)
+			}
+			manifest, envelopeContent := signTestSubject(t, signer)
+
+			if manifest.ArtifactType != NotationArtifactType || manifest.Layers[0].MediaType != NotationEnvelopeMediaType {
+				t.Fatalf("unexpected notation signature manifest %#v", manifest)
+			}
+			thumbprint := sha256.Sum256(certificate.Raw)
+			if manifest.Annotations[NotationThumbprintAnnotation] != `["`+hex.EncodeToString(thumbprint[:])+`"]` {
+				t.Fatalf("unexpected thumbprint annotation %s", manifest.Annotations[NotationThumbprintAnnotation])
+			}
+
+			var envelope jwsEnvelope
+			if err := json.Unmarshal(envelopeContent, &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if len(envelope.Header.CertificateChain) != 1 || string(envelope.Header.CertificateChain[0]) != string(certificate.Raw) {
+				t.Fatalf("expected the certificate chain in the envelope")
+			}
+
+			var protected jwsProtectedHeader
+			protectedContent, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(protectedContent, &protected); err != nil {
+				t.Fatal(err)
+			}
+			if protected.Algorithm != test.algorithm || protected.ContentType != NotationPayloadContentType || protected.SigningScheme != notationSigningScheme {
+				t.Fatalf("unexpected protected header %s", protectedContent)
+			}
+
+			var payload notationPayload
+			payloadContent, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(payloadContent, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.TargetArtifact.Digest != testSubject.Digest || payload.TargetArtifact.Size != testSubject.Size {
+				t.Fatalf("unexpected payload %s", payloadContent)
+			}
+
+			signature, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.verify([]byte(envelope.Protected+"."+envelope.Payload), signature) {
+				t.Fatal("signature doesn't verify")
+			}
+		})
+	}
+}
+
+func TestNewSignerErrors(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		format       string
+		key          crypto.Signer
+		certificates []*x509.Certificate
+	}{
+		{name: "unknown format", format: "gpg", key: ecdsaKey},
+		{name: "notation without certificate", format: FormatNotation, key: ecdsaKey},
+		{name: "notation with ed25519", format: FormatNotation, key: ed25519Key, certificates: []*x509.Certificate{newTestCertificate(t, ed25519Key)}},
+		{name: "certificate of another key", format: FormatCosign, key: ecdsaKey, certificates: []*x509.Certificate{newTestCertificate(t, otherKey)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewSigner(test.format, test.key, test.certificates); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
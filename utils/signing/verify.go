@@ -0,0 +1,334 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+var ErrNoValidSignature = errors.New("no valid signature")
+
+// ErrUnsupportedSignatureFormat means a signature was found in a format Verify can't check
+var ErrUnsupportedSignatureFormat = errors.New("unsupported signature format")
+
+// SigstoreBundleMediaTypePrefix starts the artifact and layer media types of sigstore bundles, which cosign stores
+// keyless signatures in. Checking them needs the transparency log or a timestamp authority, so they aren't checked.
+const SigstoreBundleMediaTypePrefix = "application/vnd.dev.sigstore.bundle"
+
+// Verifier checks cosign and notation signatures against trusted public keys or certificate authorities
+type Verifier struct {
+	publicKeys []crypto.PublicKey
+	roots      *x509.CertPool
+	// identity is required in the certificate subject common name or alternative names when set
+	identity string
+}
+
+// NewVerifier creates a verifier that trusts signatures made by publicKeys, or made with a certificate issued by
+// roots for identity. identity only applies to certificates and may be empty to trust any certificate of roots.
+func NewVerifier(publicKeys []crypto.PublicKey, roots []*x509.Certificate, identity string) (*Verifier, error) {
+	if len(publicKeys) == 0 && len(roots) == 0 {
+		return nil, errors.New("signature verification needs a public key or a certificate authority")
+	}
+	if identity != "" && len(roots) == 0 {
+		return nil, errors.New("certificate identity verification needs a certificate authority")
+	}
+
+	verifier := &Verifier{publicKeys: publicKeys, identity: identity}
+	if len(roots) > 0 {
+		verifier.roots = x509.NewCertPool()
+		for _, root := range roots {
+			verifier.roots.AddCert(root)
+		}
+	}
+	return verifier, nil
+}
+
+// LoadPublicKey reads a PEM public key file, like the cosign.pub cosign generate-key-pair creates
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	pemContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemContent)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM public key found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// IsSignature tells if a referrer artifact type is one of the signatures Verify checks
+func IsSignature(artifactType string) bool {
+	return artifactType == CosignArtifactType || artifactType == NotationArtifactType
+}
+
+// IsUnsupportedSignature tells if a referrer artifact type is a signature Verify can't check, like a sigstore bundle
+func IsUnsupportedSignature(artifactType string) bool {
+	return strings.HasPrefix(artifactType, SigstoreBundleMediaTypePrefix)
+}
+
+// Verify checks that a signature manifest, with its blobs in fetcher, signs subject with a trusted key.
+// Manifests with several signature layers, like cosign's sha256-<digest hex>.sig tags, need one valid layer.
+func (verifier *Verifier) Verify(ctx context.Context, fetcher content.Fetcher, signatureDesc ocispec.Descriptor, subject ocispec.Descriptor) error {
+	manifestContent, err := content.FetchAll(ctx, fetcher, signatureDesc)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return fmt.Errorf("failed to decode signature %s: %w", signatureDesc.Digest, err)
+	}
+
+	var errs []error
+	for _, layer := range manifest.Layers {
+		if IsUnsupportedSignature(layer.MediaType) {
+			errs = append(errs, fmt.Errorf("%w: sigstore bundle %s", ErrUnsupportedSignatureFormat, layer.Digest))
+			continue
+		}
+		if layer.MediaType != CosignSimpleSigningMediaType && layer.MediaType != NotationEnvelopeMediaType {
+			continue
+		}
+		layerContent, err := content.FetchAll(ctx, fetcher, layer)
+		if err != nil {
+			return err
+		}
+		if layer.MediaType == CosignSimpleSigningMediaType {
+			err = verifier.verifyCosign(layer, layerContent, subject)
+		} else {
+			err = verifier.verifyNotation(layerContent, subject)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("%w: %s has no cosign or notation signature", ErrNoValidSignature, signatureDesc.Digest)
+	}
+	if len(errs) == 1 && errors.Is(errs[0], ErrUnsupportedSignatureFormat) {
+		return fmt.Errorf("%s: %w", signatureDesc.Digest, errs[0])
+	}
+	return fmt.Errorf("%w: %s: %w", ErrNoValidSignature, signatureDesc.Digest, errors.Join(errs...))
+}
+
+func (verifier *Verifier) verifyCosign(layer ocispec.Descriptor, payloadContent []byte, subject ocispec.Descriptor) error {
+	var payload simpleSigning
+	if err := json.Unmarshal(payloadContent, &payload); err != nil {
+		return fmt.Errorf("failed to decode cosign payload: %w", err)
+	}
+	if payload.Critical.Image.DockerManifestDigest != subject.Digest.String() {
+		return fmt.Errorf("cosign signature is for %s", payload.Critical.Image.DockerManifestDigest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("failed to decode cosign signature: %w", err)
+	}
+
+	verify := func(key crypto.PublicKey) error {
+		return verifyCosignPayload(key, payloadContent, signature)
+	}
+	if certificate := layer.Annotations[cosignCertificateAnnotation]; certificate != "" {
+		chain, err := parseCertificates([]byte(certificate + layer.Annotations[cosignChainAnnotation]))
+		if err != nil {
+			return err
+		}
+		return verifier.verifyWithCertificates(chain, verify)
+	}
+	return verifier.verifyWithPublicKeys(verify)
+}
+
+func (verifier *Verifier) verifyNotation(envelopeContent []byte, subject ocispec.Descriptor) error {
+	var envelope jwsEnvelope
+	if err := json.Unmarshal(envelopeContent, &envelope); err != nil {
+		return fmt.Errorf("failed to decode notation envelope: %w", err)
+	}
+	protectedContent, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return fmt.Errorf("failed to decode notation protected header: %w", err)
+	}
+	var protected jwsProtectedHeader
+	if err := json.Unmarshal(protectedContent, &protected); err != nil {
+		return fmt.Errorf("failed to decode notation protected header: %w", err)
+	}
+	if protected.ContentType != NotationPayloadContentType || protected.SigningScheme != notationSigningScheme {
+		return fmt.Errorf("unsupported notation signature %s with signing scheme %s", protected.ContentType, protected.SigningScheme)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode notation signature: %w", err)
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range envelope.Header.CertificateChain {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("failed to read notation certificate: %w", err)
+		}
+		chain = append(chain, certificate)
+	}
+	if len(chain) == 0 {
+		return errors.New("notation signature has no certificate chain")
+	}
+
+	signingInput := []byte(envelope.Protected + "." + envelope.Payload)
+	// the signer sets the signing time, so without a trusted timestamp the chain must be valid now
+	err = verifier.verifyWithCertificates(chain, func(key crypto.PublicKey) error {
+		return verifyJWS(key, protected.Algorithm, signingInput, signature)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the payload is only trusted once the signature is
+	payloadContent, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode notation payload: %w", err)
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(payloadContent, &payload); err != nil {
+		return fmt.Errorf("failed to decode notation payload: %w", err)
+	}
+	if payload.TargetArtifact.Digest != subject.Digest || payload.TargetArtifact.Size != subject.Size {
+		return fmt.Errorf("notation signature is for %s", payload.TargetArtifact.Digest)
+	}
+	return nil
+}
+
+// Verify with any trusted public key
+func (verifier *Verifier) verifyWithPublicKeys(verify func(crypto.PublicKey) error) error {
+	if len(verifier.publicKeys) == 0 {
+		return errors.New("signature has no certificate and no public key is trusted")
+	}
+	var errs []error
+	for _, key := range verifier.publicKeys {
+		err := verify(key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Verify with the leaf of a certificate chain, which is trusted when its key is trusted or when it's issued by a
+// trusted certificate authority for the trusted identity. Without a trusted timestamp the chain must be valid at
+// the current time, so only long-lived certificates of a private PKI work, not short-lived keyless ones.
+func (verifier *Verifier) verifyWithCertificates(chain []*x509.Certificate, verify func(crypto.PublicKey) error) error {
+	leaf := chain[0]
+	for _, key := range verifier.publicKeys {
+		if trusted, ok := key.(interface{ Equal(crypto.PublicKey) bool }); ok && trusted.Equal(leaf.PublicKey) {
+			return verify(leaf.PublicKey)
+		}
+	}
+	if verifier.roots == nil {
+		return fmt.Errorf("certificate %s is not for a trusted public key", leaf.Subject)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         verifier.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted certificate %s: %w", leaf.Subject, err)
+	}
+	if verifier.identity != "" && !hasIdentity(leaf, verifier.identity) {
+		return fmt.Errorf("certificate %s is not for %s", leaf.Subject, verifier.identity)
+	}
+	return verify(leaf.PublicKey)
+}
+
+func hasIdentity(certificate *x509.Certificate, identity string) bool {
+	if certificate.Subject.CommonName == identity || slices.Contains(certificate.EmailAddresses, identity) || slices.Contains(certificate.DNSNames, identity) {
+		return true
+	}
+	for _, uri := range certificate.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyCosignPayload(key crypto.PublicKey, payload []byte, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	var ok bool
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, payload, signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if !ok {
+		return errors.New("invalid cosign signature")
+	}
+	return nil
+}
+
+func verifyJWS(key crypto.PublicKey, algorithm string, signingInput []byte, signature []byte) error {
+	expected, hash, err := jwsAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	if algorithm != expected {
+		return fmt.Errorf("notation signature algorithm %s doesn't match the %s certificate key", algorithm, expected)
+	}
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	hashed := hasher.Sum(nil)
+
+	var ok bool
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			ok = ecdsa.Verify(key, hashed, r, s)
+		}
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPSS(key, hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	if !ok {
+		return errors.New("invalid notation signature")
+	}
+	return nil
+}
+
+// CosignSignatureTag is the tag cosign pushes signatures of dgst to when not using the referrers API
+func CosignSignatureTag(dgst digest.Digest) string {
+	return dgst.Algorithm().String() + "-" + dgst.Encoded() + ".sig"
+}
@@ -0,0 +1,327 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signing
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// Create a CA and a code signing certificate it issued for key and identity
+func newTestChain(t *testing.T, key crypto.Signer, identity string) (*x509.Certificate, *x509.Certificate) {
+	t.Helper()
+	return newTestChainValidUntil(t, key, identity, time.Now().Add(time.Hour))
+}
+
+// newTestChain with a code signing certificate valid for the two hours before notAfter
+func newTestChainValidUntil(t *testing.T, key crypto.Signer, identity string, notAfter time.Time) (*x509.Certificate, *x509.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "soci-indexer-test-ca"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "soci-indexer-test"},
+		EmailAddresses: []string{identity},
+		NotBefore:      notAfter.Add(-2 * time.Hour),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, leaf
+}
+
+// Sign testSubject into a new store
+func signTestSignature(t *testing.T, format string, key crypto.Signer, certificates []*x509.Certificate) (*memory.Store, ocispec.Descriptor) {
+	t.Helper()
+	signer, err := NewSigner(format, key, certificates)
+	if err != nil {
+		t.Fatalf("NewSigner returned error: %v", err)
+	}
+	store := memory.New()
+	desc, err := signer.Sign(context.Background(), store, "registry.example.com/example/repo", testSubject)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	return store, desc
+}
+
+func TestVerify(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, leaf := newTestChain(t, ecdsaKey, "release@example.com")
+	otherCA, _ := newTestChain(t, otherKey, "release@example.com")
+
+	otherSubject := testSubject
+	otherSubject.Digest = digest.Digest("sha256:4444444444444444444444444444444444444444444444444444444444444444")
+
+	tests := []struct {
+		name         string
+		format       string
+		key          crypto.Signer
+		certificates []*x509.Certificate
+		publicKeys   []crypto.PublicKey
+		roots        []*x509.Certificate
+		identity     string
+		subject      ocispec.Descriptor
+		verified     bool
+	}{
+		{name: "cosign ecdsa key", format: FormatCosign, key: ecdsaKey, publicKeys: []crypto.PublicKey{ecdsaKey.Public()}, verified: true},
+		{name: "cosign ed25519 key", format: FormatCosign, key: ed25519Key, publicKeys: []crypto.PublicKey{otherKey.Public(), ed25519Key.Public()}, verified: true},
+		{name: "cosign untrusted key", format: FormatCosign, key: ecdsaKey, publicKeys: []crypto.PublicKey{otherKey.Public()}},
+		{name: "cosign certificate", format: FormatCosign, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, roots: []*x509.Certificate{ca}, identity: "release@example.com", verified: true},
+		{name: "cosign without certificate and only a CA", format: FormatCosign, key: ecdsaKey, roots: []*x509.Certificate{ca}},
+		{name: "cosign other subject", format: FormatCosign, key: ecdsaKey, publicKeys: []crypto.PublicKey{ecdsaKey.Public()}, subject: otherSubject},
+		{name: "notation CA and identity", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf, ca}, roots: []*x509.Certificate{ca}, identity: "release@example.com", verified: true},
+		{name: "notation CA", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, roots: []*x509.Certificate{ca}, verified: true},
+		{name: "notation public key", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, publicKeys: []crypto.PublicKey{ecdsaKey.Public()}, verified: true},
+		{name: "notation wrong identity", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, roots: []*x509.Certificate{ca}, identity: "someone@example.com"},
+		{name: "notation untrusted CA", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, roots: []*x509.Certificate{otherCA}},
+		{name: "notation other subject", format: FormatNotation, key: ecdsaKey, certificates: []*x509.Certificate{leaf}, roots: []*x509.Certificate{ca}, subject: otherSubject},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, desc := signTestSignature(t, test.format, test.key, test.certificates)
+			verifier, err := NewVerifier(test.publicKeys, test.roots, test.identity)
+			if err != nil {
+				t.Fatalf("NewVerifier returned error: %v", err)
+			}
+			subject := testSubject
+			if test.subject.Digest != "" {
+				subject = test.subject
+			}
+
+			err = verifier.Verify(context.Background(), store, desc, subject)
+			if test.verified && err != nil {
+				t.Fatalf("Verify returned error: %v", err)
+			}
+			if !test.verified && !errors.Is(err, ErrNoValidSignature) {
+				t.Fatalf("expected ErrNoValidSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyNotationBackdated(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(-time.Hour)
+	ca, expired := newTestChainValidUntil(t, key, "release@example.com", expiry)
+
+	// the signing time is within the validity of the expired certificate, but it's set by the signer
+	signer, err := NewSigner(FormatNotation, key, []*x509.Certificate{expired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.now = func() time.Time {
+		return expiry.Add(-time.Hour)
+	}
+	store := memory.New()
+	desc, err := signer.Sign(context.Background(), store, "registry.example.com/example/repo", testSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifier(nil, []*x509.Certificate{ca}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), store, desc, testSubject); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected a backdated signature with an expired certificate to fail, got %v", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier([]crypto.PublicKey{key.Public()}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, desc := signTestSignature(t, FormatCosign, key, nil)
+	manifestContent, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a payload for another image with the original signature
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	payloadContent, err := content.FetchAll(ctx, store, manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedPayload := bytes.Replace(payloadContent, []byte("registry.example.com"), []byte("evil.example.com"), 1)
+	manifest.Layers[0].Digest = digest.FromBytes(tamperedPayload)
+	manifest.Layers[0].Size = int64(len(tamperedPayload))
+	if err := pushContent(ctx, store, manifest.Layers[0], tamperedPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a second layer with a signature that isn't base64
+	invalidLayer := manifest.Layers[0]
+	invalidLayer.Annotations = map[string]string{cosignSignatureAnnotation: "not base64!"}
+	manifest.Layers = append(manifest.Layers, invalidLayer)
+
+	tamperedContent, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(tamperedContent), Size: int64(len(tamperedContent))}
+	if err := pushContent(ctx, store, tamperedDesc, tamperedContent); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifier.Verify(ctx, store, tamperedDesc, testSubject); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected ErrNoValidSignature, got %v", err)
+	}
+
+	// one valid layer is enough, like cosign tags with several signatures
+	manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+		MediaType:   CosignSimpleSigningMediaType,
+		Digest:      digest.FromBytes(payloadContent),
+		Size:        int64(len(payloadContent)),
+		Annotations: map[string]string{cosignSignatureAnnotation: mustCosignSignature(t, key, payloadContent)},
+	})
+	validContent, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(validContent), Size: int64(len(validContent))}
+	if err := pushContent(ctx, store, validDesc, validContent); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(ctx, store, validDesc, testSubject); err != nil {
+		t.Fatalf("Verify returned error: %v", err)
+	}
+}
+
+func TestVerifySigstoreBundle(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier([]crypto.PublicKey{key.Public()}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memory.New()
+	bundleContent := []byte(`{"mediaType":"application/vnd.dev.sigstore.bundle.v0.3+json"}`)
+	bundleDesc := ocispec.Descriptor{
+		MediaType: "application/vnd.dev.sigstore.bundle.v0.3+json",
+		Digest:    digest.FromBytes(bundleContent),
+		Size:      int64(len(bundleContent)),
+	}
+	if err := pushContent(ctx, store, bundleDesc, bundleContent); err != nil {
+		t.Fatal(err)
+	}
+	manifestContent, err := json.Marshal(ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: bundleDesc.MediaType,
+		Layers:       []ocispec.Descriptor{bundleDesc},
+		Subject:      &testSubject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestContent), Size: int64(len(manifestContent))}
+	if err := pushContent(ctx, store, desc, manifestContent); err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifier.Verify(ctx, store, desc, testSubject)
+	if !errors.Is(err, ErrUnsupportedSignatureFormat) || errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected ErrUnsupportedSignatureFormat, got %v", err)
+	}
+	if !IsUnsupportedSignature(bundleDesc.MediaType) || IsUnsupportedSignature(CosignArtifactType) {
+		t.Fatal("expected only sigstore bundles to be unsupported signatures")
+	}
+}
+
+func mustCosignSignature(t *testing.T, key crypto.Signer, payload []byte) string {
+	t.Helper()
+	signature, err := signCosignPayload(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestNewVerifierErrors(t *testing.T) {
+	if _, err := NewVerifier(nil, nil, ""); err == nil {
+		t.Error("expected an error without keys or certificate authorities")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifier([]crypto.PublicKey{key.Public()}, nil, "release@example.com"); err == nil {
+		t.Error("expected an error with an identity but no certificate authority")
+	}
+}